@@ -0,0 +1,247 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * preferred allocation policies for plugin devices
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+const (
+	AllocPolicySpread      = "spread"       // least loaded APQN, spread over adapters (default)
+	AllocPolicyPack        = "pack"         // fill up APQNs and adapters before using new ones
+	AllocPolicySameAdapter = "same-adapter" // keep all devices of a request on one adapter
+)
+
+type allocdev_s struct {
+	id      string
+	adapter int
+	domain  int
+}
+
+// load counters for APQNs and adapters, APQN key is (256 * adapter) + domain
+type allocload_s struct {
+	apqns    map[int]int
+	adapters map[int]int
+}
+
+func (l *allocload_s) add(d *allocdev_s) {
+	l.apqns[256*d.adapter+d.domain]++
+	l.adapters[d.adapter]++
+}
+
+func (l *allocload_s) apqn(d *allocdev_s) int {
+	return l.apqns[256*d.adapter+d.domain]
+}
+
+func (l *allocload_s) adapter(d *allocdev_s) int {
+	return l.adapters[d.adapter]
+}
+
+func parseAllocDev(id string) (*allocdev_s, error) {
+
+	var card, queue, overcount int
+	n, err := fmt.Sscanf(id, ApqnFmtStr, &card, &queue, &overcount)
+	if err != nil || n < 3 {
+		return nil, fmt.Errorf("Error parsing device id '%s'", id)
+	}
+
+	return &allocdev_s{id: id, adapter: card, domain: queue}, nil
+}
+
+// allocPreferredDevs chooses size devices out of the available devices.
+// The mustinclude devices are always part of the result. The inuse devices
+// are the plugin devices currently allocated by other containers and are
+// the base for the load calculation of the APQNs and adapters. As the
+// zcrypt node grants access to all combinations of the adapters and domains
+// of the chosen devices, devices of the config set (setapqns) are preferred
+// which keep each of these combinations an APQN of the chosen devices and
+// which add a new APQN. If there are not enough of them, the other devices
+// fill up the request, so always size devices are returned if available.
+// Allocate rejects such a request, see apqnsForDevs.
+func allocPreferredDevs(policy string, available, mustinclude []string, size int,
+	inuse []string, setapqns APQNList) ([]string, error) {
+
+	var chosen []string
+	var candidates []*allocdev_s
+
+	load := &allocload_s{
+		apqns:    map[int]int{},
+		adapters: map[int]int{},
+	}
+	inset := map[int]bool{}
+	for _, a := range setapqns {
+		inset[256*a.Adapter+a.Domain] = true
+	}
+	adapters, domains, apqns := map[int]bool{}, map[int]bool{}, map[int]bool{}
+	// fits returns true if device d is an APQN of the config set and all
+	// the adapter and domain combinations with device d are still APQNs of
+	// the chosen devices or device d itself
+	fits := func(d *allocdev_s) bool {
+		if !inset[256*d.adapter+d.domain] {
+			return false
+		}
+		covered := func(a, q int) bool {
+			return (a == d.adapter && q == d.domain) || apqns[256*a+q]
+		}
+		for a := range adapters {
+			if !covered(a, d.domain) {
+				return false
+			}
+		}
+		for q := range domains {
+			if !covered(d.adapter, q) {
+				return false
+			}
+		}
+		return true
+	}
+	// only devices which fit extend the adapters and domains, the others
+	// are not accessible anyway
+	choose := func(d *allocdev_s) {
+		if fits(d) {
+			adapters[d.adapter] = true
+			domains[d.domain] = true
+		}
+		load.add(d)
+		chosen = append(chosen, d.id)
+		apqns[256*d.adapter+d.domain] = true
+	}
+	for _, id := range inuse {
+		if d, err := parseAllocDev(id); err == nil {
+			load.add(d)
+		}
+	}
+
+	isChosen := map[string]bool{}
+	for _, id := range mustinclude {
+		d, err := parseAllocDev(id)
+		if err != nil {
+			return nil, err
+		}
+		if !fits(d) {
+			log.Printf("AllocPolicy: Must include devices %v don't cover all their adapter and domain combinations\n", mustinclude)
+		}
+		choose(d)
+		isChosen[id] = true
+	}
+
+	for _, id := range available {
+		if isChosen[id] {
+			continue
+		}
+		d, err := parseAllocDev(id)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, d)
+	}
+	// deterministic order, the last resort tie breaker is the device id
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].id < candidates[j].id })
+
+	// with the same-adapter policy the adapter is fixed by the first
+	// mustinclude device or chosen as the adapter which can serve the
+	// most of the requested devices with the lowest load
+	sameadapter := -1
+	if policy == AllocPolicySameAdapter {
+		if len(mustinclude) > 0 {
+			d, _ := parseAllocDev(mustinclude[0])
+			sameadapter = d.adapter
+		} else {
+			avail := map[int]int{}
+			for _, d := range candidates {
+				if fits(d) {
+					avail[d.adapter]++
+				}
+			}
+			for _, d := range candidates {
+				if sameadapter < 0 {
+					sameadapter = d.adapter
+					continue
+				}
+				n, m := min(avail[d.adapter], size), min(avail[sameadapter], size)
+				if n > m || (n == m && load.adapters[d.adapter] < load.adapters[sameadapter]) {
+					sameadapter = d.adapter
+				}
+			}
+		}
+	}
+
+	// better returns true if device a is preferred over device b
+	better := func(a, b *allocdev_s) bool {
+		switch policy {
+		case AllocPolicyPack:
+			if load.apqn(a) != load.apqn(b) {
+				return load.apqn(a) > load.apqn(b)
+			}
+			if load.adapter(a) != load.adapter(b) {
+				return load.adapter(a) > load.adapter(b)
+			}
+		case AllocPolicySameAdapter:
+			if (a.adapter == sameadapter) != (b.adapter == sameadapter) {
+				return a.adapter == sameadapter
+			}
+			fallthrough
+		default:
+			if load.apqn(a) != load.apqn(b) {
+				return load.apqn(a) < load.apqn(b)
+			}
+			if load.adapter(a) != load.adapter(b) {
+				return load.adapter(a) < load.adapter(b)
+			}
+		}
+		return a.id < b.id
+	}
+
+	// tier of a device, lower is preferred: a new APQN which fits, a new
+	// APQN which doesn't fit, an APQN already chosen for this request
+	tier := func(d *allocdev_s) int {
+		switch {
+		case apqns[256*d.adapter+d.domain]:
+			return 2
+		case !fits(d):
+			return 1
+		}
+		return 0
+	}
+
+	for len(chosen) < size && len(candidates) > 0 {
+		best, besttier := -1, 0
+		for i, d := range candidates {
+			t := tier(d)
+			if best < 0 || t < besttier || (t == besttier && better(d, candidates[best])) {
+				best, besttier = i, t
+			}
+		}
+		d := candidates[best]
+		candidates = append(candidates[:best], candidates[best+1:]...)
+		if besttier == 1 {
+			log.Printf("AllocPolicy: Device %s doesn't fit to the adapter and domain combinations of %v\n", d.id, chosen)
+		}
+		choose(d)
+	}
+
+	if len(chosen) < size {
+		log.Printf("AllocPolicy: Only %d of %d requested devices available\n", len(chosen), size)
+	}
+
+	return chosen, nil
+}
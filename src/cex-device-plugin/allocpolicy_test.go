@@ -0,0 +1,186 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * tests for the preferred allocation policies
+ */
+
+// run with
+// $ go test -run AllocPreferred
+
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAllocPreferredDevs(t *testing.T) {
+	var tests = []struct {
+		name        string
+		policy      string
+		available   []string
+		mustinclude []string
+		size        int
+		inuse       []string
+		set         []string // APQNs of the config set, default all APQNs of the devices
+		want        []string
+		rejected    bool // Allocate rejects the preferred devices
+	}{
+		{
+			name:      "spread picks unused APQN",
+			policy:    AllocPolicySpread,
+			available: []string{"apqn-1-5-1", "apqn-2-5-0", "apqn-2-5-1"},
+			size:      1,
+			inuse:     []string{"apqn-1-5-0"},
+			want:      []string{"apqn-2-5-0"},
+		},
+		{
+			name:      "spread over distinct adapters",
+			policy:    AllocPolicySpread,
+			available: []string{"apqn-1-5-0", "apqn-1-6-0", "apqn-2-5-0", "apqn-2-6-0"},
+			size:      2,
+			want:      []string{"apqn-1-5-0", "apqn-2-5-0"},
+		},
+		{
+			name:      "spread prefers less loaded adapter",
+			policy:    AllocPolicySpread,
+			available: []string{"apqn-1-6-0", "apqn-2-6-0"},
+			size:      1,
+			inuse:     []string{"apqn-1-5-0"},
+			want:      []string{"apqn-2-6-0"},
+		},
+		{
+			name:      "empty policy is spread",
+			policy:    "",
+			available: []string{"apqn-1-5-1", "apqn-2-5-1"},
+			size:      1,
+			inuse:     []string{"apqn-1-5-0"},
+			want:      []string{"apqn-2-5-1"},
+		},
+		{
+			name:      "pack fills used APQN",
+			policy:    AllocPolicyPack,
+			available: []string{"apqn-1-5-1", "apqn-2-5-0", "apqn-2-5-1"},
+			size:      1,
+			inuse:     []string{"apqn-2-5-2"},
+			want:      []string{"apqn-2-5-0"},
+		},
+		{
+			name:      "same-adapter keeps request on one adapter",
+			policy:    AllocPolicySameAdapter,
+			available: []string{"apqn-1-5-0", "apqn-2-5-0", "apqn-2-6-0"},
+			size:      2,
+			want:      []string{"apqn-2-5-0", "apqn-2-6-0"},
+		},
+		{
+			name:        "same-adapter follows mustinclude",
+			policy:      AllocPolicySameAdapter,
+			available:   []string{"apqn-1-5-0", "apqn-1-6-0", "apqn-2-5-0", "apqn-2-6-0"},
+			mustinclude: []string{"apqn-1-5-0"},
+			size:        2,
+			want:        []string{"apqn-1-5-0", "apqn-1-6-0"},
+		},
+		{
+			name:      "spread prefers adapter domain combinations in the set",
+			policy:    AllocPolicySpread,
+			available: []string{"apqn-1-1-0", "apqn-1-2-0", "apqn-2-2-0"},
+			size:      2,
+			want:      []string{"apqn-1-1-0", "apqn-1-2-0"},
+		},
+		{
+			// no second APQN keeps the combinations in the set, a new APQN
+			// is still preferred over the same APQN twice
+			name:      "spread fills up with APQNs outside of the combinations",
+			policy:    AllocPolicySpread,
+			available: []string{"apqn-1-1-0", "apqn-1-1-1", "apqn-2-2-0", "apqn-2-2-1"},
+			size:      2,
+			set:       []string{"apqn-1-1-0", "apqn-2-2-0"},
+			want:      []string{"apqn-1-1-0", "apqn-2-2-0"},
+			rejected:  true,
+		},
+		{
+			// the less loaded (2,6) would grant (1,6) and (2,5), which are
+			// in the set but not allocated to this container
+			name:        "spread keeps combinations within the chosen devices",
+			policy:      AllocPolicySpread,
+			available:   []string{"apqn-2-5-0", "apqn-2-6-0"},
+			mustinclude: []string{"apqn-1-5-0"},
+			size:        2,
+			inuse:       []string{"apqn-2-5-1"},
+			set:         []string{"apqn-1-5-0", "apqn-1-6-0", "apqn-2-5-0", "apqn-2-6-0"},
+			want:        []string{"apqn-1-5-0", "apqn-2-5-0"},
+		},
+		{
+			name:      "spread takes the same APQN as last resort",
+			policy:    AllocPolicySpread,
+			available: []string{"apqn-1-1-0", "apqn-1-1-1"},
+			size:      2,
+			want:      []string{"apqn-1-1-0", "apqn-1-1-1"},
+		},
+		{
+			name:      "spread over adapters with all combinations in the set",
+			policy:    AllocPolicySpread,
+			available: []string{"apqn-1-1-0", "apqn-2-2-0", "apqn-2-1-0"},
+			size:      2,
+			set:       []string{"apqn-1-1-0", "apqn-2-2-0", "apqn-2-1-0"},
+			want:      []string{"apqn-1-1-0", "apqn-2-1-0"},
+		},
+		{
+			name:        "same-adapter leaves adapter for domain combinations",
+			policy:      AllocPolicySameAdapter,
+			available:   []string{"apqn-1-5-0", "apqn-2-5-0", "apqn-2-6-0"},
+			mustinclude: []string{"apqn-1-5-0"},
+			size:        2,
+			want:        []string{"apqn-1-5-0", "apqn-2-5-0"},
+		},
+		{
+			name:      "not enough devices",
+			policy:    AllocPolicySpread,
+			available: []string{"apqn-1-5-0"},
+			size:      2,
+			want:      []string{"apqn-1-5-0"},
+		},
+	}
+	for _, test := range tests {
+		set := test.set
+		if set == nil {
+			set = slices.Concat(test.available, test.mustinclude, test.inuse)
+		}
+		p := &ZCryptoResPlugin{resource: test.name}
+		for _, id := range set {
+			d, _ := parseAllocDev(id)
+			if !slices.ContainsFunc(p.apqns, func(a *APQN) bool { return a.Adapter == d.adapter && a.Domain == d.domain }) {
+				p.apqns = append(p.apqns, &APQN{Adapter: d.adapter, Domain: d.domain})
+			}
+		}
+		got, err := allocPreferredDevs(test.policy, test.available, test.mustinclude, test.size, test.inuse, p.apqns)
+		if err != nil {
+			t.Errorf(`allocPreferredDevs for "%s" failed: %s`, test.name, err)
+			continue
+		} else if !slices.Equal(got, test.want) {
+			t.Errorf(`allocPreferredDevs for "%s" returned %q, expected %q`, test.name, got, test.want)
+		}
+		// Allocate must accept the preferred devices, unless they don't
+		// cover all their adapter and domain combinations
+		if _, _, _, err := p.apqnsForDevs(got); (err != nil) != test.rejected {
+			t.Errorf(`apqnsForDevs for devices %q preferred for "%s" returned %v`, got, test.name, err)
+		}
+	}
+
+	if _, err := allocPreferredDevs(AllocPolicySpread, []string{"foo"}, nil, 1, nil, nil); err == nil {
+		t.Errorf(`allocPreferredDevs with invalid device id did not fail`)
+	}
+}
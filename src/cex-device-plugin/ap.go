@@ -29,7 +29,10 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -40,18 +43,119 @@ const (
 var apsysfsdir = getenvstr("APSYSFS_BUSDIR", "/sys/bus/ap")
 var apsysfsdevsdir = getenvstr("APSYSFS_DEVSDIR", "/sys/devices/ap")
 
+// card info like the serial number is fetched by the kernel with a
+// request to the crypto card on each read, so these attributes are cached
+var apInfoCacheTime = time.Duration(getenvint("APQN_INFO_CACHE_TIME", 300, 0, 3600))
+
+// the mkvps queue attribute is fetched the same way, but reused only for
+// a short time as a master key change does not show up as AP bus event
+var apMKVPsCacheTime = time.Duration(getenvint("APQN_MKVPS_CACHE_TIME", 60, 0, 3600))
+
+// compiled once, the AP bus scan runs for every card and queue dir
+var (
+	apCardDirRegex  = regexp.MustCompile("card[[:xdigit:]]{2}")
+	apQueueDirRegex = regexp.MustCompile("[[:xdigit:]]{2}\\.[[:xdigit:]]{4}")
+	apCardTypeRegex = regexp.MustCompile("CEX[[:digit:]]+[ACP]")
+)
+
+// reasons for an APQN not being healthy, the card state comes first
+const (
+	ApqnReasonDeconfigured = "deconfigured" // card or queue configured off (config is 0)
+	ApqnReasonCheckstopped = "checkstopped" // card or queue in checkstop state (chkstop is 1)
+	ApqnReasonOffline      = "offline"      // queue switched offline
+	ApqnReasonInReset      = "in-reset"     // queue reset in progress
+	ApqnReasonErrorState   = "error-state"  // queue device in error state
+)
+
+// MKVP is the state and verification pattern of one master key register.
+// CCA queues have the registers "AES NEW", "AES CUR", "AES OLD", "APKA NEW"
+// ..., EP11 queues the wrapping key registers "WK CUR" and "WK NEW".
+type MKVP struct {
+	Register string `json:"register"`     // like "AES CUR" or "WK CUR"
+	State    string `json:"state"`        // like "valid", "empty", "full" or "committed"
+	VP       string `json:"vp,omitempty"` // verification pattern "0x<hex>", for EP11 the WK id
+}
+
 type APQN struct {
 	Adapter int    `json:"adapter"`
 	Domain  int    `json:"domain"`
-	Gen     string `json:"gen"`    // something like "cex7"
-	Mode    string `json:"mode"`   // mode string "ep11" or "cca" or "accel"
-	Online  bool   `json:"online"` // true = online, false = offline
+	Gen     string `json:"gen"`              // something like "cex7"
+	Mode    string `json:"mode"`             // mode string "ep11" or "cca" or "accel"
+	Online  bool   `json:"online"`           // true = online, false = offline
+	Healthy bool   `json:"healthy"`          // online and none of the problems below
+	Reason  string `json:"reason,omitempty"` // why the APQN is not healthy
+	// Secure Execution state, only provided by the kernel of an SE guest
+	SEBind      string `json:"se_bind,omitempty"`      // "bound", "unbound" or "-" if bind is not supported
+	SEAssociate string `json:"se_associate,omitempty"` // "associated <idx>", "association pending", "unassociated" or "-"
+	// card info and master keys, only provided by CCA and EP11 cards
+	Serialnr   string `json:"serialnr,omitempty"`
+	FWVersion  string `json:"fw_version,omitempty"`    // EP11 only, like "7.15"
+	APIOrdinal int    `json:"api_ordinalnr,omitempty"` // EP11 only
+	MKVPs      []MKVP `json:"mkvps,omitempty"`
 }
 
 func (a *APQN) String() string {
+	if len(a.Reason) > 0 {
+		return fmt.Sprintf("(%d,%d,%s,%s,%v,%s)", a.Adapter, a.Domain, a.Gen, a.Mode, a.Online, a.Reason)
+	}
 	return fmt.Sprintf("(%d,%d,%s,%s,%v)", a.Adapter, a.Domain, a.Gen, a.Mode, a.Online)
 }
 
+// SEUsable returns true if the APQN can be used by a Secure Execution
+// guest: the queue is bound and EP11 queues are also associated
+func (a *APQN) SEUsable() bool {
+
+	if a.SEBind != "bound" {
+		return false
+	}
+	if a.Mode == "ep11" {
+		return strings.HasPrefix(a.SEAssociate, "associated")
+	}
+
+	return true
+}
+
+// apNormalizeMKVP returns a verification pattern in the form the kernel
+// shows it: lower case hex digits with 0x prefix
+func apNormalizeMKVP(vp string) string {
+
+	vp = strings.ToLower(vp)
+	if !strings.HasPrefix(vp, "0x") {
+		vp = "0x" + vp
+	}
+
+	return vp
+}
+
+// CurrentMKVPs returns the verification patterns of the valid current
+// master key registers of the APQN
+func (a *APQN) CurrentMKVPs() []string {
+
+	var vps []string
+	for _, m := range a.MKVPs {
+		if strings.HasSuffix(m.Register, " CUR") && m.State == "valid" && len(m.VP) > 0 {
+			vps = append(vps, m.VP)
+		}
+	}
+
+	return vps
+}
+
+// HasCurrentMKVP returns true if one of the current master keys of the
+// APQN has one of the given verification patterns
+func (a *APQN) HasCurrentMKVP(vps []string) bool {
+
+	for _, cur := range a.CurrentMKVPs() {
+		for _, vp := range vps {
+			if cur == apNormalizeMKVP(vp) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 type APQNList []*APQN
 
 func (l APQNList) String() string {
@@ -99,6 +203,192 @@ func apReadFirstLineFromFile(fname string) (string, error) {
 	return str, nil
 }
 
+// apReadOptionalAttr reads a sysfs attribute which is not available with
+// all kernel versions, an empty string is returned if it does not exist
+func apReadOptionalAttr(fname string) string {
+
+	str, err := apReadFirstLineFromFile(fname)
+	if err != nil {
+		return ""
+	}
+
+	return str
+}
+
+type apinfo_s struct {
+	value   string
+	fetched time.Time
+}
+
+var (
+	apinfocache = map[string]*apinfo_s{}
+	apinfomutex sync.Mutex
+	// last successfully read mkvps attribute per queue
+	apmkvpscache = map[string]*apinfo_s{}
+)
+
+// apReadCachedAttr reads a whole sysfs attribute which requires a request
+// to the crypto card, the value is reused for APQN_INFO_CACHE_TIME seconds.
+// Read failures (attribute not supported, queue offline) are not cached.
+func apReadCachedAttr(fname string) string {
+
+	apinfomutex.Lock()
+	defer apinfomutex.Unlock()
+
+	e, found := apinfocache[fname]
+	if found && time.Since(e.fetched) < apInfoCacheTime*time.Second {
+		return e.value
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		delete(apinfocache, fname)
+		return ""
+	}
+	e = &apinfo_s{value: strings.TrimSpace(string(data)), fetched: time.Now()}
+	apinfocache[fname] = e
+
+	return e.value
+}
+
+// apPurgeInfoCache drops the cached attributes which have expired, this
+// also removes the ones of vanished cards and queues
+func apPurgeInfoCache() {
+
+	apinfomutex.Lock()
+	defer apinfomutex.Unlock()
+
+	for fname, e := range apinfocache {
+		if time.Since(e.fetched) >= apInfoCacheTime*time.Second {
+			delete(apinfocache, fname)
+		}
+	}
+}
+
+// apReadMKVPs reads the mkvps attribute of a queue, the value is reused
+// for APQN_MKVPS_CACHE_TIME seconds. When the read fails (queue offline,
+// in error state) the last read value is returned, so a mkvps filter
+// keeps an unhealthy APQN in its set.
+func apReadMKVPs(fname string) string {
+
+	apinfomutex.Lock()
+	defer apinfomutex.Unlock()
+
+	e, found := apmkvpscache[fname]
+	if found && time.Since(e.fetched) < apMKVPsCacheTime*time.Second {
+		return e.value
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		if found {
+			return e.value
+		}
+		return ""
+	}
+	e = &apinfo_s{value: strings.TrimSpace(string(data)), fetched: time.Now()}
+	apmkvpscache[fname] = e
+
+	return e.value
+}
+
+// apMKVPsFileName returns the name of the mkvps attribute of a queue
+func apMKVPsFileName(carddir, queuedir string) string {
+
+	return apsysfsdevsdir + "/" + carddir + "/" + queuedir + "/mkvps"
+}
+
+// apPurgeMKVPsCache drops the cached mkvps attributes of the queues which
+// are not in the given list of APQNs any more
+func apPurgeMKVPsCache(apqns APQNList) {
+
+	fnames := map[string]bool{}
+	for _, a := range apqns {
+		carddir := fmt.Sprintf("card%02x", a.Adapter)
+		queuedir := fmt.Sprintf("%02x.%04x", a.Adapter, a.Domain)
+		fnames[apMKVPsFileName(carddir, queuedir)] = true
+	}
+
+	apinfomutex.Lock()
+	defer apinfomutex.Unlock()
+
+	for fname := range apmkvpscache {
+		if !fnames[fname] {
+			delete(apmkvpscache, fname)
+		}
+	}
+}
+
+// apParseMKVPs parses the content of the mkvps queue attribute. Each
+// line is "<register>: <state> <verification pattern>", with a "-" as
+// pattern for registers without a key.
+func apParseMKVPs(str string) []MKVP {
+
+	var mkvps []MKVP
+	for _, line := range strings.Split(str, "\n") {
+		reg, rest, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		m := MKVP{Register: strings.TrimSpace(reg)}
+		fields := strings.Fields(rest)
+		if len(fields) > 0 {
+			m.State = fields[0]
+		}
+		if len(fields) > 1 && fields[1] != "-" {
+			m.VP = apNormalizeMKVP(fields[1])
+		}
+		mkvps = append(mkvps, m)
+	}
+
+	return mkvps
+}
+
+// apCardHealthReason returns why the APQNs of a card are not healthy or
+// an empty string if the card is fine
+func apCardHealthReason(carddir string) string {
+
+	dir := apsysfsdevsdir + "/" + carddir
+	if apReadOptionalAttr(dir+"/config") == "0" {
+		return ApqnReasonDeconfigured
+	}
+	if apReadOptionalAttr(dir+"/chkstop") == "1" {
+		return ApqnReasonCheckstopped
+	}
+
+	return ""
+}
+
+// apQueueHealthReason returns why the APQN is not healthy or an empty
+// string if the queue is fine
+func apQueueHealthReason(carddir, queuedir string, online bool) string {
+
+	dir := apsysfsdevsdir + "/" + carddir + "/" + queuedir
+	if apReadOptionalAttr(dir+"/config") == "0" {
+		return ApqnReasonDeconfigured
+	}
+	if apReadOptionalAttr(dir+"/chkstop") == "1" {
+		return ApqnReasonCheckstopped
+	}
+	if !online {
+		return ApqnReasonOffline
+	}
+	if strings.HasPrefix(apReadOptionalAttr(dir+"/reset"), "Reset in progress") {
+		return ApqnReasonInReset
+	}
+	// the states attribute is only available with zcrypt debug support
+	if strings.Contains(apReadOptionalAttr(dir+"/states"), "ERROR") {
+		return ApqnReasonErrorState
+	}
+
+	return ""
+}
+
+// apQueueLastErrRC returns the return code of the last error of a queue,
+// only available with zcrypt debug support
+func apQueueLastErrRC(ap, dom int) string {
+
+	return apReadOptionalAttr(fmt.Sprintf("%s/card%02x/%02x.%04x/last_err_rc", apsysfsdevsdir, ap, ap, dom))
+}
+
 func apScanQueueDir(carddir, queuedir string) (*APQN, error) {
 
 	var card, queue int
@@ -119,6 +409,11 @@ func apScanQueueDir(carddir, queuedir string) (*APQN, error) {
 	if online[0] == '1' {
 		a.Online = true
 	}
+	a.Reason = apQueueHealthReason(carddir, queuedir, a.Online)
+	a.Healthy = len(a.Reason) == 0
+	a.SEBind = apReadOptionalAttr(apsysfsdevsdir + "/" + carddir + "/" + queuedir + "/se_bind")
+	a.SEAssociate = apReadOptionalAttr(apsysfsdevsdir + "/" + carddir + "/" + queuedir + "/se_associate")
+	a.MKVPs = apParseMKVPs(apReadMKVPs(apMKVPsFileName(carddir, queuedir)))
 
 	//fmt.Printf("debug: apScanQueueDir apqn=%v\n", a)
 	return a, nil
@@ -139,8 +434,7 @@ func apScanCardDir(carddir string) (APQNList, error) {
 		log.Printf("Ap: Error reading 'type' file from card directory '%s': %s\n", carddir, err)
 		return nil, fmt.Errorf("Ap: Error reading 'type' file from card directory '%s': %w", carddir, err)
 	}
-	match, _ := regexp.MatchString("CEX[[:digit:]]+[ACP]", cardtype)
-	if !match {
+	if !apCardTypeRegex.MatchString(cardtype) {
 		log.Printf("Ap: Error matching cardtype '%s' from card directory '%s'\n", cardtype, carddir)
 		return nil, fmt.Errorf("Ap: Error matching cardtype '%s' from card directory '%s'", cardtype, carddir)
 	}
@@ -162,11 +456,18 @@ func apScanCardDir(carddir string) (APQNList, error) {
 		cmode = "ep11"
 	}
 	//fmt.Printf("debug: cardgen=cex%d cardmode=%c\n", cardgen, cardmode)
+	cardreason := apCardHealthReason(carddir)
+	var serialnr, fwversion string
+	var apiordinal int
+	if cmode != "accel" && len(cardreason) == 0 {
+		serialnr = apReadCachedAttr(apsysfsdevsdir + "/" + carddir + "/serialnr")
+		fwversion = apReadCachedAttr(apsysfsdevsdir + "/" + carddir + "/FW_version")
+		fmt.Sscanf(apReadCachedAttr(apsysfsdevsdir+"/"+carddir+"/API_ordinalnr"), "%d", &apiordinal)
+	}
 
 	for _, file := range files {
 		fname := file.Name()
-		match, _ := regexp.MatchString("[[:xdigit:]]{2}\\.[[:xdigit:]]{4}", fname)
-		if !match {
+		if !apQueueDirRegex.MatchString(fname) {
 			continue
 		}
 		//fmt.Printf("debug: scaning queuedir %s\n", fname)
@@ -176,6 +477,10 @@ func apScanCardDir(carddir string) (APQNList, error) {
 		}
 		a.Gen = cgen
 		a.Mode = cmode
+		a.Serialnr, a.FWVersion, a.APIOrdinal = serialnr, fwversion, apiordinal
+		if len(cardreason) > 0 {
+			a.Healthy, a.Reason = false, cardreason
+		}
 		apqns = append(apqns, a)
 	}
 
@@ -187,6 +492,8 @@ func apScanAPQNs(verbose bool) (APQNList, error) {
 
 	var apqns APQNList
 
+	apPurgeInfoCache()
+
 	// scan ap bus dirs and fetch available apqns
 	files, err := os.ReadDir(apsysfsdevsdir)
 	if err != nil {
@@ -195,8 +502,7 @@ func apScanAPQNs(verbose bool) (APQNList, error) {
 	}
 	for _, file := range files {
 		fname := file.Name()
-		match, _ := regexp.MatchString("card[[:xdigit:]]{2}", fname)
-		if !match {
+		if !apCardDirRegex.MatchString(fname) {
 			continue
 		}
 		//fmt.Printf("debug: scaning carddir %s\n", fname)
@@ -206,6 +512,7 @@ func apScanAPQNs(verbose bool) (APQNList, error) {
 		}
 		apqns = append(apqns, cardapqns...)
 	}
+	apPurgeMKVPsCache(apqns)
 
 	if verbose {
 		log.Printf("Ap: apScanAPQNs() found %d APQNs: %s\n", len(apqns), apqns)
@@ -235,6 +542,18 @@ func apEqualAPQNLists(l1, l2 APQNList) bool {
 				if a1.Online != a2.Online {
 					return false
 				}
+				if a1.Healthy != a2.Healthy || a1.Reason != a2.Reason {
+					return false
+				}
+				if a1.SEBind != a2.SEBind || a1.SEAssociate != a2.SEAssociate {
+					return false
+				}
+				if a1.Serialnr != a2.Serialnr || a1.FWVersion != a2.FWVersion || a1.APIOrdinal != a2.APIOrdinal {
+					return false
+				}
+				if !slices.Equal(a1.MKVPs, a2.MKVPs) {
+					return false
+				}
 				found = true
 				break
 			}
@@ -263,3 +582,26 @@ func apGetQueueRequestCounter(ap, dom int) (int, error) {
 
 	return rcounter, nil
 }
+
+// apqstats_s holds the statistics of an AP queue
+type apqstats_s struct {
+	request_count  int // requests processed since the queue came up
+	pendingq_count int // requests sent to the card waiting for the reply
+	requestq_count int // requests queued in the kernel not yet sent to the card
+	load           int // weighted load of the queue, 0 if not provided
+}
+
+func apGetQueueStats(ap, dom int) (*apqstats_s, error) {
+
+	rcounter, err := apGetQueueRequestCounter(ap, dom)
+	if err != nil {
+		return nil, err
+	}
+	sysfsqueuedir := fmt.Sprintf("%s/card%02x/%02x.%04x", apsysfsdevsdir, ap, ap, dom)
+	s := &apqstats_s{request_count: rcounter}
+	fmt.Sscanf(apReadOptionalAttr(sysfsqueuedir+"/pendingq_count"), "%d", &s.pendingq_count)
+	fmt.Sscanf(apReadOptionalAttr(sysfsqueuedir+"/requestq_count"), "%d", &s.requestq_count)
+	fmt.Sscanf(apReadOptionalAttr(sysfsqueuedir+"/load"), "%d", &s.load)
+
+	return s, nil
+}
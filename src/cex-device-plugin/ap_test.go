@@ -0,0 +1,313 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * AP bus scanning
+ */
+
+// run with
+// $ go test -run Ap
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// apTestSysfsQueue creates or updates a queue dir in a fake AP sysfs tree
+func apTestSysfsQueue(t *testing.T, dir, cardtype string, card, dom int, online bool) {
+	carddir := filepath.Join(dir, fmt.Sprintf("card%02x", card))
+	queuedir := filepath.Join(carddir, fmt.Sprintf("%02x.%04x", card, dom))
+	if err := os.MkdirAll(queuedir, 0755); err != nil {
+		t.Fatalf(`Creating fake sysfs queue dir failed: %s`, err)
+	}
+	if err := os.WriteFile(filepath.Join(carddir, "type"), []byte(cardtype+"\n"), 0644); err != nil {
+		t.Fatalf(`Writing fake sysfs card type failed: %s`, err)
+	}
+	state := "0\n"
+	if online {
+		state = "1\n"
+	}
+	if err := os.WriteFile(filepath.Join(queuedir, "online"), []byte(state), 0644); err != nil {
+		t.Fatalf(`Writing fake sysfs online file failed: %s`, err)
+	}
+}
+
+func TestApHealthReasons(t *testing.T) {
+	savedir := apsysfsdevsdir
+	defer func() { apsysfsdevsdir = savedir }()
+	apsysfsdevsdir = t.TempDir()
+
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8P", 1, 1, true)
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8P", 1, 2, false)
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8P", 1, 3, true)
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8P", 1, 4, true)
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8P", 1, 5, true)
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8C", 2, 1, true)
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8C", 3, 1, true)
+	attrs := map[string]string{
+		"card01/01.0003/chkstop": "1",
+		"card01/01.0004/reset":   "Reset in progress.",
+		"card01/01.0005/states":  "ONLINE UNINITIATED ERROR",
+		"card02/config":          "0",
+		"card03/chkstop":         "1",
+		"card03/03.0001/reset":   "No Reset Timer set.",
+	}
+	for f, v := range attrs {
+		if err := os.WriteFile(filepath.Join(apsysfsdevsdir, f), []byte(v+"\n"), 0644); err != nil {
+			t.Fatalf(`Writing fake sysfs attribute %s failed: %s`, f, err)
+		}
+	}
+
+	apqns, err := apScanAPQNs(false)
+	if err != nil {
+		t.Fatalf(`apScanAPQNs failed: %s`, err)
+	}
+	want := map[string]string{
+		"(1,1)": "",
+		"(1,2)": ApqnReasonOffline,
+		"(1,3)": ApqnReasonCheckstopped,
+		"(1,4)": ApqnReasonInReset,
+		"(1,5)": ApqnReasonErrorState,
+		"(2,1)": ApqnReasonDeconfigured,
+		"(3,1)": ApqnReasonCheckstopped,
+	}
+	if len(apqns) != len(want) {
+		t.Fatalf(`apScanAPQNs returned %d APQNs: %s`, len(apqns), apqns)
+	}
+	for _, a := range apqns {
+		reason := want[fmt.Sprintf("(%d,%d)", a.Adapter, a.Domain)]
+		if a.Reason != reason || a.Healthy != (len(reason) == 0) {
+			t.Errorf(`apScanAPQNs returned %s, expected reason "%s"`, a, reason)
+		}
+	}
+}
+
+func TestApSecureExecution(t *testing.T) {
+	savedir := apsysfsdevsdir
+	defer func() { apsysfsdevsdir = savedir }()
+	apsysfsdevsdir = t.TempDir()
+
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8P", 1, 1, true)
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8P", 1, 2, true)
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8P", 1, 3, true)
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8A", 2, 1, true)
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8C", 3, 1, true)
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8C", 4, 1, true)
+	attrs := map[string]string{
+		"card01/01.0001/se_bind":      "bound",
+		"card01/01.0001/se_associate": "associated 5",
+		"card01/01.0002/se_bind":      "bound",
+		"card01/01.0002/se_associate": "association pending",
+		"card01/01.0003/se_bind":      "unbound",
+		"card01/01.0003/se_associate": "unassociated",
+		"card02/02.0001/se_bind":      "bound",
+		"card02/02.0001/se_associate": "-",
+		"card03/03.0001/se_bind":      "-",
+		"card03/03.0001/se_associate": "-",
+	}
+	for f, v := range attrs {
+		if err := os.WriteFile(filepath.Join(apsysfsdevsdir, f), []byte(v+"\n"), 0644); err != nil {
+			t.Fatalf(`Writing fake sysfs attribute %s failed: %s`, f, err)
+		}
+	}
+
+	apqns, err := apScanAPQNs(false)
+	if err != nil {
+		t.Fatalf(`apScanAPQNs failed: %s`, err)
+	}
+	want := map[string]bool{
+		"(1,1)": true,
+		"(1,2)": false,
+		"(1,3)": false,
+		"(2,1)": true,
+		"(3,1)": false,
+		"(4,1)": false, // not an SE guest
+	}
+	if len(apqns) != len(want) {
+		t.Fatalf(`apScanAPQNs returned %d APQNs: %s`, len(apqns), apqns)
+	}
+	for _, a := range apqns {
+		key := fmt.Sprintf("(%d,%d)", a.Adapter, a.Domain)
+		if a.SEUsable() != want[key] {
+			t.Errorf(`APQN %s with se_bind "%s" se_associate "%s" SEUsable returned %v`,
+				key, a.SEBind, a.SEAssociate, a.SEUsable())
+		}
+	}
+}
+
+func TestApCardInfo(t *testing.T) {
+	savedir := apsysfsdevsdir
+	defer func() { apsysfsdevsdir = savedir }()
+	apsysfsdevsdir = t.TempDir()
+
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8C", 1, 1, true)
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8C", 1, 2, false)
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8P", 2, 1, true)
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8A", 3, 1, true)
+	attrs := map[string]string{
+		"card01/serialnr": "93AADFK719",
+		"card01/01.0001/mkvps": "AES NEW: empty 0x0000000000000000\n" +
+			"AES CUR: valid 0xB072BC5C245AAC8A\n" +
+			"AES OLD: invalid 0x0000000000000000\n" +
+			"APKA NEW: empty 0x0000000000000000\n" +
+			"APKA CUR: invalid 0x0000000000000000\n" +
+			"APKA OLD: invalid 0x0000000000000000",
+		"card01/01.0002/mkvps": "AES CUR: valid 0xb072bc5c245aac8a",
+		"card02/serialnr":      "93AACJL714",
+		"card02/FW_version":    "7.15",
+		"card02/API_ordinalnr": "4",
+		"card02/02.0001/mkvps": "WK CUR: valid 0xa1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90\n" +
+			"WK NEW: empty -",
+	}
+	for f, v := range attrs {
+		if err := os.WriteFile(filepath.Join(apsysfsdevsdir, f), []byte(v+"\n"), 0644); err != nil {
+			t.Fatalf(`Writing fake sysfs attribute %s failed: %s`, f, err)
+		}
+	}
+
+	apqns, err := apScanAPQNs(false)
+	if err != nil {
+		t.Fatalf(`apScanAPQNs failed: %s`, err)
+	}
+	var tests = []struct {
+		apqn     string
+		serialnr string
+		fw       string
+		api      int
+		nmkvps   int
+		cur      string
+	}{
+		{"(1,1)", "93AADFK719", "", 0, 6, "0xb072bc5c245aac8a"},
+		{"(1,2)", "93AADFK719", "", 0, 1, "0xb072bc5c245aac8a"}, // offline, mkvps read anyway
+		{"(2,1)", "93AACJL714", "7.15", 4, 2, "0xa1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90"},
+		{"(3,1)", "", "", 0, 0, ""},
+	}
+	if len(apqns) != len(tests) {
+		t.Fatalf(`apScanAPQNs returned %d APQNs: %s`, len(apqns), apqns)
+	}
+	for _, test := range tests {
+		for _, a := range apqns {
+			if fmt.Sprintf("(%d,%d)", a.Adapter, a.Domain) != test.apqn {
+				continue
+			}
+			if a.Serialnr != test.serialnr || a.FWVersion != test.fw || a.APIOrdinal != test.api {
+				t.Errorf(`APQN %s has card info "%s" "%s" %d, expected "%s" "%s" %d`,
+					test.apqn, a.Serialnr, a.FWVersion, a.APIOrdinal, test.serialnr, test.fw, test.api)
+			}
+			if len(a.MKVPs) != test.nmkvps {
+				t.Errorf(`APQN %s has %d mkvps, expected %d: %v`, test.apqn, len(a.MKVPs), test.nmkvps, a.MKVPs)
+			}
+			cur := a.CurrentMKVPs()
+			if (len(test.cur) == 0 && len(cur) > 0) || (len(test.cur) > 0 && (len(cur) != 1 || cur[0] != test.cur)) {
+				t.Errorf(`APQN %s has current mkvps %v, expected "%s"`, test.apqn, cur, test.cur)
+			}
+		}
+	}
+}
+
+func TestApMKVPsChange(t *testing.T) {
+	savedir, savecache, savetime := apsysfsdevsdir, apmkvpscache, apMKVPsCacheTime
+	defer func() { apsysfsdevsdir, apmkvpscache, apMKVPsCacheTime = savedir, savecache, savetime }()
+	apsysfsdevsdir, apmkvpscache, apMKVPsCacheTime = t.TempDir(), map[string]*apinfo_s{}, 0
+
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8C", 1, 1, true)
+	mkvpsfile := filepath.Join(apsysfsdevsdir, "card01/01.0001/mkvps")
+
+	var tests = []struct {
+		mkvps  string // empty if the attribute can not be read
+		online bool
+		cur    string
+	}{
+		{"AES CUR: valid 0x1111111111111111", true, "0x1111111111111111"},
+		// master key change, the new pattern shows up with the next scan
+		{"AES CUR: valid 0x2222222222222222", true, "0x2222222222222222"},
+		// queue goes offline, the last read pattern is kept
+		{"", false, "0x2222222222222222"},
+	}
+	for i, test := range tests {
+		apTestSysfsQueue(t, apsysfsdevsdir, "CEX8C", 1, 1, test.online)
+		if len(test.mkvps) > 0 {
+			if err := os.WriteFile(mkvpsfile, []byte(test.mkvps+"\n"), 0644); err != nil {
+				t.Fatalf(`Writing fake sysfs mkvps file failed: %s`, err)
+			}
+		} else {
+			os.Remove(mkvpsfile)
+		}
+		apqns, err := apScanAPQNs(false)
+		if err != nil || len(apqns) != 1 {
+			t.Fatalf(`apScanAPQNs returned %v, %v`, apqns, err)
+		}
+		cur := apqns[0].CurrentMKVPs()
+		if len(cur) != 1 || cur[0] != test.cur {
+			t.Errorf(`Scan %d: APQN has current mkvps %v, expected "%s"`, i, cur, test.cur)
+		}
+		if apqns[0].Healthy != test.online {
+			t.Errorf(`Scan %d: APQN healthy is %v, expected %v`, i, apqns[0].Healthy, test.online)
+		}
+	}
+}
+
+func TestApMKVPsCache(t *testing.T) {
+	savedir, savecache, savetime := apsysfsdevsdir, apmkvpscache, apMKVPsCacheTime
+	defer func() { apsysfsdevsdir, apmkvpscache, apMKVPsCacheTime = savedir, savecache, savetime }()
+	apsysfsdevsdir, apmkvpscache, apMKVPsCacheTime = t.TempDir(), map[string]*apinfo_s{}, 60
+
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8C", 1, 1, true)
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8C", 1, 2, true)
+	mkvpsfile := filepath.Join(apsysfsdevsdir, "card01/01.0001/mkvps")
+
+	var tests = []struct {
+		name   string
+		mkvps  string
+		expire bool // let the cached value expire before the scan
+		cur    string
+	}{
+		{"first read", "AES CUR: valid 0x1111111111111111", false, "0x1111111111111111"},
+		{"cached", "AES CUR: valid 0x2222222222222222", false, "0x1111111111111111"},
+		{"expired", "AES CUR: valid 0x2222222222222222", true, "0x2222222222222222"},
+	}
+	for _, test := range tests {
+		if err := os.WriteFile(mkvpsfile, []byte(test.mkvps+"\n"), 0644); err != nil {
+			t.Fatalf(`Writing fake sysfs mkvps file failed: %s`, err)
+		}
+		if e, found := apmkvpscache[mkvpsfile]; found && test.expire {
+			e.fetched = e.fetched.Add(-apMKVPsCacheTime * time.Second)
+		}
+		apqns, err := apScanAPQNs(false)
+		if err != nil || len(apqns) != 2 {
+			t.Fatalf(`apScanAPQNs returned %v, %v`, apqns, err)
+		}
+		cur := apqns[0].CurrentMKVPs()
+		if len(cur) != 1 || cur[0] != test.cur {
+			t.Errorf(`Scan "%s": APQN has current mkvps %v, expected "%s"`, test.name, cur, test.cur)
+		}
+	}
+
+	// the cached value of a vanished queue is dropped with the next scan
+	if err := os.RemoveAll(filepath.Dir(mkvpsfile)); err != nil {
+		t.Fatalf(`Removing fake sysfs queue dir failed: %s`, err)
+	}
+	if _, err := apScanAPQNs(false); err != nil {
+		t.Fatalf(`apScanAPQNs failed: %s`, err)
+	}
+	if _, found := apmkvpscache[mkvpsfile]; found {
+		t.Errorf(`mkvps of the removed queue are still cached`)
+	}
+}
@@ -0,0 +1,251 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * node wide AP bus scanner shared by all plugin instances
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// APSnapshot is the result of one AP bus scan. A snapshot is never
+// modified after it has been published, so the APQNs may be shared.
+type APSnapshot struct {
+	Generation  uint64    `json:"generation"`  // incremented on each change of the APQNs
+	Timestamp   time.Time `json:"timestamp"`   // time of the last scan
+	ScanSeconds float64   `json:"scanseconds"` // duration of the last scan
+	APQNs       APQNList  `json:"apqns"`
+}
+
+// APDiff describes the changes between two snapshots
+type APDiff struct {
+	From    uint64   // generation the diff starts from
+	To      uint64   // generation the diff leads to
+	Added   APQNList // new APQNs
+	Removed APQNList // vanished APQNs
+	Changed APQNList // APQNs with changed attributes like online state
+}
+
+func (d *APDiff) String() string {
+	return fmt.Sprintf("generation %d->%d: %d added, %d removed, %d changed",
+		d.From, d.To, len(d.Added), len(d.Removed), len(d.Changed))
+}
+
+type apsub_s struct {
+	ch   chan *APDiff
+	from *APSnapshot // the snapshot the next diff starts from
+}
+
+// APScanner owns the one and only view of the AP bus of this node. It
+// rescans on AP bus uevents and every apqnsCheckInterval seconds and
+// publishes a new snapshot only when the APQNs have changed.
+type APScanner struct {
+	mutex    sync.RWMutex
+	snapshot *APSnapshot
+	subs     map[*apsub_s]bool
+	stopChan chan struct{}
+	rescan   chan struct{}
+}
+
+// apscanner is the node wide AP bus scanner, set up by main
+var apscanner *APScanner
+
+func NewAPScanner() *APScanner {
+
+	return &APScanner{
+		snapshot: &APSnapshot{},
+		subs:     map[*apsub_s]bool{},
+		stopChan: make(chan struct{}),
+		rescan:   make(chan struct{}, 1),
+	}
+}
+
+// apDiffAPQNLists returns the APQNs added, removed and changed from l1 to l2
+func apDiffAPQNLists(l1, l2 APQNList) (APQNList, APQNList, APQNList) {
+
+	var added, removed, changed APQNList
+
+	old := map[int]*APQN{}
+	for _, a := range l1 {
+		old[256*a.Adapter+a.Domain] = a
+	}
+	for _, a := range l2 {
+		k := 256*a.Adapter + a.Domain
+		o, found := old[k]
+		if !found {
+			added = append(added, a)
+			continue
+		}
+		delete(old, k)
+		if !apEqualAPQNLists(APQNList{o}, APQNList{a}) {
+			changed = append(changed, a)
+		}
+	}
+	for _, a := range l1 {
+		if _, found := old[256*a.Adapter+a.Domain]; found {
+			removed = append(removed, a)
+		}
+	}
+
+	return added, removed, changed
+}
+
+func apDiffSnapshots(s1, s2 *APSnapshot) *APDiff {
+
+	d := &APDiff{From: s1.Generation, To: s2.Generation}
+	d.Added, d.Removed, d.Changed = apDiffAPQNLists(s1.APQNs, s2.APQNs)
+
+	return d
+}
+
+// Snapshot returns the current snapshot of the AP bus
+func (s *APScanner) Snapshot() *APSnapshot {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.snapshot
+}
+
+// Subscribe returns a channel which receives the diff each time a new
+// snapshot is published. A busy subscriber does not miss changes, the
+// pending diff is replaced with one covering all changes since then.
+func (s *APScanner) Subscribe() chan *APDiff {
+
+	s.mutex.Lock()
+	sub := &apsub_s{ch: make(chan *APDiff, 1), from: s.snapshot}
+	s.subs[sub] = true
+	s.mutex.Unlock()
+
+	return sub.ch
+}
+
+func (s *APScanner) Unsubscribe(ch chan *APDiff) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for sub := range s.subs {
+		if sub.ch == ch {
+			delete(s.subs, sub)
+		}
+	}
+}
+
+// Rescan triggers a scan of the AP bus without waiting for it
+func (s *APScanner) Rescan() {
+
+	select {
+	case s.rescan <- struct{}{}:
+	default:
+	}
+}
+
+// scan scans the AP bus and publishes a new snapshot if there are changes
+func (s *APScanner) scan(verbose bool) error {
+
+	start := time.Now()
+	apqns, err := apScanAPQNs(verbose)
+	if err != nil {
+		log.Printf("APScanner: failure trying to scan node APQNs: %s\n", err)
+		return err
+	}
+	elapsed := time.Since(start)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	old := s.snapshot
+	snapshot := &APSnapshot{
+		Generation:  old.Generation,
+		Timestamp:   start,
+		ScanSeconds: elapsed.Seconds(),
+		APQNs:       apqns,
+	}
+	if old.Generation > 0 && apEqualAPQNLists(old.APQNs, apqns) {
+		// keep the APQNs of the published snapshot, only the scan info changes
+		snapshot.APQNs = old.APQNs
+		s.snapshot = snapshot
+		return nil
+	}
+	snapshot.Generation++
+	s.snapshot = snapshot
+
+	diff := apDiffSnapshots(old, snapshot)
+	log.Printf("APScanner: %d APQNs, %s\n", len(apqns), diff)
+	for sub := range s.subs {
+		select {
+		case <-sub.ch:
+			// the pending diff has not been picked up, replace it
+			// with a diff from the same base snapshot
+		default:
+			// the subscriber has picked up the diff leading to old
+			sub.from = old
+		}
+		if sub.from == old {
+			sub.ch <- diff
+		} else {
+			sub.ch <- apDiffSnapshots(sub.from, snapshot)
+		}
+	}
+
+	return nil
+}
+
+// Start runs the initial scan and starts the scanner loop
+func (s *APScanner) Start() error {
+
+	log.Printf("APScanner: Start()\n")
+
+	if err := s.scan(true); err != nil {
+		return fmt.Errorf("APScanner: Initial scan failed: %w", err)
+	}
+
+	go s.loop()
+
+	return nil
+}
+
+func (s *APScanner) Stop() {
+
+	log.Printf("APScanner: Stop()\n")
+
+	close(s.stopChan)
+}
+
+func (s *APScanner) loop() {
+
+	tick := time.NewTicker(apqnsCheckInterval * time.Second)
+	apchanged := APWatcherSubscribe()
+
+ForLoop:
+	for {
+		select {
+		case <-s.stopChan:
+			tick.Stop()
+			APWatcherUnsubscribe(apchanged)
+			break ForLoop
+		case <-tick.C:
+		case <-apchanged:
+		case <-s.rescan:
+		}
+		s.scan(false)
+	}
+}
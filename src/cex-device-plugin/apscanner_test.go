@@ -0,0 +1,107 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * node wide AP bus scanner shared by all plugin instances
+ */
+
+// run with
+// $ go test -run APScanner
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAPScannerDiff(t *testing.T) {
+	l1 := APQNList{
+		&APQN{Adapter: 1, Domain: 1, Gen: "cex7", Mode: "ep11", Online: true},
+		&APQN{Adapter: 1, Domain: 2, Gen: "cex7", Mode: "ep11", Online: true},
+		&APQN{Adapter: 2, Domain: 1, Gen: "cex8", Mode: "cca", Online: true},
+	}
+	l2 := APQNList{
+		&APQN{Adapter: 1, Domain: 1, Gen: "cex7", Mode: "ep11", Online: true},
+		&APQN{Adapter: 1, Domain: 2, Gen: "cex7", Mode: "ep11", Online: false},
+		&APQN{Adapter: 3, Domain: 1, Gen: "cex8", Mode: "cca", Online: true},
+	}
+	added, removed, changed := apDiffAPQNLists(l1, l2)
+	if len(added) != 1 || added[0].Adapter != 3 {
+		t.Errorf(`apDiffAPQNLists returned added %s`, added)
+	}
+	if len(removed) != 1 || removed[0].Adapter != 2 {
+		t.Errorf(`apDiffAPQNLists returned removed %s`, removed)
+	}
+	if len(changed) != 1 || changed[0].Domain != 2 || changed[0].Online {
+		t.Errorf(`apDiffAPQNLists returned changed %s`, changed)
+	}
+	added, removed, changed = apDiffAPQNLists(l1, l1)
+	if len(added)+len(removed)+len(changed) != 0 {
+		t.Errorf(`apDiffAPQNLists of equal lists returned %s %s %s`, added, removed, changed)
+	}
+}
+
+func TestAPScannerSubscribe(t *testing.T) {
+	savedir := apsysfsdevsdir
+	defer func() { apsysfsdevsdir = savedir }()
+	apsysfsdevsdir = t.TempDir()
+
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX7P", 1, 1, true)
+	s := NewAPScanner()
+	if err := s.scan(false); err != nil {
+		t.Fatalf(`APScanner scan failed: %s`, err)
+	}
+	if g := s.Snapshot().Generation; g != 1 {
+		t.Errorf(`APScanner initial generation is %d`, g)
+	}
+	ch := s.Subscribe()
+
+	// no changes, no new generation and no diff
+	s.scan(false)
+	if g := s.Snapshot().Generation; g != 1 {
+		t.Errorf(`APScanner generation changed to %d without changes`, g)
+	}
+	if len(ch) != 0 {
+		t.Errorf(`APScanner sent a diff without changes`)
+	}
+
+	// two changes, the subscriber is busy and gets one merged diff
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX7P", 1, 2, true)
+	s.scan(false)
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX7P", 1, 1, false)
+	s.scan(false)
+	if g := s.Snapshot().Generation; g != 3 {
+		t.Errorf(`APScanner generation is %d, expected 3`, g)
+	}
+	diff := <-ch
+	if diff.From != 1 || diff.To != 3 || len(diff.Added) != 1 || len(diff.Changed) != 1 || len(diff.Removed) != 0 {
+		t.Errorf(`APScanner merged diff is %s`, diff)
+	}
+
+	// the subscriber picked up the diff, the next diff starts from there
+	os.RemoveAll(filepath.Join(apsysfsdevsdir, "card01", "01.0002"))
+	s.scan(false)
+	diff = <-ch
+	if diff.From != 3 || diff.To != 4 || len(diff.Removed) != 1 || len(diff.Added)+len(diff.Changed) != 0 {
+		t.Errorf(`APScanner diff is %s`, diff)
+	}
+
+	s.Unsubscribe(ch)
+	if len(s.subs) != 0 {
+		t.Errorf(`APScanner still has %d subscribers`, len(s.subs))
+	}
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * node level AP bus watcher based on kernel uevents
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// configuring an adapter on/off is a burst of card and queue events
+	apDebounceTime = 500 * time.Millisecond
+	// the receive timeout, the watcher checks for stop in between
+	apUeventRecvTimeout = 1
+	// uevent messages are limited to a few KiB
+	apUeventBufSize = 64 * 1024
+	// kernel uevent multicast group
+	apUeventKernelGroup = 1
+)
+
+var apUeventWatch = getenvint("APQN_UEVENT_WATCH", 1, 0, 1) > 0
+
+var (
+	apwatcherstop chan struct{}
+	apwatcherwg   sync.WaitGroup
+	apsubsmutex   sync.Mutex
+	apsubs        = map[chan struct{}]bool{}
+)
+
+// APWatcherSubscribe returns a channel which receives a notification each
+// time the kernel reports a change on the AP bus. As with the crypto config
+// notifications, a busy subscriber gets only one notification for all the
+// changes in the meantime.
+func APWatcherSubscribe() chan struct{} {
+
+	ch := make(chan struct{}, 1)
+	apsubsmutex.Lock()
+	apsubs[ch] = true
+	apsubsmutex.Unlock()
+
+	return ch
+}
+
+func APWatcherUnsubscribe(ch chan struct{}) {
+
+	apsubsmutex.Lock()
+	delete(apsubs, ch)
+	apsubsmutex.Unlock()
+}
+
+func apNotifySubscribers() {
+
+	apsubsmutex.Lock()
+	defer apsubsmutex.Unlock()
+	for ch := range apsubs {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// there is already a notification pending
+		}
+	}
+}
+
+// apParseUevent splits a kernel uevent message into the action, the
+// device path and the environment. The message starts with a
+// "action@devpath" header followed by zero terminated KEY=VALUE strings.
+func apParseUevent(msg []byte) (string, string, map[string]string, error) {
+
+	fields := bytes.Split(msg, []byte{0})
+	action, devpath, found := bytes.Cut(fields[0], []byte{'@'})
+	if !found {
+		// udev messages start with "libudev", only kernel messages are of interest
+		return "", "", nil, fmt.Errorf("Ap: Invalid uevent header '%s'", fields[0])
+	}
+	env := map[string]string{}
+	for _, f := range fields[1:] {
+		if key, value, found := bytes.Cut(f, []byte{'='}); found {
+			env[string(key)] = string(value)
+		}
+	}
+
+	return string(action), string(devpath), env, nil
+}
+
+// apStartUeventWatcher opens a netlink socket for the kernel uevents and
+// notifies the subscribers about events of the ap subsystem. If this
+// fails, the plugins still detect changes via polling the AP sysfs.
+func apStartUeventWatcher() error {
+
+	if !apUeventWatch {
+		log.Printf("Ap: uevent watcher disabled\n")
+		return nil
+	}
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC,
+		syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		log.Printf("Ap: Can't create uevent netlink socket: %s\n", err)
+		return fmt.Errorf("Ap: Can't create uevent netlink socket: %w", err)
+	}
+	addr := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: apUeventKernelGroup,
+	}
+	if err = syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		log.Printf("Ap: Can't bind uevent netlink socket: %s\n", err)
+		return fmt.Errorf("Ap: Can't bind uevent netlink socket: %w", err)
+	}
+	tv := syscall.Timeval{Sec: apUeventRecvTimeout}
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		log.Printf("Ap: Can't set uevent netlink socket timeout: %s\n", err)
+		return fmt.Errorf("Ap: Can't set uevent netlink socket timeout: %w", err)
+	}
+
+	apwatcherstop = make(chan struct{})
+	events := make(chan struct{}, 1)
+	apwatcherwg.Add(2)
+	go apUeventReader(fd, events)
+	go apUeventDebouncer(events)
+	log.Printf("Ap: uevent watcher started\n")
+
+	return nil
+}
+
+// apUeventReader receives the uevents until the watcher is stopped
+func apUeventReader(fd int, events chan struct{}) {
+
+	defer apwatcherwg.Done()
+	defer syscall.Close(fd)
+
+	buf := make([]byte, apUeventBufSize)
+	for {
+		select {
+		case <-apwatcherstop:
+			return
+		default:
+		}
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			switch {
+			case errors.Is(err, syscall.EAGAIN), errors.Is(err, syscall.EINTR):
+				// receive timeout, check for stop
+			case errors.Is(err, syscall.ENOBUFS):
+				// events have been lost, let the plugins rescan
+				log.Printf("Ap: uevent receive buffer overrun\n")
+				apSignal(events)
+			default:
+				log.Printf("Ap: uevent receive failed, falling back to polling only: %s\n", err)
+				return
+			}
+			continue
+		}
+		action, devpath, env, err := apParseUevent(buf[:n])
+		if err != nil || env["SUBSYSTEM"] != "ap" {
+			continue
+		}
+		log.Printf("Ap: uevent %s %s\n", action, devpath)
+		apSignal(events)
+	}
+}
+
+func apSignal(events chan struct{}) {
+
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
+
+// apUeventDebouncer notifies the subscribers when the burst of events has settled
+func apUeventDebouncer(events chan struct{}) {
+
+	defer apwatcherwg.Done()
+
+	timer := time.NewTimer(apDebounceTime)
+	timer.Stop()
+	for {
+		select {
+		case <-apwatcherstop:
+			timer.Stop()
+			return
+		case <-events:
+			timer.Reset(apDebounceTime)
+		case <-timer.C:
+			apNotifySubscribers()
+		}
+	}
+}
+
+func apStopUeventWatcher() {
+
+	if apwatcherstop == nil {
+		return
+	}
+	close(apwatcherstop)
+	apwatcherwg.Wait()
+	apwatcherstop = nil
+}
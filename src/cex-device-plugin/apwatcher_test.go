@@ -0,0 +1,83 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * parsing of the kernel uevents received by the AP bus watcher
+ */
+
+// run with
+// $ go test -run Uevent
+
+package main
+
+import (
+	"testing"
+)
+
+func TestApParseUevent(t *testing.T) {
+	var tests = []struct {
+		name      string
+		msg       string
+		wantErr   bool
+		action    string
+		devpath   string
+		subsystem string
+		config    string
+	}{
+		{
+			name:      "card config change",
+			msg:       "change@/devices/ap/card03\x00ACTION=change\x00DEVPATH=/devices/ap/card03\x00SUBSYSTEM=ap\x00CONFIG=0\x00SEQNUM=4711\x00",
+			action:    "change",
+			devpath:   "/devices/ap/card03",
+			subsystem: "ap",
+			config:    "0",
+		},
+		{
+			name:      "queue add",
+			msg:       "add@/devices/ap/card03/03.0005\x00ACTION=add\x00SUBSYSTEM=ap\x00DEV_TYPE=0012\x00",
+			action:    "add",
+			devpath:   "/devices/ap/card03/03.0005",
+			subsystem: "ap",
+		},
+		{
+			name:      "other subsystem",
+			msg:       "add@/devices/virtual/net/lo\x00ACTION=add\x00SUBSYSTEM=net\x00",
+			action:    "add",
+			devpath:   "/devices/virtual/net/lo",
+			subsystem: "net",
+		},
+		{
+			name:    "udev message",
+			msg:     "libudev\x00\xfe\xed\xca\xfe",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		action, devpath, env, err := apParseUevent([]byte(test.msg))
+		if (err != nil) != test.wantErr {
+			t.Errorf(`apParseUevent for "%s" returned error %v`, test.name, err)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		if action != test.action || devpath != test.devpath {
+			t.Errorf(`apParseUevent for "%s" returned action "%s" devpath "%s"`, test.name, action, devpath)
+		}
+		if env["SUBSYSTEM"] != test.subsystem || env["CONFIG"] != test.config {
+			t.Errorf(`apParseUevent for "%s" returned env %v`, test.name, env)
+		}
+	}
+}
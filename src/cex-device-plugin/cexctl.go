@@ -0,0 +1,177 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * cexctl command line subcommands
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	cexctlName = "cexctl"
+)
+
+// cexctlSubcommands maps the subcommand names to their implementation,
+// each returns the exit code of the program
+var cexctlSubcommands = map[string]func(args []string) int{
+	"quotas":   quotasMain,
+	"validate": cexctlValidate,
+	"webhook":  webhookMain,
+}
+
+// cexctlArgs returns the subcommand and its arguments if the program has
+// been invoked as "cexctl <subcommand>" or "cex-plugin <subcommand>"
+func cexctlArgs(args []string) (string, []string, bool) {
+
+	if filepath.Base(args[0]) == cexctlName {
+		if len(args) < 2 {
+			return "", nil, true
+		}
+		return args[1], args[2:], true
+	}
+	if len(args) > 1 {
+		if _, found := cexctlSubcommands[args[1]]; found {
+			return args[1], args[2:], true
+		}
+	}
+
+	return "", nil, false
+}
+
+func cexctlUsage() {
+
+	var cmds []string
+	for c := range cexctlSubcommands {
+		cmds = append(cmds, c)
+	}
+	sort.Strings(cmds)
+	fmt.Fprintf(os.Stderr, "Usage: %s <subcommand> [options]\n", cexctlName)
+	fmt.Fprintf(os.Stderr, "Subcommands: %v\n", cmds)
+	fmt.Fprintf(os.Stderr, "Run '%s <subcommand> -h' for the options of a subcommand\n", cexctlName)
+}
+
+func cexctlMain(cmd string, args []string) int {
+
+	f, found := cexctlSubcommands[cmd]
+	if !found {
+		cexctlUsage()
+		return 2
+	}
+
+	return f(args)
+}
+
+// cexctlValidate reads and verifies a crypto config file. With a captured
+// AP sysfs tree given it also reports the APQNs which would be announced
+// per config set on the node the sysfs tree has been captured from.
+func cexctlValidate(args []string) int {
+
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	configarg := fs.String("config", ccsfile, "crypto config json file to validate")
+	sysfsarg := fs.String("sysfs", "", "captured AP devices sysfs dir (/sys/devices/ap) of a node")
+	sysinfoarg := fs.String("sysinfo", "", "captured /proc/sysinfo file of a node, used to derive the machine id")
+	machineidarg := fs.String("machineid", "", "machine id of a node, overrides the machine id from -sysinfo")
+	overcommitarg := fs.Int("overcommit", apqnOverCommitLimit, "APQN_OVERCOMMIT_LIMIT of the plugin, used for config sets without overcommit")
+	verbosearg := fs.Bool("v", false, "verbose, show the log output")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s validate [options]\n", cexctlName)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if !*verbosearg {
+		log.SetOutput(io.Discard)
+	}
+
+	ccsfile = *configarg
+	cc, err := ccReadConfigFile()
+	if err != nil {
+		fmt.Printf("%s: %s\n", ccsfile, err)
+		return 1
+	}
+	fmt.Printf("%s: %d config sets\n", ccsfile, len(cc.CryptoConfigSets))
+	errs := cc.Verify()
+	for _, e := range errs {
+		fmt.Printf("ERROR: %s\n", e)
+	}
+	if len(errs) > 0 {
+		fmt.Printf("%s: verification failed with %d errors\n", ccsfile, len(errs))
+		return 1
+	}
+	fmt.Printf("%s: verification successful\n", ccsfile)
+
+	if len(*sysfsarg) == 0 {
+		return 0
+	}
+
+	machineid := *machineidarg
+	if len(machineid) == 0 && len(*sysinfoarg) > 0 {
+		sysinfofile = *sysinfoarg
+		machineid, err = ccGetMachineId()
+		if err != nil {
+			fmt.Printf("%s: %s\n", sysinfofile, err)
+			return 1
+		}
+	}
+	if len(machineid) > 0 {
+		fmt.Printf("Machine id: '%s'\n", machineid)
+	} else {
+		fmt.Printf("Machine id: unknown, APQNs restricted to a machine id are never announced\n")
+	}
+
+	if *overcommitarg < 1 || *overcommitarg > 100 {
+		fmt.Printf("Overcommit limit %d out of range 1-100\n", *overcommitarg)
+		return 2
+	}
+	// config sets without overcommit get the default limit of the plugin
+	apqnOverCommitLimit = *overcommitarg
+
+	apsysfsdevsdir = *sysfsarg
+	nodeapqns, err := apScanAPQNs(false)
+	if err != nil {
+		fmt.Printf("%s: Failed to scan APQNs: %s\n", apsysfsdevsdir, err)
+		return 1
+	}
+	fmt.Printf("%s: %d APQNs found: %s\n", apsysfsdevsdir, len(nodeapqns), nodeapqns)
+
+	for _, s := range cc.CryptoConfigSets {
+		adjustConfigSet(s)
+		apqns, filtered := filterAPQNsForSet(s.SetName, machineid, s, nodeapqns)
+		fmt.Printf("Set '%s': %d APQNs announced (%d plugin devices): %s\n",
+			s.SetName, len(apqns), len(apqns)*max(1, s.Overcommit), apqns)
+		var reasons []string
+		for reason := range filtered {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Printf("Set '%s': %d APQNs not announced because of %s mismatch\n",
+				s.SetName, filtered[reason], reason)
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * offline validation of crypto config files with cexctl validate
+ */
+
+// run with
+// $ go test -run Cexctl
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// cexctlTestRun runs the subcommand and returns its exit code and output
+func cexctlTestRun(t *testing.T, cmd string, args []string) (int, string) {
+	outfile, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatalf(`Can't create output file: %s`, err)
+	}
+	defer outfile.Close()
+	savestdout := os.Stdout
+	os.Stdout = outfile
+	rc := cexctlMain(cmd, args)
+	os.Stdout = savestdout
+	log.SetOutput(os.Stderr)
+	out, _ := os.ReadFile(outfile.Name())
+
+	return rc, string(out)
+}
+
+func TestCexctlValidate(t *testing.T) {
+	saveccsfile, savesysinfo, savesysfs, saveovercommit := ccsfile, sysinfofile, apsysfsdevsdir, apqnOverCommitLimit
+	defer func() {
+		ccsfile, sysinfofile, apsysfsdevsdir, apqnOverCommitLimit = saveccsfile, savesysinfo, savesysfs, saveovercommit
+	}()
+
+	dir := t.TempDir()
+	sysfsdir := filepath.Join(dir, "ap")
+	apTestSysfsQueue(t, sysfsdir, "CEX8C", 1, 5, true)
+	apTestSysfsQueue(t, sysfsdir, "CEX8C", 1, 6, true)
+	apTestSysfsQueue(t, sysfsdir, "CEX8C", 2, 5, true)
+	files := map[string]string{
+		"valid.json": `{"cryptoconfigsets":[{"setname":"set1","project":"test","apqns":[` +
+			`{"adapter":1,"domain":5},{"adapter":1,"domain":6,"machineid":"IBM-3931-00000000000ABCDE"},` +
+			`{"adapter":2,"domain":5,"machineid":"IBM-3931-00000000000FFFFF"}]}]}`,
+		"overcommit.json": `{"cryptoconfigsets":[{"setname":"set1","project":"test","apqns":[{"adapter":1,"domain":5}]},` +
+			`{"setname":"set2","project":"test","overcommit":2,"apqns":[{"adapter":1,"domain":6}]}]}`,
+		"invalid.json": `{"cryptoconfigsets":[{"setname":"set1","project":"test"},{"setname":"set1","project":"test"}]}`,
+		"broken.json":  `{"cryptoconfigsets":[`,
+		"sysinfo":      "Manufacturer:         IBM\nType:                 3931\nSequence Code:        00000000000ABCDE\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatalf(`Can't write %s: %s`, name, err)
+		}
+	}
+
+	var tests = []struct {
+		name string
+		args []string
+		rc   int
+		want []string // lines expected in the output
+	}{
+		{
+			name: "valid config",
+			args: []string{"-config", filepath.Join(dir, "valid.json")},
+			rc:   0,
+			want: []string{"1 config sets", "verification successful"},
+		},
+		{
+			name: "invalid config",
+			args: []string{"-config", filepath.Join(dir, "invalid.json")},
+			rc:   1,
+			want: []string{"ERROR: ", "verification failed with 1 errors"},
+		},
+		{
+			name: "unparsable config",
+			args: []string{"-config", filepath.Join(dir, "broken.json")},
+			rc:   1,
+		},
+		{
+			name: "unknown option",
+			args: []string{"-foo"},
+			rc:   2,
+		},
+		{
+			name: "without machine id",
+			args: []string{"-config", filepath.Join(dir, "valid.json"), "-sysfs", sysfsdir},
+			rc:   0,
+			want: []string{"Machine id: unknown", "3 APQNs found", "Set 'set1': 1 APQNs announced (1 plugin devices): (1,5,"},
+		},
+		{
+			name: "machine id option",
+			args: []string{"-config", filepath.Join(dir, "valid.json"), "-sysfs", sysfsdir,
+				"-machineid", "IBM-3931-00000000000FFFFF"},
+			rc: 0,
+			want: []string{"Machine id: 'IBM-3931-00000000000FFFFF'",
+				"Set 'set1': 2 APQNs announced (2 plugin devices): (1,5,cex8,cca,true), (2,5,"},
+		},
+		{
+			name: "machine id from sysinfo",
+			args: []string{"-config", filepath.Join(dir, "valid.json"), "-sysfs", sysfsdir,
+				"-sysinfo", filepath.Join(dir, "sysinfo")},
+			rc: 0,
+			want: []string{"Machine id: 'IBM-3931-00000000000ABCDE'",
+				"Set 'set1': 2 APQNs announced (2 plugin devices): (1,5,cex8,cca,true), (1,6,"},
+		},
+		{
+			name: "default overcommit limit",
+			args: []string{"-config", filepath.Join(dir, "overcommit.json"), "-sysfs", sysfsdir, "-overcommit", "5"},
+			rc:   0,
+			want: []string{"Set 'set1': 1 APQNs announced (5 plugin devices)", "Set 'set2': 1 APQNs announced (2 plugin devices)"},
+		},
+		{
+			name: "overcommit limit out of range",
+			args: []string{"-config", filepath.Join(dir, "overcommit.json"), "-sysfs", sysfsdir, "-overcommit", "0"},
+			rc:   2,
+		},
+		{
+			name: "missing sysfs dir",
+			args: []string{"-config", filepath.Join(dir, "valid.json"), "-sysfs", filepath.Join(dir, "missing")},
+			rc:   1,
+		},
+	}
+	for _, test := range tests {
+		rc, out := cexctlTestRun(t, "validate", test.args)
+		if rc != test.rc {
+			t.Errorf(`cexctl validate for "%s" returned %d, expected %d, output:\n%s`, test.name, rc, test.rc, out)
+		}
+		for _, w := range test.want {
+			if !strings.Contains(out, w) {
+				t.Errorf(`cexctl validate for "%s" output misses "%s":\n%s`, test.name, w, out)
+			}
+		}
+	}
+}
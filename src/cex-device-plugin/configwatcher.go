@@ -0,0 +1,135 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * event driven config file watcher and config change notifications
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// kubelet swaps this symlink to atomically update a mounted config map
+const ccConfigMapDataLink = "..data"
+
+var (
+	// a config map update is a burst of events, wait for it to settle
+	ccDebounceTime = 2 * time.Second
+
+	ccwatcher   *fsnotify.Watcher
+	ccsubsmutex sync.Mutex
+	ccsubs      = map[chan struct{}]bool{}
+)
+
+// CryptoConfigSubscribe returns a channel which receives a notification
+// each time the current crypto config has changed. Notifications are not
+// queued, a subscriber which is busy gets only one notification for all
+// the changes in the meantime.
+func CryptoConfigSubscribe() chan struct{} {
+
+	ch := make(chan struct{}, 1)
+	ccsubsmutex.Lock()
+	ccsubs[ch] = true
+	ccsubsmutex.Unlock()
+
+	return ch
+}
+
+func CryptoConfigUnsubscribe(ch chan struct{}) {
+
+	ccsubsmutex.Lock()
+	delete(ccsubs, ch)
+	ccsubsmutex.Unlock()
+}
+
+func ccNotifySubscribers() {
+
+	ccsubsmutex.Lock()
+	defer ccsubsmutex.Unlock()
+	for ch := range ccsubs {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// there is already a notification pending
+		}
+	}
+}
+
+// ccStartFileWatcher watches the directory of the config file. The file
+// itself can't be watched as with a config map it is a symlink into the
+// ..data symlinked directory which is replaced on each update.
+func ccStartFileWatcher() error {
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("CryptoConfig: Can't create file watcher: %s\n", err)
+		return fmt.Errorf("CryptoConfig: Can't create file watcher: %w", err)
+	}
+	dir, file := filepath.Split(ccsfile)
+	if err = w.Add(filepath.Clean(dir)); err != nil {
+		w.Close()
+		log.Printf("CryptoConfig: Can't watch config dir '%s': %s\n", dir, err)
+		return fmt.Errorf("CryptoConfig: Can't watch config dir '%s': %w", dir, err)
+	}
+	ccwatcher = w
+
+	go func() {
+		var debounce <-chan time.Time
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				name := filepath.Base(ev.Name)
+				if name != file && name != ccConfigMapDataLink {
+					continue
+				}
+				//log.Printf("CryptoConfig: file watcher event %s\n", ev)
+				debounce = time.After(ccDebounceTime)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("CryptoConfig: File watcher error: %s\n", err)
+			case <-debounce:
+				debounce = nil
+				if err := updateConfig(); err != nil {
+					log.Printf("CryptoConfig: Failed to update config: %s\n", err)
+				}
+			}
+		}
+	}()
+
+	log.Printf("CryptoConfig: Watching config dir '%s' for changes\n", dir)
+
+	return nil
+}
+
+func ccStopFileWatcher() {
+
+	if ccwatcher != nil {
+		ccwatcher.Close()
+		ccwatcher = nil
+	}
+}
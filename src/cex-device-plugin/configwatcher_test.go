@@ -0,0 +1,125 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * tests for the config file watcher on a directory laid out like a
+ * mounted config map and for the config change notifications
+ */
+
+// run with
+// $ go test -run 'CcSubscribers|CcFileWatcher'
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCcSubscribers(t *testing.T) {
+	ch1 := CryptoConfigSubscribe()
+	ch2 := CryptoConfigSubscribe()
+	defer CryptoConfigUnsubscribe(ch1)
+
+	// notifications of a busy subscriber are coalesced into one
+	ccNotifySubscribers()
+	ccNotifySubscribers()
+	for i, ch := range []chan struct{}{ch1, ch2} {
+		if len(ch) != 1 {
+			t.Errorf(`Subscriber %d has %d notifications pending, expected 1`, i, len(ch))
+		}
+		<-ch
+	}
+
+	CryptoConfigUnsubscribe(ch2)
+	ccNotifySubscribers()
+	if len(ch1) != 1 || len(ch2) != 0 {
+		t.Errorf(`Subscribers have %d and %d notifications pending, expected 1 and 0`, len(ch1), len(ch2))
+	}
+}
+
+// ccTestConfigMapSwap updates a config map dir the way kubelet does it: the
+// new content goes into a new timestamped dir and the ..data symlink is
+// atomically replaced by renaming a temporary symlink, then the old dir is
+// removed
+func ccTestConfigMapSwap(t *testing.T, dir, version, content string) {
+	datadir := "..2026_10_16_" + version
+	if err := os.Mkdir(filepath.Join(dir, datadir), 0755); err != nil {
+		t.Fatalf(`Can't create dir: %s`, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, datadir, "cex_resources.json"), []byte(content), 0644); err != nil {
+		t.Fatalf(`Can't write config file: %s`, err)
+	}
+	olddir, _ := os.Readlink(filepath.Join(dir, ccConfigMapDataLink))
+	tmplink := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink(datadir, tmplink); err != nil {
+		t.Fatalf(`Can't create symlink: %s`, err)
+	}
+	if err := os.Rename(tmplink, filepath.Join(dir, ccConfigMapDataLink)); err != nil {
+		t.Fatalf(`Can't rename symlink: %s`, err)
+	}
+	if len(olddir) > 0 {
+		os.RemoveAll(filepath.Join(dir, olddir))
+	}
+}
+
+func TestCcFileWatcherDataSwap(t *testing.T) {
+	config := `{"cryptoconfigsets":[{"setname":"set","project":"%s","apqns":[{"adapter":1,"domain":5}]}]}`
+
+	savefile, savecc, savetag, saverejected, savedebounce := ccsfile, cc, tag, rejectedtag, ccDebounceTime
+	defer func() {
+		ccsfile, cc, tag, rejectedtag, ccDebounceTime = savefile, savecc, savetag, saverejected, savedebounce
+	}()
+	t.Setenv("POD_NAMESPACE", "")
+	ccDebounceTime = 200 * time.Millisecond
+	cc, tag, rejectedtag = nil, nil, nil
+
+	dir := t.TempDir()
+	ccsfile = filepath.Join(dir, "cex_resources.json")
+	ccTestConfigMapSwap(t, dir, "1", fmt.Sprintf(config, "red"))
+	if err := os.Symlink(filepath.Join(ccConfigMapDataLink, "cex_resources.json"), ccsfile); err != nil {
+		t.Fatalf(`Can't create symlink: %s`, err)
+	}
+	if err := updateConfig(); err != nil {
+		t.Fatalf(`Initial updateConfig failed: %s`, err)
+	}
+
+	ch := CryptoConfigSubscribe()
+	defer CryptoConfigUnsubscribe(ch)
+	if err := ccStartFileWatcher(); err != nil {
+		t.Fatalf(`ccStartFileWatcher failed: %s`, err)
+	}
+	defer ccStopFileWatcher()
+
+	// two updates within the debounce time give one notification
+	ccTestConfigMapSwap(t, dir, "2", fmt.Sprintf(config, "green"))
+	ccTestConfigMapSwap(t, dir, "3", fmt.Sprintf(config, "blue"))
+	select {
+	case <-ch:
+	case <-time.After(10 * ccDebounceTime):
+		t.Fatalf(`No notification after the ..data swap`)
+	}
+	select {
+	case <-ch:
+		t.Errorf(`More than one notification after the ..data swaps`)
+	case <-time.After(3 * ccDebounceTime):
+	}
+	if s := GetCurrentCryptoConfig().GetCryptoConfigSet("set"); s == nil || s.Project != "blue" {
+		t.Errorf(`Config set after the ..data swaps is %v, expected project "blue"`, s)
+	}
+}
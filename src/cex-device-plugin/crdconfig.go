@@ -0,0 +1,296 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * CryptoConfigSet custom resources as source for the crypto configuration
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	CcSourceFile = "file" // json config file, usually provided via config map
+	CcSourceCrd  = "crd"  // CryptoConfigSet custom resources
+)
+
+var ccsource = getenvstr("CRYPTOCONFIG_SOURCE", CcSourceFile)
+
+var ccCrdGVR = schema.GroupVersionResource{
+	Group:    "cex.s390.ibm.com",
+	Version:  "v1",
+	Resource: "cryptoconfigsets",
+}
+
+var (
+	ccCrdMutex    sync.Mutex
+	ccCrdClient   dynamic.Interface
+	ccCrdInformer cache.SharedIndexInformer
+	ccCrdStop     chan struct{}
+	ccCrdLastTag  []byte
+)
+
+type ccCrdStatus_s struct {
+	valid   bool
+	message string
+}
+
+func ccCrdStartWatcher() error {
+
+	client, err := kubeGetDynamicClient()
+	if err != nil {
+		return fmt.Errorf("CryptoConfigCrd: %w", err)
+	}
+	ccCrdClient = client
+
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+	ccCrdInformer = factory.ForResource(ccCrdGVR).Informer()
+
+	// the events during the initial listing are ignored, the
+	// config is built once after the informer cache is synced
+	onchange := func() {
+		if !ccCrdInformer.HasSynced() {
+			return
+		}
+		if err := ccCrdUpdate(); err != nil {
+			log.Printf("CryptoConfigCrd: Failed to update config: %s\n", err)
+		}
+	}
+	_, err = ccCrdInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { onchange() },
+		UpdateFunc: func(oldobj, newobj interface{}) { onchange() },
+		DeleteFunc: func(obj interface{}) { onchange() },
+	})
+	if err != nil {
+		log.Printf("CryptoConfigCrd: Can't add event handler to informer: %s\n", err)
+		return fmt.Errorf("CryptoConfigCrd: Can't add event handler to informer: %w", err)
+	}
+
+	ccCrdStop = make(chan struct{})
+	factory.Start(ccCrdStop)
+	if !cache.WaitForCacheSync(ccCrdStop, ccCrdInformer.HasSynced) {
+		close(ccCrdStop)
+		log.Printf("CryptoConfigCrd: Failed to sync the %s informer cache\n", ccCrdGVR.Resource)
+		return fmt.Errorf("CryptoConfigCrd: Failed to sync the %s informer cache", ccCrdGVR.Resource)
+	}
+	log.Printf("CryptoConfigCrd: Watching %s custom resources\n", ccCrdGVR.GroupResource())
+
+	return ccCrdUpdate()
+}
+
+func ccCrdStopWatcher() {
+
+	if ccCrdStop != nil {
+		close(ccCrdStop)
+		ccCrdStop = nil
+	}
+}
+
+// ccCrdParseSet converts the spec of a CryptoConfigSet custom resource
+// into a CryptoConfigSet struct. The spec is run through the very same
+// json unmarshal code as the config file. The raw json spec is returned
+// as input for the config tag.
+func ccCrdParseSet(u *unstructured.Unstructured) (*CryptoConfigSet, []byte, error) {
+
+	spec, found, err := unstructured.NestedMap(u.Object, "spec")
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid spec: %w", err)
+	}
+	if !found {
+		return nil, nil, fmt.Errorf("no spec")
+	}
+	rawspec, err := json.Marshal(spec)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid spec: %w", err)
+	}
+
+	var s CryptoConfigSet
+	if err = json.Unmarshal(rawspec, &s); err != nil {
+		return nil, rawspec, fmt.Errorf("error parsing spec: %w", err)
+	}
+	// the setname defaults to the name of the custom resource
+	if len(s.SetName) == 0 {
+		s.SetName = u.GetName()
+	}
+
+	return &s, rawspec, nil
+}
+
+// ccCrdUpdate builds a new crypto config from all the CryptoConfigSet
+// custom resources, verifies and activates it and reports the result
+// back into the status of each custom resource.
+func ccCrdUpdate() error {
+
+	ccCrdMutex.Lock()
+	defer ccCrdMutex.Unlock()
+
+	var objs []*unstructured.Unstructured
+	for _, o := range ccCrdInformer.GetStore().List() {
+		if u, ok := o.(*unstructured.Unstructured); ok {
+			objs = append(objs, u)
+		}
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].GetName() < objs[j].GetName() })
+
+	newcc := &CryptoConfig{}
+	status := map[string]ccCrdStatus_s{}
+	setnames := map[string]string{} // custom resource name -> setname
+	var invalid []string
+	h := sha256.New()
+	for _, u := range objs {
+		s, rawspec, err := ccCrdParseSet(u)
+		h.Write([]byte(u.GetName()))
+		h.Write(rawspec)
+		if err != nil {
+			log.Printf("CryptoConfigCrd: CryptoConfigSet '%s': %s\n", u.GetName(), err)
+			status[u.GetName()] = ccCrdStatus_s{false, err.Error()}
+			invalid = append(invalid, u.GetName())
+			continue
+		}
+		newcc.CryptoConfigSets = append(newcc.CryptoConfigSets, s)
+		setnames[u.GetName()] = s.SetName
+	}
+	newtag := h.Sum(nil)
+
+	// status updates of the custom resources trigger update events
+	// but don't change the config, so nothing to do then
+	if bytes.Equal(newtag, ccCrdLastTag) {
+		return nil
+	}
+	ccCrdLastTag = newtag
+
+	var refs []*corev1.ObjectReference
+	for _, u := range objs {
+		refs = append(refs, &corev1.ObjectReference{
+			Kind:       u.GetKind(),
+			APIVersion: u.GetAPIVersion(),
+			Name:       u.GetName(),
+			UID:        u.GetUID(),
+		})
+	}
+
+	// verify the sets which could be parsed, the verification errors
+	// are reported in the status of the related custom resource
+	errs := newcc.Verify()
+	errs.Log()
+	for _, u := range objs {
+		setname, found := setnames[u.GetName()]
+		if !found {
+			continue
+		}
+		if seterrs := errs.ForSet(setname); len(seterrs) > 0 {
+			status[u.GetName()] = ccCrdStatus_s{false, seterrs.Error()}
+			invalid = append(invalid, u.GetName())
+		}
+	}
+
+	var rc error
+	var reason string
+	kept := false
+	mu.Lock()
+	log.Printf("CryptoConfigCrd: Configuration changes detected\n")
+	if len(invalid) > 0 {
+		rc = fmt.Errorf("CryptoConfigCrd: Failed to verify new configuration, invalid CryptoConfigSet(s) %s",
+			strings.Join(invalid, ","))
+		reason = "configuration rejected because of invalid CryptoConfigSet(s) " + strings.Join(invalid, ",")
+		kept = ccReject(newtag, reason, refs)
+	} else {
+		ccAccept(newcc, newtag)
+	}
+	mu.Unlock()
+	ccNotifySubscribers()
+
+	if kept {
+		reason += ", keeping the last verified configuration"
+	}
+	for _, u := range objs {
+		st, found := status[u.GetName()]
+		if !found {
+			if rc != nil {
+				st = ccCrdStatus_s{false, reason}
+			} else {
+				st = ccCrdStatus_s{true, "configuration active"}
+			}
+		}
+		ccCrdWriteStatus(u, st)
+	}
+
+	return rc
+}
+
+// ccCrdStatusMatches returns true if the status of a CryptoConfigSet
+// custom resource already reports st for the current generation
+func ccCrdStatusMatches(u *unstructured.Unstructured, st ccCrdStatus_s) bool {
+
+	_, hasstatus, _ := unstructured.NestedFieldNoCopy(u.Object, "status")
+	valid, _, _ := unstructured.NestedBool(u.Object, "status", "valid")
+	message, _, _ := unstructured.NestedString(u.Object, "status", "message")
+	generation, _, _ := unstructured.NestedInt64(u.Object, "status", "observedGeneration")
+
+	return hasstatus && valid == st.valid && message == st.message && generation == u.GetGeneration()
+}
+
+// ccCrdWriteStatus updates the status of a CryptoConfigSet custom resource.
+// The plugin instances on all nodes come to the same result, so the status
+// is only written if it differs from what is already there. On a conflict
+// another instance was faster, then the status is checked again on the
+// current custom resource.
+func ccCrdWriteStatus(u *unstructured.Unstructured, st ccCrdStatus_s) {
+
+	for try := 0; try < 2; try++ {
+		if ccCrdStatusMatches(u, st) {
+			return
+		}
+		nu := u.DeepCopy()
+		nu.Object["status"] = map[string]interface{}{
+			"valid":              st.valid,
+			"message":            st.message,
+			"observedGeneration": u.GetGeneration(),
+		}
+		_, err := ccCrdClient.Resource(ccCrdGVR).UpdateStatus(context.TODO(), nu, metav1.UpdateOptions{})
+		if err == nil {
+			return
+		}
+		if !apierrors.IsConflict(err) {
+			log.Printf("CryptoConfigCrd: Failed to update status of CryptoConfigSet '%s': %s\n", u.GetName(), err)
+			return
+		}
+		u, err = ccCrdClient.Resource(ccCrdGVR).Get(context.TODO(), u.GetName(), metav1.GetOptions{})
+		if err != nil {
+			log.Printf("CryptoConfigCrd: Failed to fetch CryptoConfigSet '%s': %s\n", nu.GetName(), err)
+			return
+		}
+	}
+	log.Printf("CryptoConfigCrd: Failed to update status of CryptoConfigSet '%s': conflicting updates\n", u.GetName())
+}
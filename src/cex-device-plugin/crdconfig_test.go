@@ -0,0 +1,233 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * tests for the CryptoConfigSet custom resources as config source,
+ * run against a fake dynamic client
+ */
+
+// run with
+// $ go test -run CcCrd
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ccCrdTestObj returns a CryptoConfigSet custom resource with the given spec
+func ccCrdTestObj(name string, spec map[string]interface{}) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "cex.s390.ibm.com/v1",
+		"kind":       "CryptoConfigSet",
+		"metadata":   map[string]interface{}{"name": name},
+	}}
+	if spec != nil {
+		u.Object["spec"] = spec
+	}
+	u.SetGeneration(1)
+
+	return u
+}
+
+func ccCrdTestSpec(project string, adapter int64) map[string]interface{} {
+	return map[string]interface{}{
+		"project": project,
+		"apqns":   []interface{}{map[string]interface{}{"adapter": adapter, "domain": int64(5)}},
+	}
+}
+
+// ccCrdTestStatusUpdates returns the names of the custom resources whose
+// status was written via the fake client
+func ccCrdTestStatusUpdates(client *dynamicfake.FakeDynamicClient) []string {
+	var names []string
+	for _, a := range client.Actions() {
+		if a.GetVerb() == "update" && a.GetSubresource() == "status" {
+			obj := a.(k8stesting.UpdateAction).GetObject().(*unstructured.Unstructured)
+			names = append(names, obj.GetName())
+		}
+	}
+
+	return names
+}
+
+func TestCcCrdParseSet(t *testing.T) {
+	var tests = []struct {
+		name       string
+		obj        *unstructured.Unstructured
+		setname    string // empty if an error is expected
+		overcommit int
+	}{
+		{
+			name:       "setname given",
+			obj:        ccCrdTestObj("cr", map[string]interface{}{"setname": "set", "project": "test"}),
+			setname:    "set",
+			overcommit: -1,
+		},
+		{
+			name:       "setname defaults to the resource name",
+			obj:        ccCrdTestObj("cr", map[string]interface{}{"project": "test", "overcommit": int64(3)}),
+			setname:    "cr",
+			overcommit: 3,
+		},
+		{
+			name: "no spec",
+			obj:  ccCrdTestObj("cr", nil),
+		},
+		{
+			name: "invalid field type",
+			obj:  ccCrdTestObj("cr", map[string]interface{}{"project": int64(1)}),
+		},
+	}
+	for _, test := range tests {
+		s, _, err := ccCrdParseSet(test.obj)
+		if len(test.setname) == 0 {
+			if err == nil {
+				t.Errorf(`ccCrdParseSet for "%s" did not fail`, test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf(`ccCrdParseSet for "%s" failed: %s`, test.name, err)
+			continue
+		}
+		if s.SetName != test.setname || s.Overcommit != test.overcommit {
+			t.Errorf(`ccCrdParseSet for "%s" returned setname "%s" overcommit %d, expected "%s" %d`,
+				test.name, s.SetName, s.Overcommit, test.setname, test.overcommit)
+		}
+	}
+}
+
+func TestCcCrdUpdate(t *testing.T) {
+	savecc, savetag, saverejected := cc, tag, rejectedtag
+	saveclient, saveinformer, savelasttag := ccCrdClient, ccCrdInformer, ccCrdLastTag
+	defer func() {
+		cc, tag, rejectedtag = savecc, savetag, saverejected
+		ccCrdClient, ccCrdInformer, ccCrdLastTag = saveclient, saveinformer, savelasttag
+		MetricsCollConfigRejected(false)
+	}()
+	cc, tag, rejectedtag, ccCrdLastTag = nil, nil, nil, nil
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{ccCrdGVR: "CryptoConfigSetList"},
+		ccCrdTestObj("red", ccCrdTestSpec("red", 1)),
+		ccCrdTestObj("blue", ccCrdTestSpec("blue", 2)))
+	ccCrdClient = client
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+	ccCrdInformer = factory.ForResource(ccCrdGVR).Informer()
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, ccCrdInformer.HasSynced) {
+		t.Fatalf(`Failed to sync the informer cache`)
+	}
+
+	if err := ccCrdUpdate(); err != nil {
+		t.Fatalf(`ccCrdUpdate failed: %s`, err)
+	}
+	if GetCurrentCryptoConfig() == nil || len(GetCurrentCryptoConfig().CryptoConfigSets) != 2 {
+		t.Errorf(`ccCrdUpdate did not activate a config with 2 sets: %v`, GetCurrentCryptoConfig())
+	}
+	if names := ccCrdTestStatusUpdates(client); len(names) != 2 {
+		t.Errorf(`ccCrdUpdate wrote the status of %v, expected both custom resources`, names)
+	}
+	for _, name := range []string{"red", "blue"} {
+		u, err := ccCrdClient.Resource(ccCrdGVR).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf(`Get of custom resource "%s" failed: %s`, name, err)
+		}
+		if !ccCrdStatusMatches(u, ccCrdStatus_s{true, "configuration active"}) {
+			t.Errorf(`Custom resource "%s" has status %v`, name, u.Object["status"])
+		}
+	}
+
+	// the same specs give the same tag, nothing is written again
+	client.ClearActions()
+	if err := ccCrdUpdate(); err != nil {
+		t.Errorf(`ccCrdUpdate with unchanged specs failed: %s`, err)
+	}
+	if names := ccCrdTestStatusUpdates(client); len(names) != 0 {
+		t.Errorf(`ccCrdUpdate with unchanged specs wrote the status of %v`, names)
+	}
+
+	// the status written by another plugin instance is not written again
+	client.ClearActions()
+	u, _ := ccCrdClient.Resource(ccCrdGVR).Get(context.TODO(), "red", metav1.GetOptions{})
+	ccCrdWriteStatus(u, ccCrdStatus_s{true, "configuration active"})
+	if names := ccCrdTestStatusUpdates(client); len(names) != 0 {
+		t.Errorf(`ccCrdWriteStatus with unchanged status wrote the status of %v`, names)
+	}
+
+	// a stale object whose status was written by another instance in the
+	// meantime leads to a conflict, the status is not written again
+	stale := ccCrdTestObj("red", ccCrdTestSpec("red", 1))
+	stale.SetResourceVersion("stale")
+	client.PrependReactor("update", "cryptoconfigsets", func(a k8stesting.Action) (bool, runtime.Object, error) {
+		obj := a.(k8stesting.UpdateAction).GetObject().(*unstructured.Unstructured)
+		if obj.GetResourceVersion() == "stale" {
+			return true, nil, apierrors.NewConflict(ccCrdGVR.GroupResource(), obj.GetName(), nil)
+		}
+		return false, nil, nil
+	})
+	client.ClearActions()
+	ccCrdWriteStatus(stale, ccCrdStatus_s{true, "configuration active"})
+	if names := ccCrdTestStatusUpdates(client); len(names) != 1 {
+		t.Errorf(`ccCrdWriteStatus on a stale object wrote the status of %v, expected one conflicting write`, names)
+	}
+
+	// an invalid set rejects the config and is reported in its status
+	u, _ = ccCrdClient.Resource(ccCrdGVR).Get(context.TODO(), "blue", metav1.GetOptions{})
+	u.Object["spec"] = ccCrdTestSpec("red", 1)
+	u.SetGeneration(2)
+	if _, err := ccCrdClient.Resource(ccCrdGVR).Update(context.TODO(), u, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf(`Update of custom resource "blue" failed: %s`, err)
+	}
+	for i := 0; i < 100 && ccCrdTestGeneration(t, "blue") != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.ClearActions()
+	if err := ccCrdUpdate(); err == nil {
+		t.Errorf(`ccCrdUpdate with a duplicate APQN did not fail`)
+	}
+	if names := ccCrdTestStatusUpdates(client); len(names) != 2 {
+		t.Errorf(`ccCrdUpdate with an invalid set wrote the status of %v, expected both custom resources`, names)
+	}
+	u, _ = ccCrdClient.Resource(ccCrdGVR).Get(context.TODO(), "blue", metav1.GetOptions{})
+	if valid, _, _ := unstructured.NestedBool(u.Object, "status", "valid"); valid {
+		t.Errorf(`Invalid custom resource "blue" has status %v`, u.Object["status"])
+	}
+}
+
+// ccCrdTestGeneration returns the generation of a custom resource in the informer cache
+func ccCrdTestGeneration(t *testing.T, name string) int64 {
+	o, found, err := ccCrdInformer.GetStore().GetByKey(name)
+	if err != nil || !found {
+		t.Fatalf(`Custom resource "%s" not in the informer cache: %v`, name, err)
+	}
+
+	return o.(*unstructured.Unstructured).GetGeneration()
+}
@@ -31,10 +31,15 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/validation"
 )
 
@@ -53,21 +58,38 @@ var (
 var ccsfile = getenvstr("CCS_JSON_FILE", "/config/cex_resources.json")
 var sysinfofile = getenvstr("PROC_SYSINFO_FILE", "/proc/sysinfo")
 var Cccheckinterval = time.Duration(getenvint("CRYPTOCONFIG_CHECK_INTERVAL", 120, 30, 300))
+var ccKeepLastGood = getenvint("CRYPTOCONFIG_KEEP_LAST_GOOD", 1, 0, 1) > 0
+var ccConfigMapName = getenvstr("CRYPTOCONFIG_CONFIGMAP", "cex-resources-config")
+
+var rejectedtag []byte // tag of the last rejected config revision
 
 type CryptoConfig struct {
 	CryptoConfigSets []*CryptoConfigSet `json:"cryptoconfigsets"`
 }
 
 type CryptoConfigSet struct {
-	SetName     string    `json:"setname"`
-	Project     string    `json:"project"`
-	CexMode     string    `json:"cexmode"`
-	MinCexGen   string    `json:"mincexgen"`
-	_overcommit *int      `json:"overcommit,omitempty"` // intermediate field for parsing
-	Overcommit  int       `json:"-"`                    // -1 if not given, otherwise value of *_overcommit
-	_livesysfs  *int      `json:"livesysfs,omitempty"`  // intermediate field for parsing
-	Livesysfs   int       `json:"-"`                    // -1 if not given, otherwise value of *_livesysfs
-	APQNDefs    []APQNDef `json:"apqns"`
+	SetName         string                `json:"setname"`
+	Project         string                `json:"project"`
+	Projects        []string              `json:"projects,omitempty"`          // additional namespaces allowed to use this set
+	NsSelector      *metav1.LabelSelector `json:"namespaceselector,omitempty"` // namespaces allowed to use this set by label
+	CexMode         string                `json:"cexmode"`
+	MinCexGen       string                `json:"mincexgen"`
+	Overcommit      int                   `json:"-"`                         // -1 if not given, see UnmarshalJSON and MarshalJSON
+	Livesysfs       int                   `json:"-"`                         // -1 if not given, see UnmarshalJSON and MarshalJSON
+	AllocPolicy     string                `json:"allocpolicy,omitempty"`     // "spread" (default), "pack" or "same-adapter"
+	ViolationPolicy string                `json:"violationpolicy,omitempty"` // "log" (default), "event", "destroy-node" or "evict-pod"
+	SecureExecution bool                  `json:"secureexecution,omitempty"` // only announce APQNs bound (and associated) for Secure Execution
+	MKVPs           []string              `json:"mkvps,omitempty"`           // only announce APQNs with one of these current master keys
+	Ioctls          []IoctlDef            `json:"ioctls,omitempty"`          // allowed ioctls, empty means all
+	APQNDefs        []APQNDef             `json:"apqns"`
+	overcommitgiven bool                  // overcommit given in the json, even if invalid
+	livesysfsgiven  bool                  // livesysfs given in the json, even if invalid
+}
+
+// an ioctl given either by name (like "ZSECSENDCPRB") or by number
+type IoctlDef struct {
+	Name string // ioctl name, empty if given by number
+	Nr   int    // ioctl number, only valid if Name is empty
 }
 
 type APQNDef struct {
@@ -76,6 +98,51 @@ type APQNDef struct {
 	MachineId string `json:"machineid"`
 }
 
+func (d *IoctlDef) UnmarshalJSON(data []byte) error {
+
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		d.Name, d.Nr = name, 0
+		return nil
+	}
+	var nr int
+	if err := json.Unmarshal(data, &nr); err != nil {
+		return fmt.Errorf("ioctl %s is neither a name nor a number", string(data))
+	}
+	d.Name, d.Nr = "", nr
+
+	return nil
+}
+
+func (d IoctlDef) MarshalJSON() ([]byte, error) {
+
+	if len(d.Name) > 0 {
+		return json.Marshal(d.Name)
+	}
+	return json.Marshal(d.Nr)
+}
+
+// Number returns the ioctl number or -1 for an unknown ioctl name
+func (d IoctlDef) Number() int {
+
+	if len(d.Name) > 0 {
+		nr, found := zcryptIoctlNumbers[d.Name]
+		if !found {
+			return -1
+		}
+		return nr
+	}
+	return d.Nr
+}
+
+func (d IoctlDef) String() string {
+
+	if len(d.Name) > 0 {
+		return d.Name
+	}
+	return fmt.Sprintf("%d", d.Nr)
+}
+
 func (cc CryptoConfig) String() string {
 
 	var b strings.Builder
@@ -113,7 +180,62 @@ func (cc CryptoConfig) Equal(o *CryptoConfig) bool {
 	return true
 }
 
-func (cc CryptoConfig) Verify() bool {
+// ValidationError describes one problem found by CryptoConfig.Verify
+type ValidationError struct {
+	SetName string   `json:"setname"`        // name of the offending config set
+	APQN    *APQNDef `json:"apqn,omitempty"` // offending APQN, nil if not APQN related
+	Field   string   `json:"field"`          // offending field, like "cexmode"
+	Reason  string   `json:"reason"`
+}
+
+type ValidationErrors []*ValidationError
+
+func (e *ValidationError) Error() string {
+
+	if e.APQN != nil {
+		return fmt.Sprintf("set '%s' APQN(%d,%d) %s: %s",
+			e.SetName, e.APQN.Adapter, e.APQN.Domain, e.Field, e.Reason)
+	}
+	return fmt.Sprintf("set '%s' %s: %s", e.SetName, e.Field, e.Reason)
+}
+
+func (l ValidationErrors) Error() string {
+
+	var b strings.Builder
+	for i, e := range l {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(e.Error())
+	}
+	return b.String()
+}
+
+// ForSet returns the validation errors related to the given config set
+func (l ValidationErrors) ForSet(setname string) ValidationErrors {
+
+	var errs ValidationErrors
+	for _, e := range l {
+		if e.SetName == setname {
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
+
+// Log writes one log line per validation error
+func (l ValidationErrors) Log() {
+
+	for _, e := range l {
+		log.Printf("CryptoConfig verify: %s\n", e)
+	}
+}
+
+// Verify checks the crypto config and returns all the problems found,
+// an empty list means the crypto config is valid.
+func (cc CryptoConfig) Verify() ValidationErrors {
+
+	var errs ValidationErrors
 
 	var checkapqns func(APQNDef, APQNDef) bool = func(a1, a2 APQNDef) bool {
 		if a1.Adapter == a2.Adapter && a1.Domain == a2.Domain {
@@ -127,27 +249,48 @@ func (cc CryptoConfig) Verify() bool {
 	}
 
 	for i, s := range cc.CryptoConfigSets {
-		prestr := "CryptoConfig verify:"
+		adderr := func(field, format string, args ...any) {
+			errs = append(errs, &ValidationError{
+				SetName: s.SetName,
+				Field:   field,
+				Reason:  fmt.Sprintf(format, args...),
+			})
+		}
+		addapqnerr := func(a APQNDef, format string, args ...any) {
+			errs = append(errs, &ValidationError{
+				SetName: s.SetName,
+				APQN:    &a,
+				Field:   "apqns",
+				Reason:  fmt.Sprintf(format, args...),
+			})
+		}
 		// check setname - needs to be a valid qualified name
-		if errs := validation.IsQualifiedName(s.SetName); len(errs) > 0 {
-			log.Printf("%s Set name '%s' not a valid qualified name:\n", prestr, s.SetName)
-			for _, errstr := range errs {
-				log.Println(errstr)
-			}
-			return false
+		if verrs := validation.IsQualifiedName(s.SetName); len(verrs) > 0 {
+			adderr("setname", "'%s' not a valid qualified name: %s", s.SetName, strings.Join(verrs, ", "))
 		}
 		// check setnames - need to be unique
 		for j, s2 := range cc.CryptoConfigSets {
-			if i != j && s.SetName == s2.SetName {
-				log.Printf("%s More than one set '%s' - setname needs to be unique\n", prestr, s.SetName)
-				return false
+			if j < i && s.SetName == s2.SetName {
+				adderr("setname", "more than one set '%s' - setname needs to be unique", s.SetName)
+				break
 			}
 		}
-		prestr = fmt.Sprintf("CrpytoConfigSet '%s' verify:", s.SetName)
-		// check projectname - must not be empty
-		if len(s.Project) == 0 {
-			log.Printf("%s Projectname is empty\n", prestr)
-			return false
+		// check projectnames and namespace selector - at least one of them is needed
+		if len(s.Project) == 0 && len(s.Projects) == 0 && s.NsSelector == nil {
+			adderr("project", "projectname is empty and no projects or namespaceselector given")
+		}
+		for k, p := range s.Projects {
+			if len(p) == 0 {
+				adderr("projects", "projectname at index %d is empty", k)
+			}
+		}
+		if s.NsSelector != nil {
+			sel, err := metav1.LabelSelectorAsSelector(s.NsSelector)
+			if err != nil {
+				adderr("namespaceselector", "invalid label selector: %s", err)
+			} else if sel.Empty() {
+				adderr("namespaceselector", "empty label selector would select all namespaces")
+			}
 		}
 		// check cexmode
 		if len(s.CexMode) > 0 {
@@ -155,64 +298,77 @@ func (cc CryptoConfig) Verify() bool {
 			case "ep11", "cca", "accel":
 				break
 			default:
-				log.Printf("%s Unknown/unsupported cexmode '%s'\n", prestr, s.CexMode)
-				return false
+				adderr("cexmode", "unknown/unsupported cexmode '%s'", s.CexMode)
 			}
 		}
 		// check mincexgen
 		if len(s.MinCexGen) > 0 {
 			match, _ := regexp.MatchString("^cex[456789]$", s.MinCexGen)
 			if !match {
-				log.Printf("%s Unknown/unsupported mincexgen '%s'\n", prestr, s.MinCexGen)
-				return false
+				adderr("mincexgen", "unknown/unsupported mincexgen '%s'", s.MinCexGen)
 			}
 		}
-		// check optional overcommit limit
-		s.Overcommit = -1 // -1 means no overcommit given, so use the default value
-		if s._overcommit != nil {
-			// accect values >= 0
-			if *s._overcommit < 0 {
-				log.Printf("%s Unknown/unsupported overcommit value '%d'\n", prestr, *s._overcommit)
-				return false
+		// check optional allocation policy
+		if len(s.AllocPolicy) > 0 {
+			switch s.AllocPolicy {
+			case AllocPolicySpread, AllocPolicyPack, AllocPolicySameAdapter:
+				break
+			default:
+				adderr("allocpolicy", "unknown/unsupported allocpolicy '%s'", s.AllocPolicy)
 			}
-			s.Overcommit = *s._overcommit
-			log.Printf("%s Optional 'overcommit = %d' parameter specified in config set\n",
-				prestr, s.Overcommit)
-		}
-		// check optional livesysfs parameter
-		s.Livesysfs = -1 // -1 means to use the default (see apqnLiveSysfs from plugin.go)
-		if s._livesysfs != nil {
-			// accect values >= 0, meaning 0: livesysfs disabled, > 0 livesysfs enabled
-			if *s._livesysfs < 0 {
-				log.Printf("%s Unknown/unsupported livesysfs value '%d'\n", prestr, *s._livesysfs)
-				return false
+		}
+		// check optional violation policy
+		if len(s.ViolationPolicy) > 0 {
+			if _, found := violationPolicyLevel[s.ViolationPolicy]; !found {
+				adderr("violationpolicy", "unknown/unsupported violationpolicy '%s'", s.ViolationPolicy)
+			}
+		}
+		// check optional master key verification patterns
+		for k, vp := range s.MKVPs {
+			match, _ := regexp.MatchString("^(0x)?([[:xdigit:]]{16}|[[:xdigit:]]{64})$", vp)
+			if !match {
+				adderr("mkvps", "invalid verification pattern '%s' at index %d", vp, k)
 			}
-			s.Livesysfs = *s._livesysfs
-			log.Printf("%s Optional 'livesysfs = %d' parameter specified in config set\n",
-				prestr, s.Livesysfs)
+		}
+		// check optional ioctl allowlist
+		for k, d := range s.Ioctls {
+			nr := d.Number()
+			if nr < 0 || nr > 255 {
+				adderr("ioctls", "unknown/unsupported ioctl '%s'", d)
+				continue
+			}
+			for n, d2 := range s.Ioctls {
+				if n < k && nr == d2.Number() {
+					adderr("ioctls", "ioctl '%s' and ioctl '%s' are effectively the same", d2, d)
+					break
+				}
+			}
+		}
+		// check optional overcommit limit, if not given the default value is used
+		if s.overcommitgiven && s.Overcommit < 0 {
+			adderr("overcommit", "unknown/unsupported overcommit value '%d'", s.Overcommit)
+		}
+		// check optional livesysfs parameter, if not given the default is
+		// used (see apqnLiveSysfs from plugin.go), 0: disabled, > 0 enabled
+		if s.livesysfsgiven && s.Livesysfs < 0 {
+			adderr("livesysfs", "unknown/unsupported livesysfs value '%d'", s.Livesysfs)
 		}
 		// check APQNDefs
 		for k, a := range s.APQNDefs {
 			// check APQN adapter value
 			if a.Adapter < 0 || a.Adapter > 255 {
-				log.Printf("%s APQN(%d,%d) - invalid adapter %d [0...255]\n",
-					prestr, a.Adapter, a.Domain, a.Adapter)
-				return false
+				addapqnerr(a, "invalid adapter %d [0...255]", a.Adapter)
 			}
 			// check APQN domain value
 			if a.Domain < 0 || a.Domain > 255 {
-				log.Printf("%s APQN(%d,%d) - invalid domain %d [0...255]\n",
-					prestr, a.Adapter, a.Domain, a.Domain)
-				return false
+				addapqnerr(a, "invalid domain %d [0...255]", a.Domain)
 			}
 			// each APQN neads to be unique within the configset
 			for n, a2 := range s.APQNDefs {
-				if k != n {
-					if !checkapqns(a, a2) {
-						log.Printf("%s APQN(%d,%d) and APQN(%d,%d) are effectively the same\n",
-							prestr, a.Adapter, a.Domain, a2.Adapter, a2.Domain)
-						return false
-					}
+				if n < k && !checkapqns(a, a2) {
+					addapqnerr(a, "APQN(%d,%d) and APQN(%d,%d) are effectively the same",
+						a2.Adapter, a2.Domain, a.Adapter, a.Domain)
+					break
 				}
 			}
 			// and must not appear on other config sets
@@ -220,9 +376,8 @@ func (cc CryptoConfig) Verify() bool {
 				if i != j {
 					for _, a2 := range s2.APQNDefs {
 						if !checkapqns(a, a2) {
-							log.Printf("%s APQN(%d,%d) appears also in set '%s'\n",
-								prestr, a.Adapter, a.Domain, s2.SetName)
-							return false
+							addapqnerr(a, "APQN appears also in set '%s'", s2.SetName)
+							break
 						}
 					}
 				}
@@ -230,7 +385,7 @@ func (cc CryptoConfig) Verify() bool {
 		}
 	}
 
-	return true
+	return errs
 }
 
 func (cc CryptoConfig) PrettyLog() {
@@ -240,6 +395,12 @@ func (cc CryptoConfig) PrettyLog() {
 	for _, e := range cc.CryptoConfigSets {
 		log.Printf("  setname: '%s'\n", e.SetName)
 		log.Printf("    project: '%s'\n", e.Project)
+		if len(e.Projects) > 0 {
+			log.Printf("    projects: %v\n", e.Projects)
+		}
+		if e.NsSelector != nil {
+			log.Printf("    namespaceselector: '%s'\n", metav1.FormatLabelSelector(e.NsSelector))
+		}
 		if len(e.CexMode) > 0 {
 			log.Printf("    cexmode: '%s'\n", e.CexMode)
 		}
@@ -252,6 +413,21 @@ func (cc CryptoConfig) PrettyLog() {
 		if e.Livesysfs >= 0 {
 			log.Printf("    livesysfs: %d\n", e.Livesysfs)
 		}
+		if len(e.AllocPolicy) > 0 {
+			log.Printf("    allocpolicy: '%s'\n", e.AllocPolicy)
+		}
+		if len(e.ViolationPolicy) > 0 {
+			log.Printf("    violationpolicy: '%s'\n", e.ViolationPolicy)
+		}
+		if e.SecureExecution {
+			log.Printf("    secureexecution: %v\n", e.SecureExecution)
+		}
+		if len(e.MKVPs) > 0 {
+			log.Printf("    mkvps: %v\n", e.MKVPs)
+		}
+		if len(e.Ioctls) > 0 {
+			log.Printf("    ioctls: %v\n", e.Ioctls)
+		}
 		n = len(e.APQNDefs)
 		if n > 0 {
 			log.Printf("    %d equvialent APQNs:\n", n)
@@ -313,22 +489,161 @@ func (cc *CryptoConfig) GetCryptoConfigSetForThisAPQN(ap, dom int, machineid str
 	return nil
 }
 
+func (s *CryptoConfigSet) UnmarshalJSON(data []byte) error {
+
+	// the optional overcommit and livesysfs fields are parsed into pointers
+	// to distinguish an absent field (-1) from a given value. Negative given
+	// values are kept and reported by Verify with the other errors.
+	type plainset CryptoConfigSet
+	aux := struct {
+		*plainset
+		Overcommit *int `json:"overcommit"`
+		Livesysfs  *int `json:"livesysfs"`
+	}{
+		plainset: (*plainset)(s),
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	s.Overcommit, s.overcommitgiven = -1, aux.Overcommit != nil
+	if s.overcommitgiven {
+		s.Overcommit = *aux.Overcommit
+	}
+	s.Livesysfs, s.livesysfsgiven = -1, aux.Livesysfs != nil
+	if s.livesysfsgiven {
+		s.Livesysfs = *aux.Livesysfs
+	}
+
+	return nil
+}
+
+func (s CryptoConfigSet) MarshalJSON() ([]byte, error) {
+
+	// the counterpart of UnmarshalJSON, overcommit and livesysfs are only
+	// emitted if given, so an absent field stays absent
+	type plainset CryptoConfigSet
+	aux := struct {
+		plainset
+		Overcommit *int `json:"overcommit,omitempty"`
+		Livesysfs  *int `json:"livesysfs,omitempty"`
+	}{
+		plainset: plainset(s),
+	}
+	if s.overcommitgiven {
+		aux.Overcommit = &s.Overcommit
+	}
+	if s.livesysfsgiven {
+		aux.Livesysfs = &s.Livesysfs
+	}
+
+	return json.Marshal(aux)
+}
+
 func (s CryptoConfigSet) String() string {
-	return fmt.Sprintf("Set(setname=%s,project=%s,cexmode=%s,mincexgen=%s,overcommit=%d,livesysfs=%d,apqndefs=%s)",
-		s.SetName, s.Project, s.CexMode, s.MinCexGen, s.Overcommit, s.Livesysfs, s.APQNDefs)
+	return fmt.Sprintf("Set(setname=%s,project=%s,projects=%v,namespaceselector=%s,cexmode=%s,mincexgen=%s,overcommit=%d,livesysfs=%d,allocpolicy=%s,violationpolicy=%s,secureexecution=%v,mkvps=%v,ioctls=%v,apqndefs=%s)",
+		s.SetName, s.Project, s.Projects, metav1.FormatLabelSelector(s.NsSelector), s.CexMode, s.MinCexGen, s.Overcommit, s.Livesysfs, s.AllocPolicy, s.ViolationPolicy, s.SecureExecution, s.MKVPs, s.Ioctls, s.APQNDefs)
+}
+
+// AllowsNamespace returns true if pods of the namespace may use the config
+// set. An error is returned if the labels of the namespace needed for the
+// namespaceselector can't be looked up, the result is unknown then.
+func (s *CryptoConfigSet) AllowsNamespace(namespace string) (bool, error) {
+
+	if s == nil {
+		return false, nil
+	}
+	if s.Project == namespace || slices.Contains(s.Projects, namespace) {
+		return true, nil
+	}
+	if s.NsSelector == nil {
+		return false, nil
+	}
+	nslabels, err := namespaceLabels(namespace)
+	if err != nil {
+		return false, fmt.Errorf("CryptoConfig: Can't check namespace '%s' against namespaceselector of set '%s': %w",
+			namespace, s.SetName, err)
+	}
+
+	return s.AllowsNamespaceWithLabels(namespace, nslabels), nil
+}
+
+// AllowsNamespaceWithLabels is AllowsNamespace for callers which already
+// know the labels of the namespace
+func (s *CryptoConfigSet) AllowsNamespaceWithLabels(namespace string, nslabels map[string]string) bool {
+
+	if s == nil {
+		return false
+	}
+	if s.Project == namespace || slices.Contains(s.Projects, namespace) {
+		return true
+	}
+	if s.NsSelector == nil {
+		return false
+	}
+	sel, err := metav1.LabelSelectorAsSelector(s.NsSelector)
+	if err != nil {
+		return false
+	}
+
+	return sel.Matches(labels.Set(nslabels))
+}
+
+// NamespacesString returns the namespaces allowed to use the config set
+func (s *CryptoConfigSet) NamespacesString() string {
+
+	ns := []string{}
+	if len(s.Project) > 0 {
+		ns = append(ns, s.Project)
+	}
+	ns = append(ns, s.Projects...)
+	if s.NsSelector != nil {
+		ns = append(ns, "selector("+metav1.FormatLabelSelector(s.NsSelector)+")")
+	}
+	return strings.Join(ns, ",")
+}
+
+// IoctlNumbers returns the sorted ioctl numbers of the allowlist, nil means all
+func (s *CryptoConfigSet) IoctlNumbers() []int {
+
+	var nrs []int
+
+	if s == nil {
+		return nrs
+	}
+	for _, d := range s.Ioctls {
+		if nr := d.Number(); nr >= 0 {
+			nrs = append(nrs, nr)
+		}
+	}
+	sort.Ints(nrs)
+
+	return nrs
 }
 
 func (s CryptoConfigSet) equal(o *CryptoConfigSet) bool {
 
 	if s.SetName != o.SetName ||
 		s.Project != o.Project ||
+		!slices.Equal(s.Projects, o.Projects) ||
+		metav1.FormatLabelSelector(s.NsSelector) != metav1.FormatLabelSelector(o.NsSelector) ||
 		s.CexMode != o.CexMode ||
 		s.MinCexGen != o.MinCexGen ||
 		s.Overcommit != o.Overcommit ||
 		s.Livesysfs != o.Livesysfs ||
+		s.AllocPolicy != o.AllocPolicy ||
+		s.ViolationPolicy != o.ViolationPolicy ||
+		s.SecureExecution != o.SecureExecution ||
+		!slices.Equal(s.MKVPs, o.MKVPs) ||
+		len(s.Ioctls) != len(o.Ioctls) ||
 		len(s.APQNDefs) != len(o.APQNDefs) {
 		return false
 	}
+	for i, d := range s.Ioctls {
+		if d != o.Ioctls[i] {
+			return false
+		}
+	}
 	for _, a := range s.APQNDefs {
 		found := false
 		for _, o := range o.APQNDefs {
@@ -348,10 +663,20 @@ func (a APQNDef) String() string {
 	return fmt.Sprintf("APQN(%d,%d,%s)", a.Adapter, a.Domain, a.MachineId)
 }
 
-func ccReadConfigFile() (*CryptoConfig, error) {
+// ccParseConfig parses the json content of a crypto config file
+func ccParseConfig(rawdata []byte) (*CryptoConfig, error) {
 
 	var cc CryptoConfig
 
+	if err := json.Unmarshal(rawdata, &cc); err != nil {
+		return nil, err
+	}
+
+	return &cc, nil
+}
+
+func ccReadConfigFile() (*CryptoConfig, error) {
+
 	config, err := os.Open(ccsfile)
 	if err != nil {
 		log.Printf("CryptoConfig: Can't open config file '%s': %s\n", ccsfile, err)
@@ -365,12 +690,13 @@ func ccReadConfigFile() (*CryptoConfig, error) {
 		return nil, fmt.Errorf("CryptoConfig: Error reading config file '%s': %w", ccsfile, err)
 	}
 
-	if err = json.Unmarshal(rawdata, &cc); err != nil {
+	cc, err := ccParseConfig(rawdata)
+	if err != nil {
 		log.Printf("CryptoConfig: Error parsing config file '%s': %s\n", ccsfile, err)
 		return nil, fmt.Errorf("CryptoConfig: Error parsing config file '%s': %w", ccsfile, err)
 	}
 
-	return &cc, nil
+	return cc, nil
 }
 
 func ccGetMachineId() (string, error) {
@@ -453,32 +779,107 @@ func updateConfig() error {
 	if err != nil {
 		return err
 	}
-	mu.Lock()
-	defer mu.Unlock()
-	if bytes.Equal(newtag, tag) {
+	mu.RLock()
+	// a rejected config revision has already been reported
+	unchanged := bytes.Equal(newtag, tag) || bytes.Equal(newtag, rejectedtag)
+	reverted := bytes.Equal(newtag, tag) && rejectedtag != nil
+	mu.RUnlock()
+	if reverted {
+		// the rejected revision has been reverted to the current config
+		mu.Lock()
+		if bytes.Equal(newtag, tag) && rejectedtag != nil {
+			rejectedtag = nil
+			MetricsCollConfigRejected(false)
+			log.Printf("CryptoConfig: Rejected configuration reverted to the current configuration\n")
+		}
+		mu.Unlock()
 		return nil
 	}
+	if unchanged {
+		return nil
+	}
+	// the current config changes now one way or the other, so notify
+	// the subscribers when done and the lock is released again
+	defer ccNotifySubscribers()
+	mu.Lock()
+	defer mu.Unlock()
 	log.Printf("CryptoConfig: Configuration changes detected\n")
-	// In case of an error, do not provide any configuration.
-	// If reading and verification succeeds, we will overwrite this below
-	cc, tag = nil, nil
+	var refs []*corev1.ObjectReference
+	if ns := kubeNamespace(); len(ns) > 0 {
+		refs = append(refs, &corev1.ObjectReference{
+			Kind:       "ConfigMap",
+			APIVersion: "v1",
+			Namespace:  ns,
+			Name:       ccConfigMapName,
+		})
+	}
 	newcc, err := ccReadConfigFile()
 	if err != nil {
+		ccReject(newtag, fmt.Sprintf("failed to read or parse the config file: %s", err), refs)
 		return fmt.Errorf("CryptoConfig: Failed to read or parse the new configuration!")
 	}
-	if !newcc.Verify() {
+	if errs := newcc.Verify(); len(errs) > 0 {
+		errs.Log()
+		ccReject(newtag, fmt.Sprintf("verification failed: %s", errs), refs)
 		return fmt.Errorf("CryptoConfig: Failed to verify new configuration!")
 	}
+	ccAccept(newcc, newtag)
+	return nil
+}
+
+// ccAccept makes the new verified config the current config, mu must be held
+func ccAccept(newcc *CryptoConfig, newtag []byte) {
+
 	cc, tag = newcc, newtag
+	rejectedtag = nil
+	MetricsCollConfigRejected(false)
 	log.Printf("CryptoConfig: Configuration successful updated\n")
-	return nil
+}
+
+// ccReject handles a new config revision which failed to read, parse or
+// verify, mu must be held. Unless disabled, the last verified config is
+// kept. Without a last verified config or with keep last good disabled,
+// the plugin runs without any config. The rejected revision is reported
+// via log, a kubernetes event on each of the given objects and metrics.
+// Returns true if the last verified config is kept.
+func ccReject(newtag []byte, reason string, refs []*corev1.ObjectReference) bool {
+
+	kept := ccKeepLastGood && cc != nil
+	rejectedtag = newtag
+	MetricsCollConfigRejected(true)
+
+	var msg string
+	if kept {
+		msg = fmt.Sprintf("New crypto configuration rejected (%s), keeping the last verified configuration", reason)
+	} else {
+		// do not provide any configuration
+		cc, tag = nil, nil
+		msg = fmt.Sprintf("New crypto configuration rejected (%s), no crypto configuration active", reason)
+	}
+	log.Printf("CryptoConfig: %s\n", msg)
+	for _, ref := range refs {
+		kubeRecordEvent(ref, corev1.EventTypeWarning, "CryptoConfigRejected", msg)
+	}
+
+	return kept
 }
 
 func InitializeConfigWatcher() (*CryptoConfig, error) {
+	if ccsource == CcSourceCrd {
+		if err := ccCrdStartWatcher(); err != nil {
+			return nil, err
+		}
+		return GetCurrentCryptoConfig(), nil
+	}
 	err := updateConfig()
 	if err != nil {
 		return nil, err
 	}
+	// config file changes are usually picked up by the file watcher,
+	// polling the config file is the fallback if that doesn't work
+	if err = ccStartFileWatcher(); err != nil {
+		log.Printf("CryptoConfig: Falling back to polling the config file only\n")
+	}
 	tick = time.NewTicker(Cccheckinterval * time.Second)
 	go func() {
 		for {
@@ -497,6 +898,11 @@ func InitializeConfigWatcher() (*CryptoConfig, error) {
 }
 
 func StopConfigWatcher() {
+	if ccsource == CcSourceCrd {
+		ccCrdStopWatcher()
+		return
+	}
+	ccStopFileWatcher()
 	tick.Stop()
 }
 
@@ -20,19 +20,22 @@
  */
 
 // run with
-// $ go test cryptoconfigs*.go
+// $ go test -run CryptoConfig
 // or for more verbose output
-// $ go test -v cryptoconfigs*.go
+// $ go test -v -run CryptoConfig
 // or for coverage
-// $ go test -coverprofile=c.out cryptoconfigs*.go; go tool cover -html=c.out
+// $ go test -coverprofile=c.out; go tool cover -html=c.out
 
 package main
 
 import (
-	"log"
+	"encoding/json"
+	"fmt"
 	"os"
-	"strconv"
+	"path/filepath"
 	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type TestAPQN struct {
@@ -42,28 +45,11 @@ type TestAPQN struct {
 	setidx    int
 }
 
-// Have to provide this to remove some dependencies.
-func getenvint(envvar string, defaultval, minval, maxval int) int {
-	valstr, isset := os.LookupEnv(envvar)
-	if isset {
-		valint, err := strconv.Atoi(valstr)
-		if err != nil {
-			log.Printf("Invalid setting for %s: %q.  Using default value...\n", envvar, err)
-			return defaultval
-		}
-		if valint < minval {
-			return minval
-		}
-		if valint > maxval {
-			return maxval
-		}
-		return valint
-	}
-	return defaultval
+// ccWithSet returns a config with just the given set
+func ccWithSet(s *CryptoConfigSet) CryptoConfig {
+	return CryptoConfig{CryptoConfigSets: []*CryptoConfigSet{s}}
 }
 
-func Int(v int) *int { return &v }
-
 func TestCryptoConfigVerification(t *testing.T) {
 	var tests = []struct {
 		config CryptoConfig
@@ -137,6 +123,60 @@ func TestCryptoConfigVerification(t *testing.T) {
 			name: "omitted project name",
 			want: false,
 		},
+		// projects list instead of project name
+		{
+			config: ccWithSet(&CryptoConfigSet{
+				SetName:  "set",
+				Projects: []string{"p1", "p2"},
+			}),
+			name: "projects list",
+			want: true,
+		},
+		// empty name in projects list
+		{
+			config: ccWithSet(&CryptoConfigSet{
+				SetName:  "set",
+				Projects: []string{"p1", ""},
+			}),
+			name: "empty name in projects list",
+			want: false,
+		},
+		// namespace selector instead of project name
+		{
+			config: ccWithSet(&CryptoConfigSet{
+				SetName: "set",
+				NsSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"team": "ep11"},
+				},
+			}),
+			name: "namespace selector",
+			want: true,
+		},
+		// empty namespace selector
+		{
+			config: ccWithSet(&CryptoConfigSet{
+				SetName:    "set",
+				NsSelector: &metav1.LabelSelector{},
+			}),
+			name: "empty namespace selector",
+			want: false,
+		},
+		// invalid namespace selector
+		{
+			config: ccWithSet(&CryptoConfigSet{
+				SetName: "set",
+				NsSelector: &metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{
+						metav1.LabelSelectorRequirement{
+							Key:      "team",
+							Operator: "Foo",
+						},
+					},
+				},
+			}),
+			name: "invalid namespace selector",
+			want: false,
+		},
 		// invalid cex-mode
 		{
 			config: CryptoConfig{
@@ -191,7 +231,7 @@ func TestCryptoConfigVerification(t *testing.T) {
 					&CryptoConfigSet{
 						SetName:   "set",
 						Project:   "test",
-						Livesysfs: Int(1),
+						Livesysfs: 1,
 					},
 				},
 			},
@@ -205,7 +245,7 @@ func TestCryptoConfigVerification(t *testing.T) {
 					&CryptoConfigSet{
 						SetName:   "set",
 						Project:   "test",
-						Livesysfs: Int(0),
+						Livesysfs: 0,
 					},
 				},
 			},
@@ -217,9 +257,10 @@ func TestCryptoConfigVerification(t *testing.T) {
 			config: CryptoConfig{
 				CryptoConfigSets: []*CryptoConfigSet{
 					&CryptoConfigSet{
-						SetName:   "set",
-						Project:   "test",
-						Livesysfs: Int(-1),
+						SetName:        "set",
+						Project:        "test",
+						Livesysfs:      -1,
+						livesysfsgiven: true,
 					},
 				},
 			},
@@ -333,6 +374,114 @@ func TestCryptoConfigVerification(t *testing.T) {
 			name: "APQN in multiple sets",
 			want: false,
 		},
+		// unknown ioctl name
+		{
+			config: CryptoConfig{
+				CryptoConfigSets: []*CryptoConfigSet{
+					&CryptoConfigSet{
+						SetName: "set",
+						Project: "test",
+						Ioctls:  []IoctlDef{IoctlDef{Name: "ZSENDFOO"}},
+					},
+				},
+			},
+			name: "unknown ioctl name",
+			want: false,
+		},
+		// invalid ioctl number
+		{
+			config: CryptoConfig{
+				CryptoConfigSets: []*CryptoConfigSet{
+					&CryptoConfigSet{
+						SetName: "set",
+						Project: "test",
+						Ioctls:  []IoctlDef{IoctlDef{Nr: 256}},
+					},
+				},
+			},
+			name: "invalid ioctl number",
+			want: false,
+		},
+		// same ioctl by name and number
+		{
+			config: CryptoConfig{
+				CryptoConfigSets: []*CryptoConfigSet{
+					&CryptoConfigSet{
+						SetName: "set",
+						Project: "test",
+						Ioctls:  []IoctlDef{IoctlDef{Name: "ZSECSENDCPRB"}, IoctlDef{Nr: 0x81}},
+					},
+				},
+			},
+			name: "duplicated ioctl",
+			want: false,
+		},
+		// valid ioctls
+		{
+			config: CryptoConfig{
+				CryptoConfigSets: []*CryptoConfigSet{
+					&CryptoConfigSet{
+						SetName: "set",
+						Project: "test",
+						Ioctls:  []IoctlDef{IoctlDef{Name: "ICARSAMODEXPO"}, IoctlDef{Nr: 6}},
+					},
+				},
+			},
+			name: "valid ioctls",
+			want: true,
+		},
+		{
+			config: CryptoConfig{
+				CryptoConfigSets: []*CryptoConfigSet{
+					&CryptoConfigSet{
+						SetName:         "set",
+						Project:         "test",
+						ViolationPolicy: "kill",
+					},
+				},
+			},
+			name: "invalid violationpolicy",
+			want: false,
+		},
+		{
+			config: CryptoConfig{
+				CryptoConfigSets: []*CryptoConfigSet{
+					&CryptoConfigSet{
+						SetName:         "set",
+						Project:         "test",
+						ViolationPolicy: ViolationPolicyEvictPod,
+					},
+				},
+			},
+			name: "valid violationpolicy",
+			want: true,
+		},
+		{
+			config: CryptoConfig{
+				CryptoConfigSets: []*CryptoConfigSet{
+					&CryptoConfigSet{
+						SetName: "set",
+						Project: "test",
+						MKVPs:   []string{"0xb072bc5c245aac8a", "b072bc5c"},
+					},
+				},
+			},
+			name: "invalid mkvps",
+			want: false,
+		},
+		{
+			config: CryptoConfig{
+				CryptoConfigSets: []*CryptoConfigSet{
+					&CryptoConfigSet{
+						SetName: "set",
+						Project: "test",
+						MKVPs:   []string{"0xB072BC5C245AAC8A", "a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90"},
+					},
+				},
+			},
+			name: "valid mkvps",
+			want: true,
+		},
 		// everything should be fine...
 		{
 			config: CryptoConfig{
@@ -389,10 +538,208 @@ func TestCryptoConfigVerification(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		if got := test.config.Verify(); got != test.want {
-			t.Errorf(`CryptoConfig.Verify for "%s" returned %v`, test.name, got)
+		if errs := test.config.Verify(); (len(errs) == 0) != test.want {
+			t.Errorf(`CryptoConfig.Verify for "%s" returned %q`, test.name, errs)
+		}
+	}
+}
+
+func TestCryptoConfigVerificationErrors(t *testing.T) {
+	config := CryptoConfig{
+		CryptoConfigSets: []*CryptoConfigSet{
+			&CryptoConfigSet{
+				SetName:   "set1",
+				Project:   "",
+				CexMode:   "foo",
+				MinCexGen: "cex4",
+				APQNDefs: []APQNDef{
+					APQNDef{
+						Adapter: 1,
+						Domain:  256,
+					},
+					APQNDef{
+						Adapter: 2,
+						Domain:  2,
+					},
+				},
+			},
+			&CryptoConfigSet{
+				SetName: "set2",
+				Project: "test",
+				APQNDefs: []APQNDef{
+					APQNDef{
+						Adapter: 3,
+						Domain:  3,
+					},
+				},
+			},
+			&CryptoConfigSet{
+				SetName: "set3",
+				Project: "test",
+				APQNDefs: []APQNDef{
+					APQNDef{
+						Adapter: 2,
+						Domain:  2,
+					},
+				},
+			},
+		},
+	}
+	var want = []struct {
+		setname string
+		apqn    bool
+		field   string
+	}{
+		{"set1", false, "project"},
+		{"set1", false, "cexmode"},
+		{"set1", true, "apqns"},
+		{"set1", true, "apqns"},
+		{"set3", true, "apqns"},
+	}
+
+	errs := config.Verify()
+	if len(errs) != len(want) {
+		t.Fatalf(`CryptoConfig.Verify returned %d errors %q, expected %d`, len(errs), errs, len(want))
+	}
+	for i, w := range want {
+		if errs[i].SetName != w.setname || (errs[i].APQN != nil) != w.apqn || errs[i].Field != w.field {
+			t.Errorf(`CryptoConfig.Verify error %d is %q, expected set "%s" field "%s"`, i, errs[i], w.setname, w.field)
 		}
 	}
+	if n := len(errs.ForSet("set2")); n != 0 {
+		t.Errorf(`CryptoConfig.Verify returned %d errors for valid set "set2"`, n)
+	}
+}
+
+func TestCryptoConfigSetUnmarshal(t *testing.T) {
+	var tests = []struct {
+		json       string
+		name       string
+		fail       bool
+		overcommit int
+		livesysfs  int
+	}{
+		{
+			json:       `{"setname": "set", "project": "test"}`,
+			name:       "absent overcommit and livesysfs",
+			overcommit: -1,
+			livesysfs:  -1,
+		},
+		{
+			json:       `{"setname": "set", "project": "test", "overcommit": 0, "livesysfs": 0}`,
+			name:       "zero overcommit and livesysfs",
+			overcommit: 0,
+			livesysfs:  0,
+		},
+		{
+			json:       `{"setname": "set", "project": "test", "overcommit": 10, "livesysfs": 1}`,
+			name:       "given overcommit and livesysfs",
+			overcommit: 10,
+			livesysfs:  1,
+		},
+		{
+			json:       `{"setname": "set", "project": "test", "overcommit": 3}`,
+			name:       "only overcommit given",
+			overcommit: 3,
+			livesysfs:  -1,
+		},
+		{
+			json:       `{"setname": "set", "project": "test", "livesysfs": 0}`,
+			name:       "only livesysfs given",
+			overcommit: -1,
+			livesysfs:  0,
+		},
+		{
+			// negative values are kept and reported by Verify
+			json:       `{"setname": "set", "project": "test", "overcommit": -1}`,
+			name:       "negative overcommit",
+			overcommit: -1,
+			livesysfs:  -1,
+		},
+		{
+			json:       `{"setname": "set", "project": "test", "livesysfs": -3}`,
+			name:       "negative livesysfs",
+			overcommit: -1,
+			livesysfs:  -3,
+		},
+		{
+			json: `{"setname": "set", "project": "test", "overcommit": "many"}`,
+			name: "overcommit not a number",
+			fail: true,
+		},
+	}
+	for _, test := range tests {
+		var s CryptoConfigSet
+		err := json.Unmarshal([]byte(test.json), &s)
+		if test.fail {
+			if err == nil {
+				t.Errorf(`CryptoConfigSet.UnmarshalJSON for "%s" did not fail`, test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf(`CryptoConfigSet.UnmarshalJSON for "%s" failed: %s`, test.name, err)
+			continue
+		}
+		if s.SetName != "set" || s.Project != "test" {
+			t.Errorf(`CryptoConfigSet.UnmarshalJSON for "%s" returned wrong setname/project %q/%q`,
+				test.name, s.SetName, s.Project)
+		}
+		if s.Overcommit != test.overcommit {
+			t.Errorf(`CryptoConfigSet.UnmarshalJSON for "%s" returned overcommit %d, expected %d`,
+				test.name, s.Overcommit, test.overcommit)
+		}
+		if s.Livesysfs != test.livesysfs {
+			t.Errorf(`CryptoConfigSet.UnmarshalJSON for "%s" returned livesysfs %d, expected %d`,
+				test.name, s.Livesysfs, test.livesysfs)
+		}
+
+		// MarshalJSON emits overcommit and livesysfs only if given
+		data, err := json.Marshal(s)
+		if err != nil {
+			t.Errorf(`CryptoConfigSet.MarshalJSON for "%s" failed: %s`, test.name, err)
+			continue
+		}
+		var rt CryptoConfigSet
+		if err := json.Unmarshal(data, &rt); err != nil {
+			t.Errorf(`CryptoConfigSet unmarshal of %s for "%s" failed: %s`, data, test.name, err)
+			continue
+		}
+		if rt.Overcommit != s.Overcommit || rt.overcommitgiven != s.overcommitgiven ||
+			rt.Livesysfs != s.Livesysfs || rt.livesysfsgiven != s.livesysfsgiven {
+			t.Errorf(`CryptoConfigSet.MarshalJSON for "%s" returned %s, overcommit and livesysfs not kept`,
+				test.name, data)
+		}
+	}
+
+	// the fields also need to be parsed within a complete config
+	var cc CryptoConfig
+	data := `{"cryptoconfigsets": [{"setname": "set1", "project": "test", "overcommit": 5},
+		{"setname": "set2", "project": "test", "livesysfs": 0}]}`
+	if err := json.Unmarshal([]byte(data), &cc); err != nil {
+		t.Fatalf(`CryptoConfig unmarshal failed: %s`, err)
+	}
+	if len(cc.CryptoConfigSets) != 2 ||
+		cc.CryptoConfigSets[0].Overcommit != 5 || cc.CryptoConfigSets[0].Livesysfs != -1 ||
+		cc.CryptoConfigSets[1].Overcommit != -1 || cc.CryptoConfigSets[1].Livesysfs != 0 {
+		t.Errorf(`CryptoConfig unmarshal returned wrong sets %v`, cc)
+	}
+	if errs := cc.Verify(); len(errs) > 0 {
+		t.Errorf(`CryptoConfig.Verify for unmarshaled config returned %q`, errs)
+	}
+
+	// negative values are listed by Verify together with the other errors
+	data = `{"cryptoconfigsets": [{"setname": "set1", "project": "test", "overcommit": -2, "livesysfs": -1, "cexmode": "foo"}]}`
+	if err := json.Unmarshal([]byte(data), &cc); err != nil {
+		t.Fatalf(`CryptoConfig unmarshal with negative values failed: %s`, err)
+	}
+	var fields []string
+	for _, e := range cc.Verify() {
+		fields = append(fields, e.Field)
+	}
+	if !equalSliceContentNoOrder(fields, []string{"cexmode", "overcommit", "livesysfs"}) {
+		t.Errorf(`CryptoConfig.Verify for negative values reported fields %q`, fields)
+	}
 }
 
 func equalSliceContentNoOrder(a, b []string) bool {
@@ -626,3 +973,84 @@ func TestCryptoConfigSetForThisAPQN(t *testing.T) {
 		}
 	}
 }
+
+func TestCryptoConfigSetAllowsNamespace(t *testing.T) {
+	savedlookup := namespaceLabels
+	defer func() { namespaceLabels = savedlookup }()
+	namespaceLabels = func(namespace string) (map[string]string, error) {
+		switch namespace {
+		case "team-a":
+			return map[string]string{"team": "ep11"}, nil
+		case "team-b":
+			return map[string]string{"team": "cca"}, nil
+		}
+		return nil, fmt.Errorf("namespace '%s' not found", namespace)
+	}
+
+	set := &CryptoConfigSet{
+		SetName:  "set",
+		Project:  "p1",
+		Projects: []string{"p2", "p3"},
+		NsSelector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{"team": "ep11"},
+		},
+	}
+	var tests = []struct {
+		namespace string
+		want      bool
+		wanterr   bool
+	}{
+		{"p1", true, false},
+		{"p3", true, false},
+		{"team-a", true, false},
+		{"team-b", false, false},
+		{"unknown", false, true},
+	}
+	for _, test := range tests {
+		got, err := set.AllowsNamespace(test.namespace)
+		if got != test.want || (err != nil) != test.wanterr {
+			t.Errorf(`CryptoConfigSet.AllowsNamespace for "%s" returned %v, %v`, test.namespace, got, err)
+		}
+	}
+}
+
+func TestCryptoConfigUpdateRevert(t *testing.T) {
+	valid := `{"cryptoconfigsets":[{"setname":"set","project":"test","apqns":[{"adapter":1,"domain":5}]}]}`
+	invalid := `{"cryptoconfigsets":[{"setname":"set","project":"test"},{"setname":"set","project":"test"}]}`
+
+	savefile, savecc, savetag, saverejected := ccsfile, cc, tag, rejectedtag
+	defer func() {
+		ccsfile, cc, tag, rejectedtag = savefile, savecc, savetag, saverejected
+		MetricsCollConfigRejected(false)
+	}()
+	t.Setenv("POD_NAMESPACE", "")
+	ccsfile = filepath.Join(t.TempDir(), "cex_resources.json")
+	cc, tag, rejectedtag = nil, nil, nil
+
+	var steps = []struct {
+		name     string
+		config   string
+		rejected bool
+	}{
+		{"initial valid config", valid, false},
+		{"invalid revision", invalid, true},
+		{"invalid revision again", invalid, true},
+		{"revert to valid config", valid, false},
+	}
+	for _, step := range steps {
+		if err := os.WriteFile(ccsfile, []byte(step.config), 0644); err != nil {
+			t.Fatalf(`Can't write config file: %s`, err)
+		}
+		updateConfig()
+		mcmutex.Lock()
+		rejected := configrejected
+		mcmutex.Unlock()
+		if rejected != step.rejected || (rejectedtag != nil) != step.rejected {
+			t.Errorf(`After "%s" config rejected is %t (rejected tag %x), expected %t`,
+				step.name, rejected, rejectedtag, step.rejected)
+		}
+		if cc == nil || len(cc.CryptoConfigSets) != 1 {
+			t.Errorf(`After "%s" the valid config is not active`, step.name)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * authentication of the cex prometheus exporter fetching the metrics data
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// dir with tls.crt, tls.key and ca.crt of the pull mode https server,
+	// the exporter must present a client certificate signed by the ca.crt
+	pullTLSDir = getenvstr("PLUGIN_PULL_TLS_DIR", "")
+	// common name or dns name of the exporter client certificate
+	pullAllowedClient = getenvstr("PLUGIN_PULL_ALLOWED_CLIENT", "cex-prometheus-exporter")
+	// review the service account token sent by the exporter
+	pullTokenReview   = getenvint("PLUGIN_PULL_TOKEN_REVIEW", 0, 0, 1) > 0
+	pullTokenAudience = getenvstr("PLUGIN_PULL_TOKEN_AUDIENCE", "cex-device-plugin")
+	pullAllowedSA     = getenvstr("PLUGIN_PULL_ALLOWED_SERVICEACCOUNT", "system:serviceaccount:cex-device-plugin:cex-prometheus-exporter-sa")
+)
+
+// reviewTokenFunc is the token review function, tests may replace it
+var reviewTokenFunc = kubeReviewToken
+
+// pulltlsfiles_s loads the server certificate, key and the client ca
+// again when the files have been updated (like a rotated Secret)
+type pulltlsfiles_s struct {
+	mutex   sync.Mutex
+	dir     string
+	modtime time.Time
+	config  *tls.Config
+}
+
+func (tf *pulltlsfiles_s) load() (*tls.Config, error) {
+
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+
+	certfile, keyfile, cafile := tf.dir+"/tls.crt", tf.dir+"/tls.key", tf.dir+"/ca.crt"
+	var modtime time.Time
+	for _, f := range []string{certfile, keyfile, cafile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, fmt.Errorf("HttpAuth: Can't access TLS file: %w", err)
+		}
+		if fi.ModTime().After(modtime) {
+			modtime = fi.ModTime()
+		}
+	}
+	if tf.config != nil && modtime.Equal(tf.modtime) {
+		return tf.config, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return nil, fmt.Errorf("HttpAuth: Can't load server certificate: %w", err)
+	}
+	capem, err := os.ReadFile(cafile)
+	if err != nil {
+		return nil, fmt.Errorf("HttpAuth: Can't read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(capem) {
+		return nil, fmt.Errorf("HttpAuth: No certificate found in client CA file %s", cafile)
+	}
+	tf.config = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	tf.modtime = modtime
+	log.Printf("HttpAuth: TLS files loaded from %s\n", tf.dir)
+
+	return tf.config, nil
+}
+
+// pullTLSConfig returns the mTLS config of the pull mode https server,
+// the metrics data is never served via plain http
+func pullTLSConfig() (*tls.Config, error) {
+
+	if len(pullTLSDir) == 0 {
+		return nil, errors.New("HttpAuth: PLUGIN_PULL_TLS_DIR not set")
+	}
+	tf := &pulltlsfiles_s{dir: pullTLSDir}
+	if _, err := tf.load(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return tf.load()
+		},
+	}, nil
+}
+
+// pullAuthenticate checks the client certificate and, if enabled, the
+// service account token of a request for the metrics data. On failure
+// it returns the http status code and the reason.
+func pullAuthenticate(r *http.Request) (int, error) {
+
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return http.StatusUnauthorized, errors.New("client certificate required")
+	}
+	cert := r.TLS.PeerCertificates[0]
+	if cert.Subject.CommonName != pullAllowedClient && cert.VerifyHostname(pullAllowedClient) != nil {
+		return http.StatusForbidden, fmt.Errorf("client certificate '%s' not allowed", cert.Subject.CommonName)
+	}
+
+	if pullTokenReview {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || len(token) == 0 {
+			return http.StatusUnauthorized, errors.New("service account token required")
+		}
+		status, err := reviewTokenFunc(token, pullTokenAudience)
+		if err != nil {
+			log.Printf("%s\n", err)
+			return http.StatusServiceUnavailable, errors.New("token review failed")
+		}
+		if !status.Authenticated {
+			return http.StatusUnauthorized, fmt.Errorf("token not authenticated: %s", status.Error)
+		}
+		if status.User.Username != pullAllowedSA {
+			return http.StatusForbidden, fmt.Errorf("service account '%s' not allowed", status.User.Username)
+		}
+	}
+
+	return http.StatusOK, nil
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * authentication of the cex prometheus exporter fetching the metrics data
+ */
+
+// run with
+// $ go test -run HttpAuth
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authv1 "k8s.io/api/authentication/v1"
+)
+
+func TestHttpAuthPull(t *testing.T) {
+	savereview, savefunc := pullTokenReview, reviewTokenFunc
+	defer func() { pullTokenReview, reviewTokenFunc = savereview, savefunc }()
+
+	reviewTokenFunc = func(token, audience string) (*authv1.TokenReviewStatus, error) {
+		status := &authv1.TokenReviewStatus{}
+		if audience != pullTokenAudience {
+			return status, nil
+		}
+		switch token {
+		case "exporter":
+			status.Authenticated = true
+			status.User.Username = pullAllowedSA
+		case "othersa":
+			status.Authenticated = true
+			status.User.Username = "system:serviceaccount:default:default"
+		case "unavailable":
+			return nil, errors.New("KubeClient: TokenReview failed")
+		}
+		return status, nil
+	}
+
+	exporter := &x509.Certificate{Subject: pkix.Name{CommonName: pullAllowedClient}}
+	var tests = []struct {
+		cert   *x509.Certificate // nil if no client certificate is sent
+		review bool
+		token  string // empty if no token is sent
+		status int
+	}{
+		{exporter, false, "", http.StatusOK},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "client"}, DNSNames: []string{pullAllowedClient}}, false, "", http.StatusOK},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "worker-1"}}, false, "", http.StatusForbidden},
+		{nil, false, "", http.StatusUnauthorized},
+		{nil, true, "exporter", http.StatusUnauthorized},
+		{exporter, true, "exporter", http.StatusOK},
+		{exporter, true, "othersa", http.StatusForbidden},
+		{exporter, true, "invalid", http.StatusUnauthorized},
+		{exporter, true, "unavailable", http.StatusServiceUnavailable},
+		{exporter, true, "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		pullTokenReview = test.review
+		r := httptest.NewRequest(http.MethodGet, promExporterAPIPath, nil)
+		if test.cert != nil {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{test.cert}}
+		}
+		if len(test.token) > 0 {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		status, err := pullAuthenticate(r)
+		if status != test.status {
+			t.Errorf(`pullAuthenticate with certificate %v review %t token "%s" returned status %d (%v), expected %d`,
+				test.cert != nil, test.review, test.token, status, err, test.status)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * optional http servers for the node metrics, the pull mode metrics data
+ * and the debugging endpoints
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// each server is disabled with port 0 (default)
+var (
+	// node metrics for prometheus via plain http
+	pluginHttpPort = getenvint("PLUGIN_HTTP_PORT", 0, 0, 65535)
+	// metrics data for the pull mode of the cex prometheus exporter via mTLS
+	pluginPullPort = getenvint("PLUGIN_PULL_PORT", 0, 0, 65535)
+	// debugging endpoints, listening on localhost only
+	pluginDebugPort = getenvint("PLUGIN_DEBUG_PORT", 0, 0, 65535)
+)
+
+var httpservers []*http.Server
+
+func httpServerStart() {
+
+	if pluginHttpPort > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", pluginMetricsHandler())
+		httpServe(fmt.Sprintf(":%d", pluginHttpPort), mux, nil)
+	}
+	if pluginPullPort > 0 {
+		config, err := pullTLSConfig()
+		if err != nil {
+			log.Printf("HttpServer: Metrics data for the pull mode not served: %s\n", err)
+		} else {
+			mux := http.NewServeMux()
+			mux.HandleFunc(promExporterAPIPath, httpExporterData)
+			httpServe(fmt.Sprintf(":%d", pluginPullPort), mux, config)
+		}
+	}
+	if pluginDebugPort > 0 {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/apqns", httpDebugAPQNs)
+		mux.HandleFunc("/debug/containers", httpDebugContainers)
+		httpServe(fmt.Sprintf("127.0.0.1:%d", pluginDebugPort), mux, nil)
+	}
+}
+
+// httpServe runs a http server on addr, with https if a tls config is given
+func httpServe(addr string, handler http.Handler, config *tls.Config) {
+
+	li, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("HttpServer: Listen on %s failed: %s\n", addr, err)
+		return
+	}
+	if config != nil {
+		li = tls.NewListener(li, config)
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	httpservers = append(httpservers, srv)
+	go func() {
+		log.Printf("HttpServer: Listening on %s\n", addr)
+		err := srv.Serve(li)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("HttpServer: http server error: %s\n", err)
+		}
+	}()
+}
+
+func httpServerStop() {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, srv := range httpservers {
+		srv.Shutdown(ctx)
+	}
+	httpservers = nil
+}
+
+// httpDebugAPQNs returns the current AP bus snapshot as json
+func httpDebugAPQNs(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET supported", http.StatusMethodNotAllowed)
+		return
+	}
+	resp, err := json.MarshalIndent(apscanner.Snapshot(), "", "  ")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error encoding snapshot: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// httpExporterData returns the latest metrics data for the cex prometheus
+// exporter as json, the same data which is pushed in push mode. The exporter
+// fetches it from here in pull mode.
+func httpExporterData(w http.ResponseWriter, r *http.Request) {
+
+	if code, err := pullAuthenticate(r); err != nil {
+		log.Printf("HttpServer: Rejected metrics data request from %s: %s\n", r.RemoteAddr, err)
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET supported", http.StatusMethodNotAllowed)
+		return
+	}
+	data := MetricsCollLatestData()
+	if data == nil {
+		http.Error(w, "no metrics data available yet", http.StatusServiceUnavailable)
+		return
+	}
+	resp, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error encoding metrics data: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+type httpcontainer_s struct {
+	*PodListerContainer
+	APQNs APQNList `json:"apqns"`
+}
+
+// httpDebugContainers returns the containers with allocated plugin
+// devices together with the current state of their APQNs, like the
+// master keys. The list may be restricted with the namespace and pod
+// query parameters.
+func httpDebugContainers(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET supported", http.StatusMethodNotAllowed)
+		return
+	}
+	namespace := r.URL.Query().Get("namespace")
+	pod := r.URL.Query().Get("pod")
+
+	apqns := map[int]*APQN{}
+	for _, a := range apscanner.Snapshot().APQNs {
+		apqns[256*a.Adapter+a.Domain] = a
+	}
+	containers := []*httpcontainer_s{}
+	for _, c := range PodListerGetContainers() {
+		if (len(namespace) > 0 && c.Namespace != namespace) || (len(pod) > 0 && c.Pod != pod) {
+			continue
+		}
+		hc := &httpcontainer_s{PodListerContainer: c, APQNs: APQNList{}}
+		for _, id := range c.Devices {
+			var card, queue, overcount int
+			if n, _ := fmt.Sscanf(id, ApqnFmtStr, &card, &queue, &overcount); n < 2 {
+				continue
+			}
+			if a, found := apqns[256*card+queue]; found && !slices.Contains(hc.APQNs, a) {
+				hc.APQNs = append(hc.APQNs, a)
+			}
+		}
+		containers = append(containers, hc)
+	}
+	resp, err := json.MarshalIndent(containers, "", "  ")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error encoding containers: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
@@ -0,0 +1,265 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * kubernetes api client helper functions
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// namespace of the pod as provided by the service account
+	saNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+var (
+	kubeOnce      sync.Once
+	kubeConfig    *rest.Config
+	kubeConfigErr error
+
+	kubeRecorderOnce sync.Once
+	kubeRecorder     record.EventRecorder
+
+	nslabelscache = map[string]*nslabels_entry_s{}
+	nslabelsmutex sync.Mutex
+
+	tokenreviews      = map[string]*tokenreview_entry_s{}
+	tokenreviewsmutex sync.Mutex
+)
+
+// namespace labels are cached for this time
+const nsLabelsCacheTime = 60 * time.Second
+
+type nslabels_entry_s struct {
+	labels  map[string]string
+	fetched time.Time
+}
+
+// namespaceLabels is the namespace labels lookup function, tests may replace it
+var namespaceLabels = kubeNamespaceLabels
+
+// token reviews are cached for this time
+const tokenReviewCacheTime = 60 * time.Second
+
+type tokenreview_entry_s struct {
+	status  *authv1.TokenReviewStatus
+	fetched time.Time
+}
+
+func kubeGetConfig() (*rest.Config, error) {
+
+	kubeOnce.Do(func() {
+		// in-cluster config from the service account, a kubeconfig file as
+		// given via KUBECONFIG is only used when running outside a cluster
+		kubeConfig, kubeConfigErr = rest.InClusterConfig()
+		if kubeConfigErr != nil {
+			if kc, isset := os.LookupEnv("KUBECONFIG"); isset {
+				kubeConfig, kubeConfigErr = clientcmd.BuildConfigFromFlags("", kc)
+			}
+		}
+		if kubeConfigErr != nil {
+			log.Printf("KubeClient: Can't get kubernetes api config: %s\n", kubeConfigErr)
+			kubeConfigErr = fmt.Errorf("KubeClient: Can't get kubernetes api config: %w", kubeConfigErr)
+		}
+	})
+
+	return kubeConfig, kubeConfigErr
+}
+
+func kubeGetClientset() (*kubernetes.Clientset, error) {
+
+	config, err := kubeGetConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Printf("KubeClient: Can't create kubernetes clientset: %s\n", err)
+		return nil, fmt.Errorf("KubeClient: Can't create kubernetes clientset: %w", err)
+	}
+
+	return clientset, nil
+}
+
+func kubeGetDynamicClient() (dynamic.Interface, error) {
+
+	config, err := kubeGetConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		log.Printf("KubeClient: Can't create kubernetes dynamic client: %s\n", err)
+		return nil, fmt.Errorf("KubeClient: Can't create kubernetes dynamic client: %w", err)
+	}
+
+	return client, nil
+}
+
+// kubeNamespace returns the namespace this plugin instance runs in
+// or an empty string if unknown
+func kubeNamespace() string {
+
+	if ns, isset := os.LookupEnv("POD_NAMESPACE"); isset {
+		return ns
+	}
+	ns, err := os.ReadFile(saNamespaceFile)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(ns))
+}
+
+// kubeRecordEvent emits a kubernetes event for the referenced object.
+// Events are sent asynchronous and are best effort only, so there is
+// no error returned.
+func kubeRecordEvent(ref *corev1.ObjectReference, eventtype, reason, message string) {
+
+	kubeRecorderOnce.Do(func() {
+		clientset, err := kubeGetClientset()
+		if err != nil {
+			return
+		}
+		broadcaster := record.NewBroadcaster()
+		broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+		kubeRecorder = broadcaster.NewRecorder(scheme.Scheme,
+			corev1.EventSource{Component: "cex-plugin", Host: os.Getenv("NODENAME")})
+	})
+	if kubeRecorder == nil {
+		log.Printf("KubeClient: No event recorder available, event %s for %s '%s' dropped\n",
+			reason, ref.Kind, ref.Name)
+		return
+	}
+
+	kubeRecorder.Event(ref, eventtype, reason, message)
+}
+
+// kubeNamespaceLabels returns the labels of a namespace
+func kubeNamespaceLabels(namespace string) (map[string]string, error) {
+
+	nslabelsmutex.Lock()
+	e, found := nslabelscache[namespace]
+	nslabelsmutex.Unlock()
+	if found && time.Since(e.fetched) < nsLabelsCacheTime {
+		return e.labels, nil
+	}
+
+	// don't hold the lock across the api server request, concurrent
+	// lookups of the same namespace just fetch it twice
+	clientset, err := kubeGetClientset()
+	if err != nil {
+		return nil, err
+	}
+	ns, err := clientset.CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("KubeClient: Can't get namespace '%s': %w", namespace, err)
+	}
+	nslabelsmutex.Lock()
+	nslabelscache[namespace] = &nslabels_entry_s{
+		labels:  ns.Labels,
+		fetched: time.Now(),
+	}
+	nslabelsmutex.Unlock()
+
+	return ns.Labels, nil
+}
+
+// kubeEvictPod evicts a pod via the eviction API, so pod disruption
+// budgets are honored and the eviction may be refused
+func kubeEvictPod(namespace, name string) error {
+
+	clientset, err := kubeGetClientset()
+	if err != nil {
+		return err
+	}
+	eviction := &policyv1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	}
+	err = clientset.PolicyV1().Evictions(namespace).Evict(context.TODO(), eviction)
+	if err != nil {
+		return fmt.Errorf("KubeClient: Can't evict pod '%s/%s': %w", namespace, name, err)
+	}
+
+	return nil
+}
+
+// kubeReviewToken asks the kubernetes api server to review a service
+// account token issued for the audience, the results are cached for
+// tokenReviewCacheTime
+func kubeReviewToken(token, audience string) (*authv1.TokenReviewStatus, error) {
+
+	tokenreviewsmutex.Lock()
+	for t, e := range tokenreviews {
+		if time.Since(e.fetched) >= tokenReviewCacheTime {
+			delete(tokenreviews, t)
+		}
+	}
+	e, found := tokenreviews[token]
+	tokenreviewsmutex.Unlock()
+	if found {
+		return e.status, nil
+	}
+
+	// don't hold the lock across the api server request, concurrent
+	// requests with the same token just review it twice
+	clientset, err := kubeGetClientset()
+	if err != nil {
+		return nil, err
+	}
+	review := &authv1.TokenReview{
+		Spec: authv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: []string{audience},
+		},
+	}
+	review, err = clientset.AuthenticationV1().TokenReviews().Create(context.TODO(), review, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("KubeClient: TokenReview failed: %w", err)
+	}
+	tokenreviewsmutex.Lock()
+	tokenreviews[token] = &tokenreview_entry_s{
+		status:  &review.Status,
+		fetched: time.Now(),
+	}
+	tokenreviewsmutex.Unlock()
+
+	return &review.Status, nil
+}
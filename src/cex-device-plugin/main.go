@@ -65,6 +65,11 @@ func getenvint(envvar string, defaultval, minval, maxval int) int {
 
 func main() {
 
+	// cexctl subcommands like "validate" run instead of the plugin
+	if cmd, args, isctl := cexctlArgs(os.Args); isctl {
+		os.Exit(cexctlMain(cmd, args))
+	}
+
 	versionarg := flag.Bool("version", false, "Print version and exit")
 
 	// workaround for log: exiting because of error: log cannot create log: open ...
@@ -93,11 +98,16 @@ func main() {
 	log.Printf("Main: Machine id is '%s'\n", MachineId)
 
 	// initial list of the available apqns on this node or die
-	_, err = apScanAPQNs(true)
-	if err != nil {
+	apscanner = NewAPScanner()
+	if err = apscanner.Start(); err != nil {
 		log.Fatalf("Main: Initial scan of the available APQNs on this node failed: %s\n", err)
 	}
 
+	// watch the AP bus for changes, polling is the fallback
+	if err = apStartUeventWatcher(); err != nil {
+		log.Printf("Main: Falling back to polling the AP bus only\n")
+	}
+
 	// read the config file or die
 	cc, err := InitializeConfigWatcher()
 	if err != nil {
@@ -108,7 +118,8 @@ func main() {
 	}
 	log.Printf("Main: Crypto configuration successful read\n")
 	cc.PrettyLog()
-	if !cc.Verify() {
+	if errs := cc.Verify(); len(errs) > 0 {
+		errs.Log()
 		log.Fatalf("Main: Crypto configuration verification failed.\n")
 	}
 
@@ -134,9 +145,15 @@ func main() {
 		log.Fatalf("Main: MetricsCollector Start failed: %s\n", err)
 	}
 
+	// start the optional http server
+	httpServerStart()
+
 	// enter the crypto resources plugins loop
 	RunZCryptoResPlugins()
 
+	// stop the http server
+	httpServerStop()
+
 	// stop metrics collector
 	mc.Stop()
 
@@ -146,5 +163,11 @@ func main() {
 	// stop the config watcher
 	StopConfigWatcher()
 
+	// stop the AP bus watcher
+	apStopUeventWatcher()
+
+	// stop the AP bus scanner
+	apscanner.Stop()
+
 	log.Println("Main: S390 k8s z crypto resources plugin terminating")
 }
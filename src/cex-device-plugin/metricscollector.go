@@ -25,11 +25,15 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
-	"net"
+	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -40,7 +44,12 @@ var (
 	promExporterCollService   = getenvstr("CEX_PROM_EXPORTER_COLLECTOR_SERVICE", "cex-prometheus-exporter-collector-service")
 	promExporterCollNamespace = getenvstr("CEX_PROM_EXPORTER_COLLECTOR_SERVICE_NAMESPACE", "")
 	promExporterCollPort      = getenvint("CEX_PROM_EXPORTER_COLLECTOR_SERVICE_PORT", 12358, 0, 65535)
-	conTCPTimeout             = 5 * time.Second // connect, read and write timeout for the TCP connection
+	promExporterPush          = getenvint("CEX_PROM_EXPORTER_PUSH", 1, 0, 1) > 0 // disabled if only the node metrics are used
+	promExporterTimeout       = 5 * time.Second                                  // timeout for a push to the exporter
+	// dir with tls.crt, tls.key and ca.crt for the mTLS push, plain http if empty
+	promExporterTLSDir = getenvstr("CEX_PROM_EXPORTER_TLS_DIR", "")
+	// file with a service account token sent with each push, none if empty
+	promExporterTokenFile = getenvstr("CEX_PROM_EXPORTER_TOKEN_FILE", "")
 )
 
 type plugindev_entry_s struct {
@@ -54,10 +63,30 @@ type apqn_entry_s struct {
 type cset_entry_s struct {
 	plugindevs map[string]*plugindev_entry_s
 	apqns      map[int]*apqn_entry_s // int key here holds dom and ap: dom = key % 256, ap = key / 256
+	filtered   map[string]int        // nr of APQNs not announced per reason (like "cexmode")
+	unhealthy  map[string]int        // nr of announced but unhealthy APQNs per reason (like "checkstopped")
+}
+
+// per container entry, the containers are taken from the PodLister
+type container_entry_s struct {
+	namespace       string
+	pod             string
+	container       string
+	setname         string
+	apqns           []int   // APQNs of the plugin devices, key holds dom and ap like with cset_entry_s
+	request_counter float64 // requests attributed to this container since first seen
+	queue_depth     int     // pending and queued requests on the APQNs of this container
+	load            int     // sum of the load of the APQNs of this container
+	shared          bool    // APQNs shared with other containers, the request counter is estimated
+	latency         float64 // estimated request latency in seconds, 0 if no requests in the last interval
 }
 
 var csetmap = map[string]*cset_entry_s{}
+var containermap = map[string]*container_entry_s{} // key is "namespace/pod/container"
+var queuestats = map[int]*apqstats_s{}             // last queue statistics of the APQNs in use
 var mcmutex = sync.Mutex{}
+var configrejected bool   // latest crypto config revision failed verification
+var lastpedata *pe_data_s // latest data prepared for the exporter, served for the pull mode
 
 func dumpRawMetricsData() {
 
@@ -73,6 +102,13 @@ func dumpRawMetricsData() {
 			fmt.Printf("      APQN(%d,%d): start count: %d current count: %d\n",
 				k/256, k%256, ae.start_request_count, ae.current_request_count)
 		}
+		fmt.Printf("    filtered apqns: %v\n", cse.filtered)
+		fmt.Printf("    unhealthy apqns: %v\n", cse.unhealthy)
+	}
+	fmt.Printf("MetricsColl: %d container entries:\n", len(containermap))
+	for key, ce := range containermap {
+		fmt.Printf("  '%s': setname '%s' requests %.1f queue depth %d load %d shared %t latency %.3fs\n",
+			key, ce.setname, ce.request_counter, ce.queue_depth, ce.load, ce.shared, ce.latency)
 	}
 }
 
@@ -168,6 +204,37 @@ func MetricsCollAPQNs(setname string, apqns APQNList) {
 			ae.start_request_count, _ = apGetQueueRequestCounter(k/256, k%256)
 		}
 	}
+	// 3. count the unhealthy APQNs per reason
+	cse.unhealthy = map[string]int{}
+	for _, a := range apqns {
+		if !a.Healthy {
+			cse.unhealthy[a.Reason]++
+		}
+	}
+
+	//dumpRawMetricsData()
+}
+
+func MetricsCollFilteredAPQNs(setname string, filtered map[string]int) {
+
+	mcmutex.Lock()
+	defer mcmutex.Unlock()
+
+	// search for an existing entry for this config set, maybe add a new one
+	cse, found := csetmap[setname]
+	if !found {
+		// alloc a new config set entry
+		csetmap[setname] = &cset_entry_s{
+			plugindevs: make(map[string]*plugindev_entry_s),
+			apqns:      make(map[int]*apqn_entry_s),
+		}
+		cse = csetmap[setname]
+	}
+
+	cse.filtered = make(map[string]int, len(filtered))
+	for reason, n := range filtered {
+		cse.filtered[reason] = n
+	}
 
 	//dumpRawMetricsData()
 }
@@ -214,6 +281,14 @@ func MetricsCollPluginDevs(setname string, devs []string) {
 	//dumpRawMetricsData()
 }
 
+func MetricsCollConfigRejected(rejected bool) {
+
+	mcmutex.Lock()
+	defer mcmutex.Unlock()
+
+	configrejected = rejected
+}
+
 func MetricsCollNotifyAboutRunningContainer(setname, dev string) {
 
 	log.Printf("MetricsColl: Container Running notify, setname=%s dev=%s\n", setname, dev)
@@ -244,9 +319,16 @@ func MetricsCollNotifyAboutRunningContainer(setname, dev string) {
 	//dumpRawMetricsData()
 }
 
+// the versioned path of the metrics push api of the exporter
+const promExporterAPIPath = "/v1/metrics"
+
 type MetricsCollector struct {
-	stopChan chan struct{}
-	nodename string
+	stopChan   chan struct{}
+	nodename   string
+	client     *http.Client
+	tlsclient  *http.Client // mTLS client, rebuilt when the TLS files change
+	tlsmodtime time.Time
+	accounted  time.Time // time of the last container accounting
 }
 
 func NewMetricsCollector() *MetricsCollector {
@@ -260,6 +342,7 @@ func NewMetricsCollector() *MetricsCollector {
 	return &MetricsCollector{
 		stopChan: make(chan struct{}),
 		nodename: nn,
+		client:   &http.Client{Timeout: promExporterTimeout},
 	}
 }
 
@@ -300,15 +383,33 @@ type cset_pe_data_s struct {
 	Total_plugindevs int
 	Used_plugindevs  int
 	Request_counter  int
+	Filtered_apqns   map[string]int `json:",omitempty"`
+	Unhealthy_apqns  map[string]int `json:",omitempty"`
+}
+
+// per container struct for the data sent to cex prometheus exporter collector
+type container_pe_data_s struct {
+	Namespace       string
+	Pod             string
+	Container       string
+	Setname         string
+	Request_counter float64
+	Queue_depth     int
+	Load            int
+	Shared          bool    `json:",omitempty"`
+	Latency         float64 `json:",omitempty"`
 }
 
 // per cex plugin app struct for the data sent to cex prometheus exporter collector
 type pe_data_s struct {
 	Nodename         string
+	Timestamp        time.Time // time the data has been prepared
 	Total_plugindevs int
 	Used_plugindevs  int
 	Request_counter  int
+	Config_rejected  bool `json:",omitempty"`
 	Csets            []*cset_pe_data_s
+	Containers       []*container_pe_data_s `json:",omitempty"`
 }
 
 func (mc *MetricsCollector) doLoop() {
@@ -336,16 +437,32 @@ func (mc *MetricsCollector) doLoop() {
 		}
 	}
 
+	// attribute the requests to the containers
+	mc.accountContainers()
+
 	//dumpRawMetricsData()
 
 	// accumulate the raw metrics into the send data struct
 	senddata := mc.prepPromExpData()
+	lastpedata = senddata
 
 	// unlock the raw data metrics lock
 	mcmutex.Unlock()
 
 	// send the prepared data to the cex prometheus exporter
-	mc.sendDataToPromExp(senddata)
+	if promExporterPush {
+		mc.sendDataToPromExp(senddata)
+	}
+}
+
+// MetricsCollLatestData returns the latest data prepared for the cex
+// prometheus exporter or nil if there is none yet
+func MetricsCollLatestData() *pe_data_s {
+
+	mcmutex.Lock()
+	defer mcmutex.Unlock()
+
+	return lastpedata
 }
 
 func (mc *MetricsCollector) prepPromExpData() *pe_data_s {
@@ -354,7 +471,9 @@ func (mc *MetricsCollector) prepPromExpData() *pe_data_s {
 	// struct, the mcmutex is locked by the caller
 
 	pe_data := &pe_data_s{
-		Nodename: mc.nodename,
+		Nodename:        mc.nodename,
+		Timestamp:       time.Now(),
+		Config_rejected: configrejected,
 	}
 	var cset_pe_data []*cset_pe_data_s
 	for sn, cse := range csetmap {
@@ -372,13 +491,202 @@ func (mc *MetricsCollector) prepPromExpData() *pe_data_s {
 			cspe.Request_counter += ae.current_request_count - ae.start_request_count
 			pe_data.Request_counter += cspe.Request_counter
 		}
+		if len(cse.filtered) > 0 {
+			cspe.Filtered_apqns = make(map[string]int, len(cse.filtered))
+			for reason, n := range cse.filtered {
+				cspe.Filtered_apqns[reason] = n
+			}
+		}
+		if len(cse.unhealthy) > 0 {
+			cspe.Unhealthy_apqns = make(map[string]int, len(cse.unhealthy))
+			for reason, n := range cse.unhealthy {
+				cspe.Unhealthy_apqns[reason] = n
+			}
+		}
 		cset_pe_data = append(cset_pe_data, cspe)
 	}
 	pe_data.Csets = cset_pe_data
+	for _, ce := range containermap {
+		pe_data.Containers = append(pe_data.Containers, &container_pe_data_s{
+			Namespace:       ce.namespace,
+			Pod:             ce.pod,
+			Container:       ce.container,
+			Setname:         ce.setname,
+			Request_counter: ce.request_counter,
+			Queue_depth:     ce.queue_depth,
+			Load:            ce.load,
+			Shared:          ce.shared,
+			Latency:         ce.latency,
+		})
+	}
 
 	return pe_data
 }
 
+// accountContainers attributes the requests processed by the APQNs to the
+// containers using them. The zcrypt device nodes have no request counter,
+// so the request_count delta of an APQN shared by several containers
+// (overcommit) is split evenly between them. The request latency is not
+// exposed either, it is estimated from the queue depth and the request
+// rate of the interval (Little's law). The mcmutex is locked by the
+// caller.
+func (mc *MetricsCollector) accountContainers() {
+
+	// 1. update the container entries with the ones seen by the PodLister
+	current := map[string]bool{}
+	for _, c := range PodListerGetContainers() {
+		key := c.Namespace + "/" + c.Pod + "/" + c.Container
+		current[key] = true
+		ce, found := containermap[key]
+		if !found {
+			ce = &container_entry_s{
+				namespace: c.Namespace,
+				pod:       c.Pod,
+				container: c.Container,
+			}
+			containermap[key] = ce
+		}
+		ce.setname = c.SetName
+		ce.apqns = ce.apqns[:0]
+		for _, dev := range c.Devices {
+			var ap, dom, overcount int
+			if n, _ := fmt.Sscanf(dev, ApqnFmtStr, &ap, &dom, &overcount); n < 3 {
+				continue
+			}
+			if k := 256*ap + dom; !slices.Contains(ce.apqns, k) {
+				ce.apqns = append(ce.apqns, k)
+			}
+		}
+	}
+	for key := range containermap {
+		if !current[key] {
+			delete(containermap, key)
+		}
+	}
+
+	// 2. fetch the statistics and the request count deltas of the APQNs in use
+	users := map[int]int{}
+	for _, ce := range containermap {
+		for _, k := range ce.apqns {
+			users[k]++
+		}
+	}
+	deltas := map[int]int{}
+	for k := range users {
+		qs, err := apGetQueueStats(k/256, k%256)
+		if err != nil {
+			delete(queuestats, k)
+			continue
+		}
+		// a lower count means the queue has been reset, start over
+		if last, found := queuestats[k]; found && qs.request_count >= last.request_count {
+			deltas[k] = qs.request_count - last.request_count
+		}
+		queuestats[k] = qs
+	}
+	for k := range queuestats {
+		if users[k] == 0 {
+			delete(queuestats, k)
+		}
+	}
+
+	// 3. attribute the deltas and sum up the queue depth and load
+	now := time.Now()
+	interval := now.Sub(mc.accounted).Seconds()
+	if mc.accounted.IsZero() {
+		interval = 0
+	}
+	mc.accounted = now
+	for _, ce := range containermap {
+		ce.queue_depth, ce.load, ce.shared = 0, 0, false
+		for _, k := range ce.apqns {
+			if qs, found := queuestats[k]; found {
+				ce.queue_depth += qs.pendingq_count + qs.requestq_count
+				ce.load += qs.load
+			}
+			if users[k] > 1 {
+				ce.shared = true
+			}
+		}
+		delta := 0.0
+		for _, k := range ce.apqns {
+			delta += float64(deltas[k]) / float64(users[k])
+		}
+		ce.request_counter += delta
+		// latency = queue depth / request rate
+		ce.latency = 0
+		if delta > 0 && interval > 0 {
+			ce.latency = float64(ce.queue_depth) * interval / delta
+		}
+	}
+}
+
+// getTLSClient returns the http client for the mTLS push. The client
+// certificate, key and the CA to verify the exporter are loaded again
+// when the files have been updated (like a rotated Secret). A Secret
+// mounted on all nodes may provide the certificate of each node as
+// <nodename>.crt and <nodename>.key, else tls.crt and tls.key are used.
+func (mc *MetricsCollector) getTLSClient() (*http.Client, error) {
+
+	certfile := promExporterTLSDir + "/" + mc.nodename + ".crt"
+	keyfile := promExporterTLSDir + "/" + mc.nodename + ".key"
+	if _, err := os.Stat(certfile); err != nil {
+		certfile = promExporterTLSDir + "/tls.crt"
+		keyfile = promExporterTLSDir + "/tls.key"
+	}
+	cafile := promExporterTLSDir + "/ca.crt"
+
+	var modtime time.Time
+	for _, f := range []string{certfile, keyfile, cafile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, fmt.Errorf("MetricsColl: Can't access TLS file: %w", err)
+		}
+		if fi.ModTime().After(modtime) {
+			modtime = fi.ModTime()
+		}
+	}
+	if mc.tlsclient != nil && modtime.Equal(mc.tlsmodtime) {
+		return mc.tlsclient, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return nil, fmt.Errorf("MetricsColl: Can't load client certificate: %w", err)
+	}
+	capem, err := os.ReadFile(cafile)
+	if err != nil {
+		return nil, fmt.Errorf("MetricsColl: Can't read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(capem) {
+		return nil, fmt.Errorf("MetricsColl: No certificate found in CA file %s", cafile)
+	}
+	if mc.tlsclient != nil {
+		mc.tlsclient.CloseIdleConnections()
+	}
+	mc.tlsclient = &http.Client{
+		Timeout: promExporterTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{cert},
+				RootCAs:      pool,
+			},
+		},
+	}
+	mc.tlsmodtime = modtime
+	log.Printf("MetricsColl: TLS files loaded from %s\n", promExporterTLSDir)
+
+	return mc.tlsclient, nil
+}
+
+// reply of the cex prometheus exporter collector to a push
+type pe_reply_s struct {
+	Status string // "ok" or "error"
+	Error  string
+}
+
 func (mc *MetricsCollector) sendDataToPromExp(senddata *pe_data_s) bool {
 
 	var addr string
@@ -394,44 +702,52 @@ func (mc *MetricsCollector) sendDataToPromExp(senddata *pe_data_s) bool {
 	//s := string(data)
 	//fmt.Printf("MetricsColl: marshalled data: '%v'\n", s)
 
-	// TCP connect to exporter
 	if len(promExporterCollNamespace) > 0 {
 		addr = fmt.Sprintf("%s.%s:%d", promExporterCollService,
 			promExporterCollNamespace, promExporterCollPort)
 	} else {
 		addr = fmt.Sprintf("%s:%d", promExporterCollService, promExporterCollPort)
 	}
-	con, err := net.DialTimeout("tcp", addr, conTCPTimeout)
-	if err != nil {
-		log.Printf("MetricsColl: Connection to '%s' failed: %s\n", addr, err)
-		return false
+	scheme, client := "http", mc.client
+	if len(promExporterTLSDir) > 0 {
+		if client, err = mc.getTLSClient(); err != nil {
+			log.Printf("%s\n", err)
+			return false
+		}
+		scheme = "https"
 	}
-	defer con.Close()
+	url := scheme + "://" + addr + promExporterAPIPath
 
-	// send the json data
-	con.SetWriteDeadline(time.Now().Add(conTCPTimeout))
-	_, err = con.Write(data)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
 	if err != nil {
-		log.Printf("MetricsColl: Connection write error: %v\n", err)
+		log.Printf("MetricsColl: Can't create push request for '%s': %s\n", url, err)
 		return false
 	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(promExporterTokenFile) > 0 {
+		// projected tokens are rotated by the kubelet, so read it each time
+		token, err := os.ReadFile(promExporterTokenFile)
+		if err != nil {
+			log.Printf("MetricsColl: Can't read token file: %s\n", err)
+			return false
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
 
-	// receive ack or or error string
-	buf := make([]byte, 1024)
-	con.SetReadDeadline(time.Now().Add(conTCPTimeout))
-	_, err = con.Read(buf)
+	// push the json data and check the reply
+	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("MetricsColl: Connection read error: %v\n", err)
+		log.Printf("MetricsColl: Push to '%s' failed: %s\n", url, err)
 		return false
 	}
-	i := bytes.IndexByte(buf, 0x0a)
-	if i < 1 {
-		log.Printf("MetricsColl: Connection received invalid reply\n")
+	defer resp.Body.Close()
+	var reply pe_reply_s
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&reply); err != nil {
+		log.Printf("MetricsColl: Push to '%s' received invalid reply (%s): %s\n", url, resp.Status, err)
 		return false
 	}
-	str := strings.TrimSpace(string(buf[:i]))
-	if str != "ok" {
-		log.Printf("MetricsColl: Connection received invalid reply '%s'\n", str)
+	if resp.StatusCode != http.StatusOK || reply.Status != "ok" {
+		log.Printf("MetricsColl: Push to '%s' rejected (%s): %s\n", url, resp.Status, reply.Error)
 		return false
 	}
 
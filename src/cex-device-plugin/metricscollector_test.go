@@ -0,0 +1,306 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * per container accounting and push of the metrics collector
+ */
+
+// run with
+// $ go test -run MetricsColl
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMetricsCollAccountContainers(t *testing.T) {
+	saveapdir := apsysfsdevsdir
+	defer func() {
+		apsysfsdevsdir = saveapdir
+		plcontainers = nil
+		containermap = map[string]*container_entry_s{}
+		queuestats = map[int]*apqstats_s{}
+	}()
+	apsysfsdevsdir = t.TempDir()
+
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8C", 1, 1, true)
+	apTestSysfsQueue(t, apsysfsdevsdir, "CEX8C", 1, 2, true)
+	writeattrs := func(attrs map[string]string) {
+		for f, v := range attrs {
+			if err := os.WriteFile(f, []byte(v+"\n"), 0644); err != nil {
+				t.Fatalf(`Writing fake sysfs attribute %s failed: %s`, f, err)
+			}
+		}
+	}
+
+	// containers a and b share APQN (1,1), c has APQN (1,2) for its own
+	plcontainers = []*PodListerContainer{
+		{Namespace: "ns1", Pod: "p1", Container: "a", SetName: "set1", ZCryptNode: "zcrypt-apqn-1-1-0", Devices: []string{"apqn-1-1-0"}},
+		{Namespace: "ns1", Pod: "p2", Container: "b", SetName: "set1", ZCryptNode: "zcrypt-apqn-1-1-1", Devices: []string{"apqn-1-1-1"}},
+		{Namespace: "ns2", Pod: "p3", Container: "c", SetName: "set2", ZCryptNode: "zcrypt-apqn-1-2-0", Devices: []string{"apqn-1-2-0"}},
+	}
+	mc := &MetricsCollector{}
+
+	writeattrs(map[string]string{
+		filepath.Join(apsysfsdevsdir, "card01/01.0001/request_count"): "100",
+		filepath.Join(apsysfsdevsdir, "card01/01.0002/request_count"): "50",
+	})
+	mc.accountContainers()
+	// pretend the first accounting was 10s ago
+	mc.accounted = mc.accounted.Add(-10 * time.Second)
+	writeattrs(map[string]string{
+		filepath.Join(apsysfsdevsdir, "card01/01.0001/request_count"):  "140",
+		filepath.Join(apsysfsdevsdir, "card01/01.0001/pendingq_count"): "2",
+		filepath.Join(apsysfsdevsdir, "card01/01.0001/requestq_count"): "1",
+		filepath.Join(apsysfsdevsdir, "card01/01.0002/request_count"):  "80",
+	})
+	mc.accountContainers()
+
+	var tests = []struct {
+		key      string
+		requests float64
+		depth    int
+		shared   bool
+		latency  float64
+	}{
+		{"ns1/p1/a", 20, 3, true, 1.5},
+		{"ns1/p2/b", 20, 3, true, 1.5},
+		{"ns2/p3/c", 30, 0, false, 0},
+	}
+	if len(containermap) != len(tests) {
+		t.Fatalf(`accountContainers has %d container entries, expected %d`, len(containermap), len(tests))
+	}
+	for _, test := range tests {
+		ce, found := containermap[test.key]
+		if !found {
+			t.Errorf(`accountContainers has no entry for container "%s"`, test.key)
+			continue
+		}
+		if ce.request_counter != test.requests || ce.queue_depth != test.depth || ce.shared != test.shared {
+			t.Errorf(`Container "%s" has requests %.1f depth %d shared %t, expected %.1f %d %t`,
+				test.key, ce.request_counter, ce.queue_depth, ce.shared, test.requests, test.depth, test.shared)
+		}
+		// queue depth by request rate, 3 requests queued at 2 per second give 1.5s
+		if math.Abs(ce.latency-test.latency) > 0.01 {
+			t.Errorf(`Container "%s" has latency %.3fs, expected %.3fs`, test.key, ce.latency, test.latency)
+		}
+	}
+
+	// vanished containers are dropped
+	plcontainers = plcontainers[:1]
+	mc.accountContainers()
+	if len(containermap) != 1 || len(queuestats) != 1 {
+		t.Errorf(`accountContainers kept %d container entries and %d queue stats, expected 1 and 1`,
+			len(containermap), len(queuestats))
+	}
+}
+
+func TestMetricsCollPush(t *testing.T) {
+	var received *pe_data_s
+	var tests = []struct {
+		name  string
+		code  int
+		reply string
+		want  bool
+	}{
+		{"accepted", http.StatusOK, `{"Status":"ok"}`, true},
+		{"rejected", http.StatusBadRequest, `{"Status":"error","Error":"metrics data without Nodename"}`, false},
+		{"invalid reply", http.StatusOK, "ok\n", false},
+	}
+	for _, test := range tests {
+		received = nil
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.URL.Path != promExporterAPIPath ||
+				r.Header.Get("Content-Type") != "application/json" {
+				t.Errorf(`Push for "%s" sent %s %s with content type "%s"`,
+					test.name, r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+			}
+			received = &pe_data_s{}
+			if err := json.NewDecoder(r.Body).Decode(received); err != nil {
+				t.Errorf(`Push for "%s" sent invalid json: %s`, test.name, err)
+			}
+			w.WriteHeader(test.code)
+			w.Write([]byte(test.reply))
+		}))
+		host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+		savehost, saveport := promExporterCollService, promExporterCollPort
+		promExporterCollService = host
+		promExporterCollPort, _ = strconv.Atoi(port)
+
+		mc := &MetricsCollector{nodename: "worker-1", client: srv.Client()}
+		got := mc.sendDataToPromExp(&pe_data_s{Nodename: "worker-1", Total_plugindevs: 3})
+
+		promExporterCollService, promExporterCollPort = savehost, saveport
+		srv.Close()
+
+		if got != test.want {
+			t.Errorf(`sendDataToPromExp for "%s" returned %t, expected %t`, test.name, got, test.want)
+		}
+		if received == nil || received.Nodename != "worker-1" || received.Total_plugindevs != 3 {
+			t.Errorf(`Push for "%s" delivered %+v`, test.name, received)
+		}
+	}
+}
+
+func TestMetricsCollPushTLS(t *testing.T) {
+	// self signed client certificate for the node, acts as its own CA
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "worker-1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf(`Can't create client certificate: %s`, err)
+	}
+	clientcert, _ := x509.ParseCertificate(der)
+	keyder, _ := x509.MarshalECPrivateKey(key)
+
+	var cn, auth string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			cn = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+		auth = r.Header.Get("Authorization")
+		w.Write([]byte(`{"Status":"ok"}`))
+	}))
+	clientcas := x509.NewCertPool()
+	clientcas.AddCert(clientcert)
+	srv.TLS = &tls.Config{ClientCAs: clientcas, ClientAuth: tls.RequireAndVerifyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"worker-1.crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		"worker-1.key": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder}),
+		"ca.crt":       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}),
+		"token":        []byte("secret-token\n"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatalf(`Can't write %s: %s`, name, err)
+		}
+	}
+
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	savehost, saveport := promExporterCollService, promExporterCollPort
+	savetlsdir, savetokenfile := promExporterTLSDir, promExporterTokenFile
+	promExporterCollService = host
+	promExporterCollPort, _ = strconv.Atoi(port)
+	promExporterTLSDir = dir
+	promExporterTokenFile = filepath.Join(dir, "token")
+	defer func() {
+		promExporterCollService, promExporterCollPort = savehost, saveport
+		promExporterTLSDir, promExporterTokenFile = savetlsdir, savetokenfile
+	}()
+
+	mc := &MetricsCollector{nodename: "worker-1", client: &http.Client{}}
+	if !mc.sendDataToPromExp(&pe_data_s{Nodename: "worker-1"}) {
+		t.Errorf(`sendDataToPromExp via mTLS failed`)
+	}
+	if cn != "worker-1" {
+		t.Errorf(`Push via mTLS presented client certificate "%s", expected "worker-1"`, cn)
+	}
+	if auth != "Bearer secret-token" {
+		t.Errorf(`Push via mTLS sent Authorization "%s", expected "Bearer secret-token"`, auth)
+	}
+
+	// the certificate of another node is not used
+	other := &MetricsCollector{nodename: "worker-2", client: &http.Client{}}
+	if other.sendDataToPromExp(&pe_data_s{Nodename: "worker-2"}) {
+		t.Errorf(`sendDataToPromExp via mTLS succeeded without the certificate of the node`)
+	}
+
+	// without a certificate of its own, a node uses the shared tls.crt
+	os.WriteFile(filepath.Join(dir, "tls.crt"), files["worker-1.crt"], 0600)
+	os.WriteFile(filepath.Join(dir, "tls.key"), files["worker-1.key"], 0600)
+	cn = ""
+	if !other.sendDataToPromExp(&pe_data_s{Nodename: "worker-2"}) {
+		t.Errorf(`sendDataToPromExp via mTLS failed with the shared certificate`)
+	}
+	if cn != "worker-1" {
+		t.Errorf(`Push via mTLS presented client certificate "%s", expected the shared one`, cn)
+	}
+}
+
+func TestMetricsCollLatestData(t *testing.T) {
+	savedata := lastpedata
+	defer func() { lastpedata = savedata }()
+
+	// requests from the exporter, authenticated via its client certificate
+	fetch := func(method string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, promExporterAPIPath, nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+			{Subject: pkix.Name{CommonName: pullAllowedClient}},
+		}}
+		rec := httptest.NewRecorder()
+		httpExporterData(rec, r)
+		return rec
+	}
+
+	lastpedata = nil
+	rec := fetch(http.MethodGet)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf(`Fetch without metrics data returned %d, expected %d`, rec.Code, http.StatusServiceUnavailable)
+	}
+
+	prepared := time.Now().Add(-time.Minute).Truncate(time.Second)
+	lastpedata = &pe_data_s{Nodename: "worker-1", Timestamp: prepared, Total_plugindevs: 3}
+	rec = fetch(http.MethodGet)
+	got := &pe_data_s{}
+	if err := json.NewDecoder(rec.Body).Decode(got); err != nil || rec.Code != http.StatusOK {
+		t.Errorf(`Fetch returned %d with invalid json: %v`, rec.Code, err)
+	}
+	if got.Nodename != "worker-1" || !got.Timestamp.Equal(prepared) || got.Total_plugindevs != 3 {
+		t.Errorf(`Fetch delivered %+v`, got)
+	}
+
+	rec = fetch(http.MethodPost)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf(`POST returned %d, expected %d`, rec.Code, http.StatusMethodNotAllowed)
+	}
+
+	// without a client certificate the data is not served
+	rec = httptest.NewRecorder()
+	httpExporterData(rec, httptest.NewRequest(http.MethodGet, promExporterAPIPath, nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf(`Fetch without client certificate returned %d, expected %d`, rec.Code, http.StatusUnauthorized)
+	}
+}
@@ -22,9 +22,11 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"log"
+	"slices"
 	"sort"
 	"sync"
 	"time"
@@ -89,7 +91,10 @@ func (z *ZCryptoDPMLister) Discover(nameslistchan chan dpm.PluginNameList) {
 	log.Printf("Plugin: Register plugins for these CryptoConfigSets: %v\n", z.setnameslist)
 	nameslistchan <- dpm.PluginNameList(z.setnameslist)
 
-	// every Cccheckinterval seconds check if the list of setnames has changed
+	// check if the list of setnames has changed on each crypto config
+	// change notification and as fallback every Cccheckinterval seconds
+	ccchanged := CryptoConfigSubscribe()
+	defer CryptoConfigUnsubscribe(ccchanged)
 	tick := time.NewTicker(Cccheckinterval * time.Second)
 	defer tick.Stop()
 	for {
@@ -100,15 +105,16 @@ func (z *ZCryptoDPMLister) Discover(nameslistchan chan dpm.PluginNameList) {
 			if t.IsZero() {
 				return
 			}
-			sets = GetCurrentCryptoConfig().GetListOfSetNames()
-			sort.Strings(sets)
-			if !areTheseSortedStringListsEqual(sets, z.setnameslist) {
-				z.setnameslist = sets
-				log.Printf("Plugin: Found crypto config set changes. Reannouncing: %v\n", z.setnameslist)
-				nameslistchan <- dpm.PluginNameList(z.setnameslist)
-			} else if len(z.setnameslist) == 0 {
-				log.Printf("Plugin: No crypto config sets available, check configuration !\n")
-			}
+		case <-ccchanged:
+		}
+		sets = GetCurrentCryptoConfig().GetListOfSetNames()
+		sort.Strings(sets)
+		if !areTheseSortedStringListsEqual(sets, z.setnameslist) {
+			z.setnameslist = sets
+			log.Printf("Plugin: Found crypto config set changes. Reannouncing: %v\n", z.setnameslist)
+			nameslistchan <- dpm.PluginNameList(z.setnameslist)
+		} else if len(z.setnameslist) == 0 {
+			log.Printf("Plugin: No crypto config sets available, check configuration !\n")
 		}
 	}
 }
@@ -118,6 +124,7 @@ func (z *ZCryptoDPMLister) NewPlugin(resource string) dpm.PluginInterface {
 	log.Printf("Plugin: NewPlugin('%s')\n", resource)
 
 	ccset, tag := GetCurrentCryptoConfigSet(nil, resource, nil)
+	adjustConfigSet(ccset)
 
 	p := &ZCryptoResPlugin{
 		lister:   z,
@@ -129,10 +136,41 @@ func (z *ZCryptoDPMLister) NewPlugin(resource string) dpm.PluginInterface {
 	return p
 }
 
+func adjustConfigSet(ccset *CryptoConfigSet) {
+
+	if ccset == nil {
+		return
+	}
+	if ccset.Overcommit < 0 {
+		// no overcommit parameter given in this config set, so use default
+		ccset.Overcommit = apqnOverCommitLimit
+	}
+	if ccset.Livesysfs < 0 {
+		// no livesysfs parameter given in this config set, so use default
+		ccset.Livesysfs = apqnLiveSysfs
+	}
+}
+
 func (p *ZCryptoResPlugin) filterAPQNs(ccset *CryptoConfigSet, apqnlist APQNList) APQNList {
+
+	apqns, filtered := filterAPQNsForSet(p.resource, p.lister.machineid, ccset, apqnlist)
+	if ccset != nil {
+		MetricsCollFilteredAPQNs(p.resource, filtered)
+	}
+
+	return apqns
+}
+
+// filterAPQNsForSet returns the APQNs out of apqnlist to be announced for
+// the config set on a machine with the given machine id and the number of
+// APQNs not announced per reason (like "cexmode").
+func filterAPQNsForSet(resource, machineid string, ccset *CryptoConfigSet, apqnlist APQNList) (APQNList, map[string]int) {
 	var apqns APQNList
+	// number of APQNs not announced per reason
+	filtered := map[string]int{}
+
 	if ccset == nil {
-		return apqns
+		return apqns, filtered
 	}
 
 	for _, a := range apqnlist {
@@ -140,19 +178,38 @@ func (p *ZCryptoResPlugin) filterAPQNs(ccset *CryptoConfigSet, apqnlist APQNList
 			if a.Adapter != c.Adapter || a.Domain != c.Domain {
 				continue
 			}
-			if len(c.MachineId) > 0 && p.lister.machineid != c.MachineId {
+			if len(c.MachineId) > 0 && machineid != c.MachineId {
 				continue
 			}
 			if len(ccset.MinCexGen) > 0 && a.Gen < ccset.MinCexGen {
 				log.Printf("Plugin['%s']: APQN (%d,%d) not announced. Card generation = %s, but %s or higher required for this config set\n",
-					p.resource, a.Adapter, a.Domain, a.Gen, ccset.MinCexGen)
+					resource, a.Adapter, a.Domain, a.Gen, ccset.MinCexGen)
+				filtered["mincexgen"]++
+				continue
+			}
+			if len(ccset.CexMode) > 0 && a.Mode != ccset.CexMode {
+				log.Printf("Plugin['%s']: APQN (%d,%d) not announced. Card mode = %s, but %s required for this config set\n",
+					resource, a.Adapter, a.Domain, a.Mode, ccset.CexMode)
+				filtered["cexmode"]++
+				continue
+			}
+			if ccset.SecureExecution && !a.SEUsable() {
+				log.Printf("Plugin['%s']: APQN (%d,%d) not announced. Secure Execution bind state = '%s', associate state = '%s', but bound required for this config set\n",
+					resource, a.Adapter, a.Domain, a.SEBind, a.SEAssociate)
+				filtered["secureexecution"]++
+				continue
+			}
+			if len(ccset.MKVPs) > 0 && !a.HasCurrentMKVP(ccset.MKVPs) {
+				log.Printf("Plugin['%s']: APQN (%d,%d) not announced. Current master keys %v, but one of %v required for this config set\n",
+					resource, a.Adapter, a.Domain, a.CurrentMKVPs(), ccset.MKVPs)
+				filtered["mkvps"]++
 				continue
 			}
 			apqns = append(apqns, a)
 		}
 	}
 
-	return apqns
+	return apqns, filtered
 }
 
 func (p *ZCryptoResPlugin) makePluginDevsFromAPQNs() []*kdp.Device {
@@ -166,7 +223,13 @@ func (p *ZCryptoResPlugin) makePluginDevsFromAPQNs() []*kdp.Device {
 
 	for _, a := range p.apqns {
 		health := kdp.Healthy
-		if !a.Online {
+		if !a.Healthy {
+			reason := a.Reason
+			if rc := apQueueLastErrRC(a.Adapter, a.Domain); len(rc) > 0 && rc != "0" {
+				reason += " (last_err_rc " + rc + ")"
+			}
+			log.Printf("Plugin['%s']: APQN (%d,%d) is unhealthy: %s\n",
+				p.resource, a.Adapter, a.Domain, reason)
 			health = kdp.Unhealthy
 		}
 		for i := 0; i < max(1, p.ccset.Overcommit); i++ {
@@ -187,11 +250,7 @@ func (p *ZCryptoResPlugin) checkChanged() bool {
 	var apqnsChanged, configChanged bool
 	ccset, tag := GetCurrentCryptoConfigSet(p.ccset, p.resource, p.tag) // caution: ccset may be nil
 
-	allnodeapqns, err := apScanAPQNs(false)
-	if err != nil {
-		log.Printf("Plugin['%s']: failure trying to rescan node APQNs: %s\n", p.resource, err)
-		return false
-	}
+	allnodeapqns := apscanner.Snapshot().APQNs
 
 	// check for change in APQNs
 	apqns := p.filterAPQNs(ccset, allnodeapqns)
@@ -202,16 +261,7 @@ func (p *ZCryptoResPlugin) checkChanged() bool {
 	}
 
 	// adjust the ConfigSet before comparing
-	if ccset != nil {
-		if ccset.Overcommit < 0 {
-			// no overcommit parameter given in this config set, so use default
-			ccset.Overcommit = apqnOverCommitLimit
-		}
-		if ccset.Livesysfs < 0 {
-			// no livesysfs parameter given in this config set, so use default
-			ccset.Livesysfs = apqnLiveSysfs
-		}
-	}
+	adjustConfigSet(ccset)
 
 	// check for overcommit change in ConfigSet
 	if ccset != nil && (p.ccset == nil || ccset.Overcommit != p.ccset.Overcommit) {
@@ -225,8 +275,13 @@ func (p *ZCryptoResPlugin) checkChanged() bool {
 		configChanged = true
 	}
 
-	if apqnsChanged || configChanged {
+	// always adopt a new config revision, a change in for example the
+	// ioctls of this set does not touch the devices but the next Allocate()
+	if !bytes.Equal(tag, p.tag) {
 		p.ccset, p.tag = ccset, tag
+	}
+
+	if apqnsChanged || configChanged {
 		p.apqns = apqns
 		p.tellMetricsCollAboutAPQNs()
 		p.devices = p.makePluginDevsFromAPQNs()
@@ -240,23 +295,21 @@ func (p *ZCryptoResPlugin) checkChanged() bool {
 	}
 }
 
-func (p *ZCryptoResPlugin) checkChangedLoop() {
-
-	tick := time.NewTicker(apqnsCheckInterval * time.Second)
-
-	// add one user (the for loop we will run into now) to the wait group
-	p.wgChChan.Add(1)
+func (p *ZCryptoResPlugin) checkChangedLoop(ccchanged chan struct{}, apchanged chan *APDiff) {
 
 ForLoop:
 	for {
 		select {
 		case <-p.stopChan:
-			tick.Stop()
+			CryptoConfigUnsubscribe(ccchanged)
+			apscanner.Unsubscribe(apchanged)
 			break ForLoop
-		case <-tick.C:
-			if p.checkChanged() {
-				p.changedChan <- struct{}{}
-			}
+		case <-ccchanged:
+		case diff := <-apchanged:
+			log.Printf("Plugin['%s']: AP bus changed, %s\n", p.resource, diff)
+		}
+		if p.checkChanged() {
+			p.changedChan <- struct{}{}
 		}
 	}
 
@@ -268,12 +321,13 @@ func (p *ZCryptoResPlugin) Start() error {
 
 	log.Printf("Plugin['%s']: Start()\n", p.resource)
 
-	allnodeapqns, err := apScanAPQNs(false)
-	if err != nil {
-		log.Printf("Plugin['%s']: failure trying to scan node APQNs: %s\n", p.resource, err)
-		return fmt.Errorf("Plugin['%s']: fatal failure at start", p.resource)
-	}
+	// subscribe before taking the snapshot, so no change gets lost in between
+	ccchanged := CryptoConfigSubscribe()
+	apchanged := apscanner.Subscribe()
 
+	p.ccset, p.tag = GetCurrentCryptoConfigSet(p.ccset, p.resource, p.tag)
+	adjustConfigSet(p.ccset)
+	allnodeapqns := apscanner.Snapshot().APQNs
 	p.apqns = p.filterAPQNs(p.ccset, allnodeapqns)
 	log.Printf("Plugin['%s']: Found %d eligible APQNs: %s\n", p.resource, len(p.apqns), p.apqns)
 	p.tellMetricsCollAboutAPQNs()
@@ -286,7 +340,9 @@ func (p *ZCryptoResPlugin) Start() error {
 	p.stopChan = make(chan struct{})
 	p.changedChan = make(chan struct{})
 
-	go p.checkChangedLoop()
+	// add one user (the check changed loop) to the wait group
+	p.wgChChan.Add(1)
+	go p.checkChangedLoop(ccchanged, apchanged)
 
 	return nil
 }
@@ -300,6 +356,7 @@ func (p *ZCryptoResPlugin) Stop() error {
 	p.tellMetricsCollAboutAPQNs()
 	p.devices = nil
 	p.tellMetricsCollAboutPluginDevs()
+	MetricsCollFilteredAPQNs(p.resource, nil)
 
 	// close the stop channel and thus trigger listener of this channel to stop their work
 	close(p.stopChan)
@@ -315,7 +372,10 @@ func (p *ZCryptoResPlugin) GetDevicePluginOptions(context.Context, *kdp.Empty) (
 
 	log.Printf("Plugin['%s']: GetDevicePluginOptions()\n", p.resource)
 
-	return &kdp.DevicePluginOptions{PreStartRequired: false}, nil
+	return &kdp.DevicePluginOptions{
+		PreStartRequired:                false,
+		GetPreferredAllocationAvailable: true,
+	}, nil
 }
 
 func (p *ZCryptoResPlugin) ListAndWatch(e *kdp.Empty, s kdp.DevicePlugin_ListAndWatchServer) error {
@@ -342,9 +402,122 @@ func (p *ZCryptoResPlugin) ListAndWatch(e *kdp.Empty, s kdp.DevicePlugin_ListAnd
 func (p *ZCryptoResPlugin) GetPreferredAllocation(ctx context.Context,
 	req *kdp.PreferredAllocationRequest) (*kdp.PreferredAllocationResponse, error) {
 
-	//log.Printf("Plugin['%s']: GetPreferredAllocation()\n", p.resource)
+	log.Printf("Plugin['%s']: GetPreferredAllocation(request=%v)\n", p.resource, req)
+
+	// the allocation policy is taken from the current config set
+	policy := AllocPolicySpread
+	ccset, _ := GetCurrentCryptoConfigSet(p.ccset, p.resource, p.tag)
+	if ccset != nil && len(ccset.AllocPolicy) > 0 {
+		policy = ccset.AllocPolicy
+	}
+
+	// plugin devices currently in use are the ones the pod lister has seen
+	// plus all plugin devices of this plugin which kubelet does not offer
+	allocated := PodListerGetAllocatedDevs()
+
+	rsp := new(kdp.PreferredAllocationResponse)
+	for _, careq := range req.GetContainerRequests() {
+		available := careq.GetAvailableDeviceIDs()
+		isAvailable := make(map[string]bool, len(available))
+		for _, id := range available {
+			isAvailable[id] = true
+		}
+		var inuse []string
+		for _, dev := range p.devices {
+			if allocated[dev.ID] || (dev.Health == kdp.Healthy && !isAvailable[dev.ID]) {
+				inuse = append(inuse, dev.ID)
+			}
+		}
+		ids, err := allocPreferredDevs(policy, available, careq.GetMustIncludeDeviceIDs(),
+			int(careq.GetAllocationSize()), inuse, p.apqns)
+		if err != nil {
+			log.Printf("Plugin['%s']: GetPreferredAllocation() failed: %s\n", p.resource, err)
+			return nil, err
+		}
+		rsp.ContainerResponses = append(rsp.ContainerResponses,
+			&kdp.ContainerPreferredAllocationResponse{DeviceIDs: ids})
+	}
+
+	log.Printf("Plugin['%s']: GetPreferredAllocation() policy '%s' response=%v\n", p.resource, policy, rsp)
+
+	return rsp, nil
+}
+
+// all plugin devices allocated by one container share one zcrypt device
+// node and one shadow sysfs, both named after the first (sorted) device id
+func nodeIdForDevs(ids []string) string {
+
+	if len(ids) == 0 {
+		return ""
+	}
+	nodeid := ids[0]
+	for _, id := range ids[1:] {
+		if id < nodeid {
+			nodeid = id
+		}
+	}
+
+	return nodeid
+}
+
+// apqnsForDevs returns the APQNs, adapters and domains the zcrypt node for
+// the device ids grants access to. The zcrypt node grants access to all
+// combinations of its adapters and domains, so each of them needs to be an
+// APQN of the device ids. Otherwise the container would get access to APQNs
+// which may be allocated to other containers. The kubelet may ignore the
+// preferred allocation, device ids not covering such a product are rejected.
+func (p *ZCryptoResPlugin) apqnsForDevs(ids []string) (APQNList, []int, []int, error) {
+
+	var apqns APQNList
+	var adapters, domains []int
+
+	find := func(card, queue int) *APQN {
+		for _, a := range p.apqns {
+			if a.Adapter == card && a.Domain == queue {
+				return a
+			}
+		}
+		return nil
+	}
 
-	return nil, nil
+	// the APQNs of the device ids, key is (256 * adapter) + domain
+	allocated := map[int]bool{}
+	for _, id := range ids {
+		// parse device id
+		d, err := parseAllocDev(id)
+		if err != nil {
+			log.Printf("Plugin['%s']: Error parsing device id '%s'\n", p.resource, id)
+			return nil, nil, nil, err
+		}
+		allocated[256*d.adapter+d.domain] = true
+		if !slices.Contains(adapters, d.adapter) {
+			adapters = append(adapters, d.adapter)
+		}
+		if !slices.Contains(domains, d.domain) {
+			domains = append(domains, d.domain)
+		}
+	}
+	sort.Ints(adapters)
+	sort.Ints(domains)
+
+	for _, card := range adapters {
+		for _, queue := range domains {
+			if !allocated[256*card+queue] {
+				log.Printf("Plugin['%s']: APQN(%d,%d) is not allocated, but the zcrypt node for device ids %v would grant access to it\n",
+					p.resource, card, queue, ids)
+				return nil, nil, nil, fmt.Errorf("Device ids %v of set '%s' do not cover all their adapter and domain combinations, APQN(%d,%d) is missing",
+					ids, p.resource, card, queue)
+			}
+			a := find(card, queue)
+			if a == nil {
+				log.Printf("Plugin['%s']: APQN(%d,%d) of device ids %v is not part of this set\n", p.resource, card, queue, ids)
+				return nil, nil, nil, fmt.Errorf("APQN(%d,%d) of device ids %v is not part of set '%s'", card, queue, ids, p.resource)
+			}
+			apqns = append(apqns, a)
+		}
+	}
+
+	return apqns, adapters, domains, nil
 }
 
 func (p *ZCryptoResPlugin) Allocate(ctx context.Context, req *kdp.AllocateRequest) (*kdp.AllocateResponse, error) {
@@ -355,60 +528,68 @@ func (p *ZCryptoResPlugin) Allocate(ctx context.Context, req *kdp.AllocateReques
 	for _, careq := range req.GetContainerRequests() {
 		//fmt.Printf("debug Plugin['%s']: Allocate(): Container allocrequest=%v\n", p.resource, careq)
 		carsp := kdp.ContainerAllocateResponse{}
-		for _, id := range careq.GetDevicesIDs() {
-			// parse device id
-			//fmt.Printf("debug Plugin['%s']: Allocate(): Container request for device ID %v\n", p.resource, id)
-			var card, queue, overcount int
-			n, err := fmt.Sscanf(id, ApqnFmtStr, &card, &queue, &overcount)
-			if err != nil || n < 3 {
-				log.Printf("Plugin['%s']: Error parsing device id '%s'\n", p.resource, id)
-				return nil, fmt.Errorf("Error parsing device id '%s'", id)
-			}
-			// check and maybe create a zcrypt device node
-			znode := fmt.Sprintf("zcrypt-"+ApqnFmtStr, card, queue, overcount)
-			if !zcryptNodeExists(znode) {
-				log.Printf("Plugin['%s']: creating zcrypt device node '%s'\n", p.resource, znode)
-				err = zcryptCreateSimpleNode(znode, card, queue)
-				if err != nil {
-					log.Printf("Plugin['%s']: Error creating zcrypt node '%s': %s\n", p.resource, znode, err)
-					defer zcryptDestroyNode(znode)
-					return nil, fmt.Errorf("Error creating zcrypt node '%s'", znode)
-				}
-			} else {
-				//fmt.Printf("debug Plugin['%s']: zcrypt device node '%s' already exists\n", p.resource, znode)
-			}
-			// map the zcrypt device node to /dev/z90crypt inside the container
-			dev := new(kdp.DeviceSpec)
-			dev.HostPath = "/dev/" + znode
-			dev.ContainerPath = "/dev/z90crypt"
-			dev.Permissions = "rw"
-			carsp.Devices = append(carsp.Devices, dev)
-			// create AP bus and devices shadow sysfs for this container and mount them into the container
-			apbusdir, apdevsdir, err := makeShadowApSysfs(id, p.ccset.Livesysfs, card, queue)
+		ids := careq.GetDevicesIDs()
+		if len(ids) == 0 {
+			rsp.ContainerResponses = append(rsp.ContainerResponses, &carsp)
+			continue
+		}
+		// collect the APQNs, adapters and domains for all requested device ids
+		apqns, adapters, domains, err := p.apqnsForDevs(ids)
+		if err != nil {
+			return nil, err
+		}
+		nodeid := nodeIdForDevs(ids)
+		// the ioctls allowed for this config set, empty means all
+		ioctls := p.ccset.IoctlNumbers()
+		// check and maybe (re)create a zcrypt device node
+		znode := "zcrypt-" + nodeid
+		if zcryptNodeExists(znode) && !zcryptNodeMatches(znode, adapters, domains, ioctls) {
+			log.Printf("Plugin['%s']: destroying stale zcrypt device node '%s'\n", p.resource, znode)
+			zcryptDestroyNode(znode)
+		}
+		if !zcryptNodeExists(znode) {
+			log.Printf("Plugin['%s']: creating zcrypt device node '%s'\n", p.resource, znode)
+			err = zcryptCreateSimpleNode(znode, adapters, domains, ioctls)
 			if err != nil {
-				log.Printf("Plugin['%s']: Error creating shadow sysfs for device '%s': %s\n", p.resource, id, err)
+				log.Printf("Plugin['%s']: Error creating zcrypt node '%s': %s\n", p.resource, znode, err)
 				defer zcryptDestroyNode(znode)
-				return nil, fmt.Errorf("Error creating shadow sysfs for device '%s'", id)
+				return nil, fmt.Errorf("Error creating zcrypt node '%s'", znode)
 			}
-			carsp.Mounts = append(carsp.Mounts, &kdp.Mount{
-				ContainerPath: "/sys/bus/ap",
-				HostPath:      apbusdir,
-				ReadOnly:      true})
-			carsp.Mounts = append(carsp.Mounts, &kdp.Mount{
-				ContainerPath: "/sys/devices/ap",
-				HostPath:      apdevsdir,
-				ReadOnly:      true})
-			if p.ccset.Livesysfs > 0 {
-				err = addLiveMounts(id, &carsp, card, queue)
-				if err != nil {
-					log.Printf("Plugin['%s']: Error adding live mounts for device '%s': %s\n", p.resource, id, err)
-					defer zcryptDestroyNode(znode)
-					return nil, fmt.Errorf("Error adding live mounts for device '%s'", id)
-				}
+		} else {
+			//fmt.Printf("debug Plugin['%s']: zcrypt device node '%s' already exists\n", p.resource, znode)
+		}
+		// map the zcrypt device node to /dev/z90crypt inside the container
+		dev := new(kdp.DeviceSpec)
+		dev.HostPath = "/dev/" + znode
+		dev.ContainerPath = "/dev/z90crypt"
+		dev.Permissions = "rw"
+		carsp.Devices = append(carsp.Devices, dev)
+		// create AP bus and devices shadow sysfs for this container and mount them into the container
+		apbusdir, apdevsdir, err := makeShadowApSysfs(nodeid, p.ccset.Livesysfs, apqns)
+		if err != nil {
+			log.Printf("Plugin['%s']: Error creating shadow sysfs for device '%s': %s\n", p.resource, nodeid, err)
+			defer zcryptDestroyNode(znode)
+			return nil, fmt.Errorf("Error creating shadow sysfs for device '%s'", nodeid)
+		}
+		carsp.Mounts = append(carsp.Mounts, &kdp.Mount{
+			ContainerPath: "/sys/bus/ap",
+			HostPath:      apbusdir,
+			ReadOnly:      true})
+		carsp.Mounts = append(carsp.Mounts, &kdp.Mount{
+			ContainerPath: "/sys/devices/ap",
+			HostPath:      apdevsdir,
+			ReadOnly:      true})
+		if p.ccset.Livesysfs > 0 {
+			err = addLiveMounts(nodeid, &carsp, apqns)
+			if err != nil {
+				log.Printf("Plugin['%s']: Error adding live mounts for device '%s': %s\n", p.resource, nodeid, err)
+				defer zcryptDestroyNode(znode)
+				return nil, fmt.Errorf("Error adding live mounts for device '%s'", nodeid)
 			}
+		}
+		for _, id := range ids {
 			p.tellMetricsCollAboutAlloc(id)
-			// only one device per container supported
-			break
+			PodListerNotifyAboutAlloc(id)
 		}
 		rsp.ContainerResponses = append(rsp.ContainerResponses, &carsp)
 	}
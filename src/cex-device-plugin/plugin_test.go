@@ -0,0 +1,323 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * plugin functions
+ */
+
+// run with
+// $ go test -run 'Filter|APQNsForDevs|AllocateIoctls'
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+
+	kdp "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestFilterAPQNsForSet(t *testing.T) {
+	apqns := APQNList{
+		&APQN{Adapter: 1, Domain: 1, Gen: "cex8", Mode: "ep11", SEBind: "bound", SEAssociate: "associated 1"},
+		&APQN{Adapter: 1, Domain: 2, Gen: "cex8", Mode: "ep11", SEBind: "unbound", SEAssociate: "unassociated"},
+		&APQN{Adapter: 2, Domain: 1, Gen: "cex6", Mode: "ep11"},
+		&APQN{Adapter: 3, Domain: 1, Gen: "cex8", Mode: "cca",
+			MKVPs: []MKVP{{Register: "AES CUR", State: "valid", VP: "0xb072bc5c245aac8a"}}},
+	}
+	defs := []APQNDef{
+		APQNDef{Adapter: 1, Domain: 1},
+		APQNDef{Adapter: 1, Domain: 2},
+		APQNDef{Adapter: 2, Domain: 1},
+		APQNDef{Adapter: 3, Domain: 1},
+	}
+
+	var tests = []struct {
+		name     string
+		ccset    *CryptoConfigSet
+		want     int
+		filtered map[string]int
+	}{
+		{
+			name:     "no restrictions",
+			ccset:    &CryptoConfigSet{APQNDefs: defs},
+			want:     4,
+			filtered: map[string]int{},
+		},
+		{
+			name:     "cexmode and mincexgen",
+			ccset:    &CryptoConfigSet{CexMode: "ep11", MinCexGen: "cex7", APQNDefs: defs},
+			want:     2,
+			filtered: map[string]int{"cexmode": 1, "mincexgen": 1},
+		},
+		{
+			name:     "secure execution",
+			ccset:    &CryptoConfigSet{SecureExecution: true, APQNDefs: defs},
+			want:     1,
+			filtered: map[string]int{"secureexecution": 3},
+		},
+		{
+			name:     "mkvps",
+			ccset:    &CryptoConfigSet{MKVPs: []string{"B072BC5C245AAC8A"}, APQNDefs: defs},
+			want:     1,
+			filtered: map[string]int{"mkvps": 3},
+		},
+		{
+			name:     "nil set",
+			ccset:    nil,
+			want:     0,
+			filtered: map[string]int{},
+		},
+	}
+	for _, test := range tests {
+		got, filtered := filterAPQNsForSet("test", "", test.ccset, apqns)
+		if len(got) != test.want {
+			t.Errorf(`filterAPQNsForSet for "%s" returned %d APQNs: %s`, test.name, len(got), got)
+		}
+		if len(filtered) != len(test.filtered) {
+			t.Errorf(`filterAPQNsForSet for "%s" returned filtered %v, expected %v`, test.name, filtered, test.filtered)
+			continue
+		}
+		for reason, n := range test.filtered {
+			if filtered[reason] != n {
+				t.Errorf(`filterAPQNsForSet for "%s" returned filtered %v, expected %v`, test.name, filtered, test.filtered)
+			}
+		}
+	}
+}
+
+func TestAPQNsForDevs(t *testing.T) {
+	var tests = []struct {
+		name     string
+		ids      []string
+		set      [][2]int // APQNs of the config set
+		adapters []int    // nil if an error is expected
+		domains  []int
+	}{
+		{
+			name:     "full product",
+			ids:      []string{"apqn-1-1-0", "apqn-1-2-0", "apqn-2-1-0", "apqn-2-2-0"},
+			set:      [][2]int{{1, 1}, {1, 2}, {2, 1}, {2, 2}},
+			adapters: []int{1, 2},
+			domains:  []int{1, 2},
+		},
+		{
+			name:     "overcommitted APQN",
+			ids:      []string{"apqn-1-1-0", "apqn-1-1-1"},
+			set:      [][2]int{{1, 1}},
+			adapters: []int{1},
+			domains:  []int{1},
+		},
+		{
+			name:     "same domain on two adapters",
+			ids:      []string{"apqn-1-5-0", "apqn-2-5-0"},
+			set:      [][2]int{{1, 5}, {1, 6}, {2, 5}, {2, 6}},
+			adapters: []int{1, 2},
+			domains:  []int{5},
+		},
+		{
+			name: "one combination missing",
+			ids:  []string{"apqn-1-1-0", "apqn-1-2-0", "apqn-2-1-0"},
+			set:  [][2]int{{1, 1}, {1, 2}, {2, 1}},
+		},
+		{
+			name: "diagonal",
+			ids:  []string{"apqn-1-1-0", "apqn-2-2-0"},
+			set:  [][2]int{{1, 1}, {2, 2}},
+		},
+		{
+			// the node would grant (1,6) and (2,5) which are in the set,
+			// but may be allocated to other containers
+			name: "diagonal with all combinations in the set",
+			ids:  []string{"apqn-1-5-0", "apqn-2-6-0"},
+			set:  [][2]int{{1, 5}, {1, 6}, {2, 5}, {2, 6}},
+		},
+		{
+			name: "not in the set",
+			ids:  []string{"apqn-3-3-0"},
+			set:  [][2]int{{1, 1}},
+		},
+		{
+			name: "invalid device id",
+			ids:  []string{"foo"},
+			set:  [][2]int{{1, 1}},
+		},
+	}
+	for _, test := range tests {
+		p := &ZCryptoResPlugin{resource: test.name}
+		for _, a := range test.set {
+			p.apqns = append(p.apqns, &APQN{Adapter: a[0], Domain: a[1]})
+		}
+		apqns, adapters, domains, err := p.apqnsForDevs(test.ids)
+		if test.adapters == nil {
+			if err == nil {
+				t.Errorf(`apqnsForDevs for "%s" did not fail`, test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf(`apqnsForDevs for "%s" failed: %s`, test.name, err)
+			continue
+		}
+		if !slices.Equal(adapters, test.adapters) || !slices.Equal(domains, test.domains) ||
+			len(apqns) != len(adapters)*len(domains) {
+			t.Errorf(`apqnsForDevs for "%s" returned %d APQNs of adapters %v domains %v, expected adapters %v domains %v`,
+				test.name, len(apqns), adapters, domains, test.adapters, test.domains)
+		}
+	}
+}
+
+// allocTestFakeZcrypt sets up a fake zcrypt class dir, virtual zcrypt dir
+// and /dev dir. A goroutine plays the kernel: for each node name written
+// to the create fifo it adds the node dir with empty mask files and the
+// device node file. The returned function stops the goroutine.
+func allocTestFakeZcrypt(t *testing.T, dir string) func() {
+	zcryptclassdir = filepath.Join(dir, "class")
+	zcryptvdevdir = filepath.Join(dir, "virtual")
+	zcryptdevdir = filepath.Join(dir, "dev")
+	for _, d := range []string{zcryptclassdir, zcryptvdevdir, zcryptdevdir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatalf(`Can't create dir: %s`, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(zcryptclassdir, "destroy"), nil, 0644); err != nil {
+		t.Fatalf(`Can't write file: %s`, err)
+	}
+	createfifo := filepath.Join(zcryptclassdir, "create")
+	if err := syscall.Mkfifo(createfifo, 0644); err != nil {
+		t.Fatalf(`Can't create fifo: %s`, err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			data, err := os.ReadFile(createfifo)
+			name := strings.TrimSpace(string(data))
+			if err != nil || name == "" {
+				return
+			}
+			nodedir := filepath.Join(zcryptvdevdir, name)
+			os.MkdirAll(nodedir, 0755)
+			for _, f := range []string{"apmask", "aqmask", "ioctlmask"} {
+				os.WriteFile(filepath.Join(nodedir, f), nil, 0644)
+			}
+			os.WriteFile(filepath.Join(zcryptdevdir, name), nil, 0644)
+		}
+	}()
+
+	return func() {
+		os.WriteFile(createfifo, nil, 0)
+		<-done
+	}
+}
+
+// allocTestFakeSysfs sets up a fake AP bus sysfs with the given APQNs
+func allocTestFakeSysfs(t *testing.T, dir string, apqns APQNList) {
+	apbusdir = filepath.Join(dir, "bus")
+	apdevsdir = filepath.Join(dir, "devices")
+	shadowbasedir = filepath.Join(dir, "shadow")
+	files := map[string]string{}
+	for _, f := range sys_bus_ap_copyfiles {
+		files[filepath.Join(apbusdir, f)] = "0\n"
+	}
+	for _, a := range apqns {
+		carddir := filepath.Join(apdevsdir, fmt.Sprintf("card%02x", a.Adapter))
+		for _, f := range sys_devices_ap_card_copyfiles {
+			files[filepath.Join(carddir, f)] = "0\n"
+		}
+		for _, f := range sys_devices_ap_queue_copyfiles {
+			files[filepath.Join(carddir, fmt.Sprintf("%02x.%04x", a.Adapter, a.Domain), f)] = "0\n"
+		}
+	}
+	if err := os.MkdirAll(shadowbasedir, 0755); err != nil {
+		t.Fatalf(`Can't create dir: %s`, err)
+	}
+	for f, v := range files {
+		if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+			t.Fatalf(`Can't create dir: %s`, err)
+		}
+		if err := os.WriteFile(f, []byte(v), 0644); err != nil {
+			t.Fatalf(`Can't write file: %s`, err)
+		}
+	}
+}
+
+func TestAllocateIoctls(t *testing.T) {
+	apqns := APQNList{&APQN{Adapter: 1, Domain: 1, Gen: "cex8", Mode: "ep11", Healthy: true}}
+	config := `{"cryptoconfigsets":[{"setname":"set","project":"test","overcommit":2,"livesysfs":0,
+		"ioctls":[%s],"apqns":[{"adapter":1,"domain":1}]}]}`
+
+	saveclassdir, savevdevdir, savedevdir := zcryptclassdir, zcryptvdevdir, zcryptdevdir
+	savebusdir, savedevsdir, savebasedir := apbusdir, apdevsdir, shadowbasedir
+	savecc, savetag, savescanner := cc, tag, apscanner
+	defer func() {
+		zcryptclassdir, zcryptvdevdir, zcryptdevdir = saveclassdir, savevdevdir, savedevdir
+		apbusdir, apdevsdir, shadowbasedir = savebusdir, savedevsdir, savebasedir
+		cc, tag, apscanner = savecc, savetag, savescanner
+	}()
+	dir := t.TempDir()
+	stop := allocTestFakeZcrypt(t, dir)
+	defer stop()
+	allocTestFakeSysfs(t, dir, apqns)
+	apscanner = NewAPScanner()
+	apscanner.snapshot = &APSnapshot{Generation: 1, APQNs: apqns}
+
+	var steps = []struct {
+		name      string
+		ioctls    string
+		tag       string
+		id        string
+		ioctlmask string // as written by the plugin to the ioctlmask of the node
+	}{
+		{"initial ioctls", `"ZSECSENDCPRB","ZSENDEP11CPRB"`, "1", "apqn-1-1-0", "+4,+129"},
+		{"tightened ioctls", `"ZSECSENDCPRB"`, "2", "apqn-1-1-1", "+129"},
+	}
+	var p *ZCryptoResPlugin
+	for i, step := range steps {
+		newcc, err := ccParseConfig([]byte(fmt.Sprintf(config, step.ioctls)))
+		if err != nil {
+			t.Fatalf(`ccParseConfig for "%s" failed: %s`, step.name, err)
+		}
+		mu.Lock()
+		cc, tag = newcc, []byte(step.tag)
+		mu.Unlock()
+		if p == nil {
+			p = (&ZCryptoDPMLister{}).NewPlugin("set").(*ZCryptoResPlugin)
+		}
+		// only the first step changes the devices
+		if changed := p.checkChanged(); changed != (i == 0) {
+			t.Errorf(`checkChanged for "%s" returned %v`, step.name, changed)
+		}
+		req := &kdp.AllocateRequest{ContainerRequests: []*kdp.ContainerAllocateRequest{{DevicesIDs: []string{step.id}}}}
+		if _, err := p.Allocate(context.Background(), req); err != nil {
+			t.Errorf(`Allocate for "%s" failed: %s`, step.name, err)
+			continue
+		}
+		ioctlmask, err := os.ReadFile(filepath.Join(zcryptvdevdir, "zcrypt-"+step.id, "ioctlmask"))
+		if err != nil {
+			t.Errorf(`Can't read ioctlmask for "%s": %s`, step.name, err)
+			continue
+		}
+		if got := strings.TrimSpace(string(ioctlmask)); got != step.ioctlmask {
+			t.Errorf(`Allocate for "%s" created a node with ioctlmask %s, expected %s`, step.name, got, step.ioctlmask)
+		}
+	}
+}
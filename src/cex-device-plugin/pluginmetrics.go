@@ -0,0 +1,189 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * node level Prometheus metrics served by the plugin itself
+ */
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// pluginMetrics collects the node metrics on each scrape from the AP
+// scanner snapshot, the metrics collector raw data and the zcrypt nodes
+// and shadow sysfs dirs. All metrics carry the nodename label.
+type pluginMetrics struct {
+	apqnHealthy         *prometheus.Desc
+	apqnInfo            *prometheus.Desc
+	plugindevsAvailable *prometheus.Desc
+	plugindevsUsed      *prometheus.Desc
+	filteredAPQNs       *prometheus.Desc
+	unhealthyAPQNs      *prometheus.Desc
+	zcryptNodes         *prometheus.Desc
+	shadowSysfs         *prometheus.Desc
+	configActive        *prometheus.Desc
+	configRejected      *prometheus.Desc
+	scanSeconds         *prometheus.Desc
+	scanGeneration      *prometheus.Desc
+	scanTimestamp       *prometheus.Desc
+	containerRequests   *prometheus.Desc
+	containerQueueDepth *prometheus.Desc
+	containerLoad       *prometheus.Desc
+	containerShared     *prometheus.Desc
+	containerLatency    *prometheus.Desc
+}
+
+func newPluginMetrics(nodename string) *pluginMetrics {
+
+	cl := prometheus.Labels{"nodename": nodename}
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc("cex_plugin_node_"+name, help, labels, cl)
+	}
+	containerlabels := []string{"namespace", "pod", "container", "setname"}
+
+	return &pluginMetrics{
+		apqnHealthy: desc("apqn_healthy",
+			"1 if the APQN is healthy, 0 if not, with the reason",
+			"adapter", "domain", "gen", "mode", "reason"),
+		apqnInfo: desc("apqn_info",
+			"Card info and current master key verification patterns of the APQN, always 1",
+			"adapter", "domain", "serialnr", "fw_version", "mkvps"),
+		plugindevsAvailable: desc("plugindevs_available",
+			"Number of CEX plugin devices available on this node, partitioned by configset",
+			"setname"),
+		plugindevsUsed: desc("plugindevs_used",
+			"Number of CEX plugin devices in use on this node, partitioned by configset",
+			"setname"),
+		filteredAPQNs: desc("filtered_apqns",
+			"Number of APQNs not announced because of a mismatch with the configset, partitioned by configset and reason",
+			"setname", "reason"),
+		unhealthyAPQNs: desc("unhealthy_apqns",
+			"Number of announced APQNs which are not healthy, partitioned by configset and reason",
+			"setname", "reason"),
+		zcryptNodes: desc("zcrypt_nodes",
+			"Number of zcrypt device nodes created by the plugin"),
+		shadowSysfs: desc("shadow_sysfs",
+			"Number of shadow sysfs directories created by the plugin"),
+		configActive: desc("config_active",
+			"1 if a verified crypto configuration is active, 0 if not"),
+		configRejected: desc("config_rejected",
+			"1 if the latest crypto configuration revision has been rejected, 0 if not"),
+		scanSeconds: desc("apscan_duration_seconds",
+			"Duration of the last AP bus scan"),
+		scanGeneration: desc("apscan_generation",
+			"Number of changes of the APQNs seen by the AP bus scanner"),
+		scanTimestamp: desc("apscan_timestamp_seconds",
+			"Time of the last AP bus scan in seconds since the epoch"),
+		containerRequests: desc("container_request_counter",
+			"Requests processed for a container, estimated if the APQNs are shared with other containers",
+			containerlabels...),
+		containerQueueDepth: desc("container_queue_depth",
+			"Pending and queued requests on the APQNs used by a container",
+			containerlabels...),
+		containerLoad: desc("container_load",
+			"Sum of the load of the APQNs used by a container",
+			containerlabels...),
+		containerShared: desc("container_shared",
+			"1 if the APQNs used by a container are shared with other containers and the request counter is estimated, 0 if not",
+			containerlabels...),
+		containerLatency: desc("container_latency_estimate_seconds",
+			"Request latency of a container estimated from the queue depth and the request rate of the APQNs",
+			containerlabels...),
+	}
+}
+
+func (pm *pluginMetrics) Describe(ch chan<- *prometheus.Desc) {
+
+	prometheus.DescribeByCollect(pm, ch)
+}
+
+func (pm *pluginMetrics) Collect(ch chan<- prometheus.Metric) {
+
+	gauge := func(d *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, labels...)
+	}
+	boolvalue := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	snapshot := apscanner.Snapshot()
+	for _, a := range snapshot.APQNs {
+		ap, dom := strconv.Itoa(a.Adapter), strconv.Itoa(a.Domain)
+		gauge(pm.apqnHealthy, boolvalue(a.Healthy), ap, dom, a.Gen, a.Mode, a.Reason)
+		gauge(pm.apqnInfo, 1, ap, dom, a.Serialnr, a.FWVersion, strings.Join(a.CurrentMKVPs(), ","))
+	}
+	gauge(pm.scanSeconds, snapshot.ScanSeconds)
+	ch <- prometheus.MustNewConstMetric(pm.scanGeneration, prometheus.CounterValue, float64(snapshot.Generation))
+	gauge(pm.scanTimestamp, float64(snapshot.Timestamp.UnixMilli())/1000)
+
+	if nodes, err := zcryptFetchActiveNodes(); err == nil {
+		gauge(pm.zcryptNodes, float64(len(nodes)))
+	}
+	if shadows, err := shadowFetchActiveShadows(); err == nil {
+		gauge(pm.shadowSysfs, float64(len(shadows)))
+	}
+	gauge(pm.configActive, boolvalue(GetCurrentCryptoConfig() != nil))
+
+	mcmutex.Lock()
+	defer mcmutex.Unlock()
+
+	gauge(pm.configRejected, boolvalue(configrejected))
+	for sn, cse := range csetmap {
+		used := 0
+		for _, pde := range cse.plugindevs {
+			if pde.in_use {
+				used++
+			}
+		}
+		gauge(pm.plugindevsAvailable, float64(len(cse.plugindevs)), sn)
+		gauge(pm.plugindevsUsed, float64(used), sn)
+		for reason, n := range cse.filtered {
+			gauge(pm.filteredAPQNs, float64(n), sn, reason)
+		}
+		for reason, n := range cse.unhealthy {
+			gauge(pm.unhealthyAPQNs, float64(n), sn, reason)
+		}
+	}
+	for _, ce := range containermap {
+		labels := []string{ce.namespace, ce.pod, ce.container, ce.setname}
+		ch <- prometheus.MustNewConstMetric(pm.containerRequests, prometheus.CounterValue, ce.request_counter, labels...)
+		gauge(pm.containerQueueDepth, float64(ce.queue_depth), labels...)
+		gauge(pm.containerLoad, float64(ce.load), labels...)
+		gauge(pm.containerShared, boolvalue(ce.shared), labels...)
+		if ce.latency > 0 {
+			gauge(pm.containerLatency, ce.latency, labels...)
+		}
+	}
+}
+
+// pluginMetricsHandler returns the http handler serving the node metrics
+func pluginMetricsHandler() http.Handler {
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newPluginMetrics(os.Getenv("NODENAME")))
+
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
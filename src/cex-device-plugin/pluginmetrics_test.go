@@ -0,0 +1,91 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * node level Prometheus metrics
+ */
+
+// run with
+// $ go test -run PluginMetrics
+
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPluginMetrics(t *testing.T) {
+	savescanner, saveshadowdir := apscanner, shadowbasedir
+	defer func() {
+		apscanner, shadowbasedir = savescanner, saveshadowdir
+		csetmap = map[string]*cset_entry_s{}
+		containermap = map[string]*container_entry_s{}
+	}()
+	shadowbasedir = t.TempDir()
+	t.Setenv("NODENAME", "worker-1")
+
+	apscanner = NewAPScanner()
+	apscanner.snapshot = &APSnapshot{
+		Generation:  3,
+		ScanSeconds: 0.25,
+		APQNs: APQNList{
+			&APQN{Adapter: 1, Domain: 5, Gen: "cex8", Mode: "cca", Online: true, Healthy: true, Serialnr: "93AADFK719",
+				MKVPs: []MKVP{{Register: "AES CUR", State: "valid", VP: "0xb072bc5c245aac8a"}}},
+			&APQN{Adapter: 2, Domain: 5, Gen: "cex8", Mode: "ep11", Reason: ApqnReasonOffline},
+		},
+	}
+	csetmap = map[string]*cset_entry_s{
+		"set1": &cset_entry_s{
+			plugindevs: map[string]*plugindev_entry_s{
+				"apqn-1-5-0": &plugindev_entry_s{in_use: true},
+				"apqn-1-5-1": &plugindev_entry_s{},
+			},
+			filtered:  map[string]int{"cexmode": 1},
+			unhealthy: map[string]int{ApqnReasonOffline: 1},
+		},
+	}
+	containermap = map[string]*container_entry_s{
+		"ns1/p1/c1": &container_entry_s{namespace: "ns1", pod: "p1", container: "c1", setname: "set1", request_counter: 42.5, queue_depth: 3, latency: 0.75},
+	}
+
+	rec := httptest.NewRecorder()
+	pluginMetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+
+	want := []string{
+		`cex_plugin_node_apqn_healthy{adapter="1",domain="5",gen="cex8",mode="cca",nodename="worker-1",reason=""} 1`,
+		`cex_plugin_node_apqn_healthy{adapter="2",domain="5",gen="cex8",mode="ep11",nodename="worker-1",reason="offline"} 0`,
+		`cex_plugin_node_apqn_info{adapter="1",domain="5",fw_version="",mkvps="0xb072bc5c245aac8a",nodename="worker-1",serialnr="93AADFK719"} 1`,
+		`cex_plugin_node_plugindevs_available{nodename="worker-1",setname="set1"} 2`,
+		`cex_plugin_node_plugindevs_used{nodename="worker-1",setname="set1"} 1`,
+		`cex_plugin_node_filtered_apqns{nodename="worker-1",reason="cexmode",setname="set1"} 1`,
+		`cex_plugin_node_unhealthy_apqns{nodename="worker-1",reason="offline",setname="set1"} 1`,
+		`cex_plugin_node_shadow_sysfs{nodename="worker-1"} 0`,
+		`cex_plugin_node_apscan_duration_seconds{nodename="worker-1"} 0.25`,
+		`cex_plugin_node_apscan_generation{nodename="worker-1"} 3`,
+		`# TYPE cex_plugin_node_container_request_counter counter`,
+		`cex_plugin_node_container_request_counter{container="c1",namespace="ns1",nodename="worker-1",pod="p1",setname="set1"} 42.5`,
+		`cex_plugin_node_container_latency_estimate_seconds{container="c1",namespace="ns1",nodename="worker-1",pod="p1",setname="set1"} 0.75`,
+		`cex_plugin_node_container_shared{container="c1",namespace="ns1",nodename="worker-1",pod="p1",setname="set1"} 0`,
+	}
+	for _, w := range want {
+		if !strings.Contains(string(body), w+"\n") {
+			t.Errorf(`Plugin metrics do not contain "%s"`, w)
+		}
+	}
+}
@@ -28,6 +28,7 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	podresapi "k8s.io/kubelet/pkg/apis/podresources/v1"
@@ -144,6 +145,7 @@ ForLoop:
 type zcryptnode_s struct {
 	first time.Time // first ever seen timestamp
 	last  time.Time // timestamp when last use by a container was seen
+	devs  []string  // plugin devices of the container using this node
 }
 
 var zcryptnodemap = map[string]*zcryptnode_s{}
@@ -155,6 +157,67 @@ type sysfsshadow_s struct {
 
 var sysfsshadowmap = map[string]*sysfsshadow_s{}
 
+// plugin devices known to be allocated by a container with the timestamp
+// of the last time the allocation was seen (or announced via Allocate)
+var (
+	allocdevsmap   = map[string]time.Time{}
+	allocdevsmutex = sync.Mutex{}
+)
+
+// PodListerContainer is a container with allocated plugin devices as
+// seen by the last PodLister run
+type PodListerContainer struct {
+	Namespace  string   `json:"namespace"`
+	Pod        string   `json:"pod"`
+	Container  string   `json:"container"`
+	SetName    string   `json:"setname,omitempty"`
+	ZCryptNode string   `json:"zcryptnode"`
+	Devices    []string `json:"devices"`
+}
+
+var (
+	plcontainers      []*PodListerContainer
+	plcontainersmutex = sync.Mutex{}
+)
+
+// PodListerGetContainers returns the containers with allocated plugin
+// devices, the list must not be modified
+func PodListerGetContainers() []*PodListerContainer {
+
+	plcontainersmutex.Lock()
+	defer plcontainersmutex.Unlock()
+
+	return plcontainers
+}
+
+func PodListerNotifyAboutAlloc(dev string) {
+
+	allocdevsmutex.Lock()
+	allocdevsmap[dev] = time.Now()
+	allocdevsmutex.Unlock()
+}
+
+func PodListerGetAllocatedDevs() map[string]bool {
+
+	devs := map[string]bool{}
+
+	// a plugin device where no container has been seen for
+	// more than 2 * PodLister Polltime, is not in use any more
+	nowminus2xPollTime := time.Now().Add(time.Duration(-2) * PlPollTime * time.Second)
+
+	allocdevsmutex.Lock()
+	defer allocdevsmutex.Unlock()
+	for dev, seen := range allocdevsmap {
+		if seen.Before(nowminus2xPollTime) {
+			delete(allocdevsmap, dev)
+			continue
+		}
+		devs[dev] = true
+	}
+
+	return devs
+}
+
 func (pl *PodLister) doLoop() error {
 
 	if pl.con == nil {
@@ -220,13 +283,17 @@ func (pl *PodLister) doLoop() error {
 	*/
 
 	// go through all the active pods and examine the containers which have a device we manage in this plugin
-	conswithplugindevs := 0
+	var containers []*PodListerContainer
 	for _, pod := range resp.PodResources {
 		for _, c := range pod.Containers {
 			for _, d := range c.Devices {
 				if !strings.HasPrefix(d.ResourceName, baseResourceName+"/") {
 					continue
 				}
+				var ids []string
+				var setname string
+				var violation *CryptoConfigSet
+				nscheck := nsCheckAllowed
 				for _, id := range d.DeviceIds {
 					if !strings.HasPrefix(id, "apqn-") {
 						continue
@@ -243,40 +310,72 @@ func (pl *PodLister) doLoop() error {
 						log.Printf("PodLister: config set for APQN(%d,%d) not found\n", card, queue)
 					} else {
 						// check pod namespace against config set projectname
-						if pod.Namespace != ccset.Project {
+						check, err := checkNamespace(ccset, pod.Namespace)
+						switch check {
+						case nsCheckViolation:
 							log.Printf("PodLister: Container '%s' in namespace '%s' uses CEX resource '%s' marked for project '%s'!!!\n",
-								c.Name, pod.Namespace, id, ccset.Project)
-						} else {
+								c.Name, pod.Namespace, id, ccset.NamespacesString())
+						case nsCheckUnknown:
+							log.Printf("PodLister: Container '%s' in namespace '%s' uses CEX resource '%s': %s\n",
+								c.Name, pod.Namespace, id, err)
+						default:
 							log.Printf("PodLister: Container '%s' in namespace %s uses CEX resource '%s'\n",
 								c.Name, pod.Namespace, id)
 						}
+						if check > nscheck {
+							nscheck = check
+							violation = ccset
+						}
 						MetricsCollNotifyAboutRunningContainer(ccset.SetName, id)
+						setname = ccset.SetName
 					}
-
-					conswithplugindevs++
-					// check/update zcryptnodemap
-					znname := "zcrypt-" + id
-					zn, znfound := zcryptnodemap[znname]
-					if znfound {
-						zn.last = time.Now()
-						//log.Printf("PodLister: last timestamp of zcryptnode '%s' refreshed\n", znname)
-					} else {
-						log.Printf("PodLister: zcryptnode '%s' not found in zcryptnodemap !!!\n", znname)
-					}
-					// check/update sysfsshadowmap
-					snname := "sysfs-" + id
-					sn, snfound := sysfsshadowmap[snname]
-					if snfound {
-						sn.last = time.Now()
-						//log.Printf("PodLister: last timestamp of sysfsshadow '%s' refreshed\n", snname)
-					} else {
-						log.Printf("PodLister: sysfs shadow '%s' not found in sysfs shadowmap !!!\n", snname)
-					}
+					PodListerNotifyAboutAlloc(id)
+					ids = append(ids, id)
+				}
+				if len(ids) == 0 {
+					continue
+				}
+				// all the devices of this container share one zcrypt node and one sysfs shadow
+				nodeid := nodeIdForDevs(ids)
+				// check/update zcryptnodemap
+				znname := "zcrypt-" + nodeid
+				containers = append(containers, &PodListerContainer{
+					Namespace:  pod.Namespace,
+					Pod:        pod.Name,
+					Container:  c.Name,
+					SetName:    setname,
+					ZCryptNode: znname,
+					Devices:    ids,
+				})
+				zn, znfound := zcryptnodemap[znname]
+				if znfound {
+					zn.last = time.Now()
+					zn.devs = ids
+					//log.Printf("PodLister: last timestamp of zcryptnode '%s' refreshed\n", znname)
+				} else {
+					log.Printf("PodLister: zcryptnode '%s' not found in zcryptnodemap !!!\n", znname)
+				}
+				// check/update sysfsshadowmap
+				snname := "sysfs-" + nodeid
+				sn, snfound := sysfsshadowmap[snname]
+				if snfound {
+					sn.last = time.Now()
+					//log.Printf("PodLister: last timestamp of sysfsshadow '%s' refreshed\n", snname)
+				} else {
+					log.Printf("PodLister: sysfs shadow '%s' not found in sysfs shadowmap !!!\n", snname)
+				}
+				// apply the violation policy of the config set on namespace mismatch
+				if violation != nil {
+					pl.handleViolation(violation, nscheck, pod.Namespace, pod.Name, c.Name, znname, ids)
 				}
 			}
 		}
 	}
-	log.Printf("PodLister: %d active containers with allocated cex devices\n", conswithplugindevs)
+	log.Printf("PodLister: %d active containers with allocated cex devices\n", len(containers))
+	plcontainersmutex.Lock()
+	plcontainers = containers
+	plcontainersmutex.Unlock()
+	purgeViolations()
 
 	// go through the zcryptnodemap and check if entries have expired
 	for zk, zn := range zcryptnodemap {
@@ -286,7 +385,7 @@ func (pl *PodLister) doLoop() error {
 				// within DeleteResourceTimeoutIfUnused s never seen a container using this
 				log.Printf("PodLister: deleting zcrypt node '%s': no container ever used it since %d s\n",
 					zk, DeleteResourceTimeoutIfUnused)
-				pl.tellMetricsCollAboutDestroyNode(zk)
+				pl.tellMetricsCollAboutDestroyNode(zk, zn.devs)
 				zcryptDestroyNode(zk)
 				delete(zcryptnodemap, zk)
 			}
@@ -296,7 +395,7 @@ func (pl *PodLister) doLoop() error {
 				// container using this has not been seen for DeleteResourceTimeoutAfterUse s
 				log.Printf("PodLister: deleting zcrypt node '%s': no container use since %d s\n",
 					zk, DeleteResourceTimeoutAfterUse)
-				pl.tellMetricsCollAboutDestroyNode(zk)
+				pl.tellMetricsCollAboutDestroyNode(zk, zn.devs)
 				zcryptDestroyNode(zk)
 				delete(zcryptnodemap, zk)
 			}
@@ -329,9 +428,13 @@ func (pl *PodLister) doLoop() error {
 	return nil
 }
 
-func (pl *PodLister) tellMetricsCollAboutDestroyNode(zcryptnode string) {
+func (pl *PodLister) tellMetricsCollAboutDestroyNode(zcryptnode string, devs []string) {
 
-	if strings.HasPrefix(zcryptnode, "zcrypt-") {
+	if len(devs) > 0 {
+		for _, dev := range devs {
+			MetricsCollNotifyAboutDestroyNode(dev)
+		}
+	} else if strings.HasPrefix(zcryptnode, "zcrypt-") {
 		dev := zcryptnode[7:]
 		MetricsCollNotifyAboutDestroyNode(dev)
 	}
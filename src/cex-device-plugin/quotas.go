@@ -0,0 +1,310 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * ResourceQuota generation for the crypto config sets
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	quotaName          = "cex-quota"
+	quotaManagedByKey  = "app.kubernetes.io/managed-by"
+	quotaManagedByName = "cex-plugin"
+)
+
+// quotaHardFor returns the hard limits of the ResourceQuota for a
+// namespace: zero requests for each config set the namespace is not
+// allowed to use. Extended resources can't be overcommitted, so
+// restricting the requests is sufficient.
+func quotaHardFor(cc *CryptoConfig, namespace string, nslabels map[string]string) corev1.ResourceList {
+
+	hard := corev1.ResourceList{}
+	if cc == nil {
+		return hard
+	}
+	for _, s := range cc.CryptoConfigSets {
+		if s.AllowsNamespaceWithLabels(namespace, nslabels) {
+			continue
+		}
+		hard[corev1.ResourceName("requests."+baseResourceName+"/"+s.SetName)] = resource.MustParse("0")
+	}
+
+	return hard
+}
+
+func quotaNew(namespace string, hard corev1.ResourceList) *corev1.ResourceQuota {
+
+	return &corev1.ResourceQuota{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ResourceQuota",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      quotaName,
+			Namespace: namespace,
+			Labels:    map[string]string{quotaManagedByKey: quotaManagedByName},
+		},
+		Spec: corev1.ResourceQuotaSpec{
+			Hard: hard,
+		},
+	}
+}
+
+type quotaSync_s struct {
+	clientset  kubernetes.Interface
+	namespaces []string        // only these namespaces, all if empty
+	exclude    *regexp.Regexp  // namespaces matching are skipped
+	apply      bool            // apply the quotas instead of printing yaml
+	unmanaged  map[string]bool // namespaces with a cex-quota not managed by the plugin
+}
+
+// quotas returns the ResourceQuotas for all the selected namespaces,
+// namespaces allowed to use all config sets get none
+func (q *quotaSync_s) quotas(cc *CryptoConfig) (map[string]*corev1.ResourceQuota, []string, error) {
+
+	nslist, err := q.clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Quotas: Can't list namespaces: %w", err)
+	}
+	quotas := map[string]*corev1.ResourceQuota{}
+	var selected []string
+	for _, ns := range nslist.Items {
+		if len(q.namespaces) > 0 && !slices.Contains(q.namespaces, ns.Name) {
+			continue
+		}
+		if q.exclude != nil && q.exclude.MatchString(ns.Name) {
+			continue
+		}
+		selected = append(selected, ns.Name)
+		hard := quotaHardFor(cc, ns.Name, ns.Labels)
+		if len(hard) > 0 {
+			quotas[ns.Name] = quotaNew(ns.Name, hard)
+		}
+	}
+
+	return quotas, selected, nil
+}
+
+// sync creates, updates and deletes the ResourceQuotas managed by the
+// plugin so that they match the current crypto config
+func (q *quotaSync_s) sync(cc *CryptoConfig) error {
+
+	quotas, selected, err := q.quotas(cc)
+	if err != nil {
+		return err
+	}
+
+	if !q.apply {
+		var list struct {
+			APIVersion string                  `json:"apiVersion"`
+			Kind       string                  `json:"kind"`
+			Items      []*corev1.ResourceQuota `json:"items"`
+		}
+		list.APIVersion, list.Kind = "v1", "List"
+		for _, ns := range selected {
+			if quota, found := quotas[ns]; found {
+				list.Items = append(list.Items, quota)
+			}
+		}
+		out, err := yaml.Marshal(&list)
+		if err != nil {
+			return fmt.Errorf("Quotas: Can't marshal quotas: %w", err)
+		}
+		os.Stdout.Write(out)
+		return nil
+	}
+
+	// all quotas with our name, so the ones not managed by the plugin are found too
+	existing, err := q.clientset.CoreV1().ResourceQuotas("").List(context.TODO(), metav1.ListOptions{
+		FieldSelector: "metadata.name=" + quotaName,
+	})
+	if err != nil {
+		return fmt.Errorf("Quotas: Can't list resource quotas: %w", err)
+	}
+	current := map[string]*corev1.ResourceQuota{}
+	unmanaged := map[string]bool{}
+	for i := range existing.Items {
+		item := &existing.Items[i]
+		if item.Name != quotaName {
+			continue
+		}
+		if item.Labels[quotaManagedByKey] != quotaManagedByName {
+			if !q.unmanaged[item.Namespace] {
+				log.Printf("Quotas: ResourceQuota '%s/%s' is not managed by %s, namespace skipped\n",
+					item.Namespace, quotaName, quotaManagedByName)
+			}
+			unmanaged[item.Namespace] = true
+			continue
+		}
+		current[item.Namespace] = item
+	}
+	// log an unmanaged quota again only when it shows up again after it was removed
+	q.unmanaged = unmanaged
+
+	// the selected namespaces and the ones with a managed quota which
+	// is no longer wanted, like a namespace which is excluded now
+	namespaces := slices.Clone(selected)
+	for ns := range current {
+		if !slices.Contains(selected, ns) {
+			namespaces = append(namespaces, ns)
+		}
+	}
+
+	var errs []string
+	for _, ns := range namespaces {
+		if unmanaged[ns] {
+			continue
+		}
+		quota, want := quotas[ns]
+		cur, have := current[ns]
+		switch {
+		case want && !have:
+			_, err = q.clientset.CoreV1().ResourceQuotas(ns).Create(context.TODO(), quota, metav1.CreateOptions{})
+			if err == nil {
+				log.Printf("Quotas: ResourceQuota '%s/%s' created\n", ns, quotaName)
+			}
+		case want && have:
+			if apiequality.Semantic.DeepEqual(cur.Spec.Hard, quota.Spec.Hard) {
+				continue
+			}
+			cur.Spec.Hard = quota.Spec.Hard
+			_, err = q.clientset.CoreV1().ResourceQuotas(ns).Update(context.TODO(), cur, metav1.UpdateOptions{})
+			if err == nil {
+				log.Printf("Quotas: ResourceQuota '%s/%s' updated\n", ns, quotaName)
+			}
+		case !want && have:
+			err = q.clientset.CoreV1().ResourceQuotas(ns).Delete(context.TODO(), quotaName, metav1.DeleteOptions{})
+			if err == nil {
+				log.Printf("Quotas: ResourceQuota '%s/%s' deleted\n", ns, quotaName)
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			log.Printf("Quotas: Can't sync ResourceQuota in namespace '%s': %s\n", ns, err)
+			errs = append(errs, ns)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Quotas: Failed to sync ResourceQuotas in namespaces %v", errs)
+	}
+
+	return nil
+}
+
+// quotasMain generates ResourceQuotas restricting every namespace to the
+// config sets it is allowed to use. Without -apply the quotas are printed
+// as yaml, with -watch the quotas are kept in sync with the crypto config.
+func quotasMain(args []string) int {
+
+	fs := flag.NewFlagSet("quotas", flag.ContinueOnError)
+	configarg := fs.String("config", ccsfile, "crypto config json file, only used with the file config source")
+	nsarg := fs.String("namespaces", "", "comma separated list of namespaces, default all namespaces")
+	excludearg := fs.String("exclude", "^(kube-|openshift)", "regular expression of namespaces to skip")
+	applyarg := fs.Bool("apply", false, "create, update and delete the quotas instead of printing them")
+	watcharg := fs.Bool("watch", false, "keep the quotas in sync with the crypto config, implies -apply")
+	intervalarg := fs.Int("interval", 60, "resync interval in seconds with -watch, picks up new namespaces")
+	verbosearg := fs.Bool("v", false, "verbose, show the log output")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s quotas [options]\n", cexctlName)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *watcharg {
+		*applyarg, *verbosearg = true, true
+	}
+	if !*verbosearg {
+		log.SetOutput(io.Discard)
+	}
+
+	q := &quotaSync_s{apply: *applyarg}
+	if len(*nsarg) > 0 {
+		q.namespaces = strings.Split(*nsarg, ",")
+	}
+	if len(*excludearg) > 0 {
+		re, err := regexp.Compile(*excludearg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -exclude expression: %s\n", err)
+			return 2
+		}
+		q.exclude = re
+	}
+	clientset, err := kubeGetClientset()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	q.clientset = clientset
+
+	ccsfile = *configarg
+	cc, err := InitializeConfigWatcher()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	if cc == nil {
+		fmt.Fprintf(os.Stderr, "Quotas: No valid crypto config available\n")
+		return 1
+	}
+
+	if !*watcharg {
+		if err = q.sync(cc); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	log.Printf("Quotas: Keeping ResourceQuotas in sync with the crypto config\n")
+	ccnotify := CryptoConfigSubscribe()
+	defer CryptoConfigUnsubscribe(ccnotify)
+	ticker := time.NewTicker(time.Duration(max(10, *intervalarg)) * time.Second)
+	defer ticker.Stop()
+	for {
+		if cc = GetCurrentCryptoConfig(); cc != nil {
+			if err = q.sync(cc); err != nil {
+				log.Printf("%s\n", err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ccnotify:
+			log.Printf("Quotas: Crypto config changed\n")
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * ResourceQuota generation for the crypto config sets
+ */
+
+// run with
+// $ go test -run Quota
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestQuotaHardFor(t *testing.T) {
+	cc := &CryptoConfig{
+		CryptoConfigSets: []*CryptoConfigSet{
+			&CryptoConfigSet{
+				SetName: "red",
+				Project: "red",
+			},
+			&CryptoConfigSet{
+				SetName:  "blue",
+				Project:  "blue",
+				Projects: []string{"team-a"},
+			},
+			&CryptoConfigSet{
+				SetName: "green",
+				NsSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"cex": "green"},
+				},
+			},
+		},
+	}
+
+	var tests = []struct {
+		namespace string
+		labels    map[string]string
+		want      []string
+	}{
+		{"red", nil, []string{"blue", "green"}},
+		{"team-a", nil, []string{"green", "red"}},
+		{"team-b", map[string]string{"cex": "green"}, []string{"blue", "red"}},
+		{"other", map[string]string{"cex": "red"}, []string{"blue", "green", "red"}},
+	}
+	for _, test := range tests {
+		hard := quotaHardFor(cc, test.namespace, test.labels)
+		var got []string
+		for name, q := range hard {
+			if !q.IsZero() {
+				t.Errorf(`quotaHardFor for namespace "%s" returned non zero quota %s for %s`, test.namespace, q.String(), name)
+			}
+			got = append(got, string(name))
+		}
+		sort.Strings(got)
+		if len(got) != len(test.want) {
+			t.Errorf(`quotaHardFor for namespace "%s" returned %v, expected %v`, test.namespace, got, test.want)
+			continue
+		}
+		for i, s := range test.want {
+			if got[i] != "requests.cex.s390.ibm.com/"+s {
+				t.Errorf(`quotaHardFor for namespace "%s" returned %v, expected %v`, test.namespace, got, test.want)
+				break
+			}
+		}
+	}
+	if hard := quotaHardFor(nil, "red", nil); len(hard) != 0 {
+		t.Errorf(`quotaHardFor without crypto config returned %v`, hard)
+	}
+}
+
+func TestQuotaSync(t *testing.T) {
+	cc := &CryptoConfig{
+		CryptoConfigSets: []*CryptoConfigSet{
+			&CryptoConfigSet{
+				SetName: "red",
+				Project: "red",
+			},
+			&CryptoConfigSet{
+				SetName: "blue",
+				Project: "blue",
+			},
+		},
+	}
+
+	namespace := func(name string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	}
+	// stale managed quota in red, managed quota in the now excluded
+	// kube-system and a quota of the admin in other
+	stale := quotaNew("red", corev1.ResourceList{"requests.cex.s390.ibm.com/green": resource.MustParse("0")})
+	excluded := quotaNew("kube-system", quotaHardFor(cc, "kube-system", nil))
+	foreign := quotaNew("other", corev1.ResourceList{"requests.cpu": resource.MustParse("1")})
+	foreign.Labels = nil
+	clientset := fake.NewSimpleClientset(namespace("red"), namespace("blue"), namespace("kube-system"),
+		namespace("other"), stale, excluded, foreign)
+
+	q := &quotaSync_s{clientset: clientset, exclude: regexp.MustCompile("^kube-"), apply: true}
+	for i := 0; i < 2; i++ {
+		if err := q.sync(cc); err != nil {
+			t.Fatalf(`quotaSync_s.sync returned error %s`, err)
+		}
+	}
+
+	var tests = []struct {
+		namespace string
+		want      []string // nil if there is no quota
+	}{
+		{"red", []string{"requests.cex.s390.ibm.com/blue"}},
+		{"blue", []string{"requests.cex.s390.ibm.com/red"}},
+		{"kube-system", nil},
+		{"other", []string{"requests.cpu"}},
+	}
+	for _, test := range tests {
+		quota, err := clientset.CoreV1().ResourceQuotas(test.namespace).Get(context.TODO(), quotaName, metav1.GetOptions{})
+		if err != nil {
+			if test.want != nil {
+				t.Errorf(`quotaSync_s.sync left no quota in namespace "%s": %s`, test.namespace, err)
+			}
+			continue
+		}
+		if test.want == nil {
+			t.Errorf(`quotaSync_s.sync left quota %v in namespace "%s"`, quota.Spec.Hard, test.namespace)
+			continue
+		}
+		var got []string
+		for name := range quota.Spec.Hard {
+			got = append(got, string(name))
+		}
+		sort.Strings(got)
+		if len(got) != len(test.want) || got[0] != test.want[0] {
+			t.Errorf(`quotaSync_s.sync left quota %v in namespace "%s", expected %v`, got, test.namespace, test.want)
+		}
+	}
+	if !q.unmanaged["other"] || len(q.unmanaged) != 1 {
+		t.Errorf(`quotaSync_s.sync found unmanaged quotas in %v, expected only "other"`, q.unmanaged)
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 	"syscall"
 
@@ -86,6 +87,8 @@ var sys_devices_ap_queue_copyfiles = []string{
 var sys_devices_ap_queue_maybecopyfiles = []string{
 	"mkvps",
 	"op_modes",
+	"se_associate",
+	"se_bind",
 }
 var sys_devices_ap_queue_fileswithvalue = []struct{ name, value string }{
 	{"load", "0\n"},
@@ -118,7 +121,7 @@ func shadowSysfsInit() bool {
 	return true
 }
 
-func makeShadowApSysfs(id string, livesysfs, adapter, domain int) (string, string, error) {
+func makeShadowApSysfs(id string, livesysfs int, apqns APQNList) (string, string, error) {
 
 	exists := func(name string) bool {
 		_, err := os.Stat(name)
@@ -217,11 +220,123 @@ func makeShadowApSysfs(id string, livesysfs, adapter, domain int) (string, strin
 		return nil
 	}
 
+	makecard := func(shadowapbusdir, shadowapdevsdir string, adapter, domain int) error {
+		// shadow sys/devices/ap/card<xx>, domain is the queue the live files link to
+		carddir := fmt.Sprintf("card%02x", adapter)
+		apcarddir := fmt.Sprintf("%s/%s", apdevsdir, carddir)
+		shadowcarddir := fmt.Sprintf("%s/%s", shadowapdevsdir, carddir)
+		if err := makedir(shadowcarddir); err != nil {
+			return err
+		}
+		if err := copyfiles(apcarddir, shadowcarddir, sys_devices_ap_card_copyfiles); err != nil {
+			return err
+		}
+		if err := maybecopyfiles(apcarddir, shadowcarddir, sys_devices_ap_card_maybecopyfiles); err != nil {
+			return err
+		}
+		if livesysfs > 0 {
+			for _, e := range sys_devices_ap_card_fileswithvalue_live {
+				if err := makefile(shadowcarddir+"/"+e.name, e.value); err != nil {
+					return err
+				}
+			}
+			for _, e := range sys_devices_ap_card_links_to_queuedir {
+				linksrc := fmt.Sprintf("%s/%s", shadowcarddir, e.name)
+				linkdst := fmt.Sprintf("%02x.%04x/%s", adapter, domain, e.name)
+				if err := makelink(linksrc, linkdst); err != nil {
+					return err
+				}
+			}
+		} else {
+			for _, e := range sys_devices_ap_card_fileswithvalue {
+				if err := makefile(shadowcarddir+"/"+e.name, e.value); err != nil {
+					return err
+				}
+			}
+		}
+		if err := makelink(shadowcarddir+"/driver", "../../../bus/ap/drivers/cex4card"); err != nil {
+			return err
+		}
+		if err := makelink(shadowcarddir+"/subsystem", "../../../bus/ap"); err != nil {
+			return err
+		}
+		// card links in sys/bus/ap/devices and sys/bus/ap/drivers/cex4card
+		linksrc := fmt.Sprintf("%s/devices/%s", shadowapbusdir, carddir)
+		linkdst := fmt.Sprintf("../../../devices/ap/%s", carddir)
+		if err := makelink(linksrc, linkdst); err != nil {
+			return err
+		}
+		linksrc = fmt.Sprintf("%s/drivers/cex4card/%s", shadowapbusdir, carddir)
+		linkdst = fmt.Sprintf("../../../../devices/ap/%s", carddir)
+		return makelink(linksrc, linkdst)
+	}
+	makequeue := func(shadowapbusdir, shadowapdevsdir string, adapter, domain int) error {
+		// shadow sys/devices/ap/card<xx>/<xx>.<yyyy>
+		carddir := fmt.Sprintf("card%02x", adapter)
+		queuedir := fmt.Sprintf("%02x.%04x", adapter, domain)
+		apqueuedir := fmt.Sprintf("%s/%s/%s", apdevsdir, carddir, queuedir)
+		shadowqueuedir := fmt.Sprintf("%s/%s/%s", shadowapdevsdir, carddir, queuedir)
+		if err := makedir(shadowqueuedir); err != nil {
+			return err
+		}
+		if err := copyfiles(apqueuedir, shadowqueuedir, sys_devices_ap_queue_copyfiles); err != nil {
+			return err
+		}
+		if err := maybecopyfiles(apqueuedir, shadowqueuedir, sys_devices_ap_queue_maybecopyfiles); err != nil {
+			return err
+		}
+		for _, e := range sys_devices_ap_queue_fileswithvalue {
+			if err := makefile(shadowqueuedir+"/"+e.name, e.value); err != nil {
+				return err
+			}
+		}
+		if err := makelink(shadowqueuedir+"/driver", "../../../../bus/ap/drivers/cex4queue"); err != nil {
+			return err
+		}
+		if err := makelink(shadowqueuedir+"/subsystem", "../../../../bus/ap"); err != nil {
+			return err
+		}
+		// queue links in sys/bus/ap/devices and sys/bus/ap/drivers/cex4queue
+		linksrc := fmt.Sprintf("%s/devices/%s", shadowapbusdir, queuedir)
+		linkdst := fmt.Sprintf("../../../devices/ap/%s/%s", carddir, queuedir)
+		if err := makelink(linksrc, linkdst); err != nil {
+			return err
+		}
+		linksrc = fmt.Sprintf("%s/drivers/cex4queue/%s", shadowapbusdir, queuedir)
+		linkdst = fmt.Sprintf("../../../../devices/ap/%s/%s", carddir, queuedir)
+		return makelink(linksrc, linkdst)
+	}
+
 	var err error
 	var shadowdir, shadowapbusdir, shadowapdevsdir string
 
-	carddir := fmt.Sprintf("card%02x", adapter)
-	queuedir := fmt.Sprintf("%02x.%04x", adapter, domain)
+	if len(apqns) == 0 {
+		return "", "", fmt.Errorf("Shadowsysfs: no APQNs given for shadow sysfs %s", id)
+	}
+
+	// the adapters and domains and for each adapter the first domain
+	var adapters, domains []int
+	firstdomain := map[int]int{}
+	for _, a := range apqns {
+		if _, found := firstdomain[a.Adapter]; !found {
+			firstdomain[a.Adapter] = a.Domain
+			adapters = append(adapters, a.Adapter)
+		} else if a.Domain < firstdomain[a.Adapter] {
+			firstdomain[a.Adapter] = a.Domain
+		}
+		found := false
+		for _, d := range domains {
+			if d == a.Domain {
+				found = true
+				break
+			}
+		}
+		if !found {
+			domains = append(domains, a.Domain)
+		}
+	}
+	sort.Ints(adapters)
+	sort.Ints(domains)
 
 	// set umask to 0
 	oldumask := syscall.Umask(0000)
@@ -254,143 +369,61 @@ func makeShadowApSysfs(id string, livesysfs, adapter, domain int) (string, strin
 		if err = maybecopyfiles(apbusdir, shadowapbusdir, sys_bus_ap_maybecopyfiles); err != nil {
 			break
 		}
-		if err = make256bitmaskfile(shadowapbusdir+"/ap_adapter_mask", 0x00, adapter); err != nil {
+		if err = make256bitmaskfile(shadowapbusdir+"/ap_adapter_mask", 0x00, adapters...); err != nil {
 			break
 		}
 		if err = make256bitmaskfile(shadowapbusdir+"/ap_control_domain_mask", 0x00); err != nil {
 			break
 		}
-		if err = makefile(shadowapbusdir+"/ap_domain", fmt.Sprintf("%d\n", domain)); err != nil {
+		if err = makefile(shadowapbusdir+"/ap_domain", fmt.Sprintf("%d\n", domains[0])); err != nil {
 			break
 		}
 		if err = make256bitmaskfile(shadowapbusdir+"/apmask", 0xff); err != nil {
 			break
 		}
-		if err = make256bitmaskfile(shadowapbusdir+"/ap_usage_domain_mask", 0x00, domain); err != nil {
+		if err = make256bitmaskfile(shadowapbusdir+"/ap_usage_domain_mask", 0x00, domains...); err != nil {
 			break
 		}
 		if err = make256bitmaskfile(shadowapbusdir+"/aqmask", 0xff); err != nil {
 			break
 		}
-
-		// shadow sys/device/ap
-		shadowapdevsdir = fmt.Sprintf("%s/devices/ap", shadowdir)
-		err = makedir(shadowapdevsdir)
-		if err != nil {
+		// shadow sys/bus/ap/devices and sys/bus/ap/drivers
+		if err = makedir(shadowapbusdir + "/devices"); err != nil {
 			break
 		}
-		// shadow sys/devices/ap/card<xx>
-		apcarddir := fmt.Sprintf("%s/%s", apdevsdir, carddir)
-		shadowcarddir := fmt.Sprintf("%s/%s", shadowapdevsdir, carddir)
-		err = makedir(shadowcarddir)
-		if err != nil {
+		if err = makedir(shadowapbusdir + "/drivers/cex4card"); err != nil {
 			break
 		}
-		err = copyfiles(apcarddir, shadowcarddir, sys_devices_ap_card_copyfiles)
-		if err != nil {
+		if err = makedir(shadowapbusdir + "/drivers/cex4queue"); err != nil {
 			break
 		}
-		err = maybecopyfiles(apcarddir, shadowcarddir, sys_devices_ap_card_maybecopyfiles)
-		if err != nil {
+
+		// shadow sys/device/ap
+		shadowapdevsdir = fmt.Sprintf("%s/devices/ap", shadowdir)
+		if err = makedir(shadowapdevsdir); err != nil {
 			break
 		}
 		if livesysfs > 0 {
 			log.Printf("Shadowsysfs: creating live sysfs\n")
-			for _, e := range sys_devices_ap_card_fileswithvalue_live {
-				if err = makefile(shadowcarddir+"/"+e.name, e.value); err != nil {
-					break
-				}
-			}
-			for _, e := range sys_devices_ap_card_links_to_queuedir {
-				linksrc := fmt.Sprintf("%s/%s", shadowcarddir, e.name)
-				linkdst := fmt.Sprintf("%02x.%04x/%s", adapter, domain, e.name)
-				if err = makelink(linksrc, linkdst); err != nil {
-					break
-				}
-			}
 		} else {
 			log.Printf("Shadowsysfs: creating static sysfs\n")
-			for _, e := range sys_devices_ap_card_fileswithvalue {
-				if err = makefile(shadowcarddir+"/"+e.name, e.value); err != nil {
-					break
-				}
+		}
+		for _, adapter := range adapters {
+			if err = makecard(shadowapbusdir, shadowapdevsdir, adapter, firstdomain[adapter]); err != nil {
+				break
 			}
 		}
 		if err != nil {
 			break
 		}
-		if err = makelink(shadowcarddir+"/driver", "../../../bus/ap/drivers/cex4card"); err != nil {
-			break
-		}
-		if err = makelink(shadowcarddir+"/subsystem", "../../../bus/ap"); err != nil {
-			break
-		}
-
-		// shadow sys/devices/ap/card<xx>/<xx>.<yyyy>
-		apqueuedir := fmt.Sprintf("%s/%s", apcarddir, queuedir)
-		shadowqueuedir := fmt.Sprintf("%s/%s", shadowcarddir, queuedir)
-		if err = makedir(shadowqueuedir); err != nil {
-			break
-		}
-		if err = copyfiles(apqueuedir, shadowqueuedir, sys_devices_ap_queue_copyfiles); err != nil {
-			break
-		}
-		if err = maybecopyfiles(apqueuedir, shadowqueuedir, sys_devices_ap_queue_maybecopyfiles); err != nil {
-			break
-		}
-		for _, e := range sys_devices_ap_queue_fileswithvalue {
-			if err = makefile(shadowqueuedir+"/"+e.name, e.value); err != nil {
+		for _, a := range apqns {
+			if err = makequeue(shadowapbusdir, shadowapdevsdir, a.Adapter, a.Domain); err != nil {
 				break
 			}
 		}
 		if err != nil {
 			break
 		}
-		if err = makelink(shadowqueuedir+"/driver", "../../../../bus/ap/drivers/cex4queue"); err != nil {
-			break
-		}
-		if err = makelink(shadowqueuedir+"/subsystem", "../../../../bus/ap"); err != nil {
-			break
-		}
-
-		// shadow sys/bus/ap/devices
-		shadowapdevicesdir := shadowapbusdir + "/devices"
-		if err = makedir(shadowapdevicesdir); err != nil {
-			break
-		}
-		// card link
-		linksrc := fmt.Sprintf("%s/%s", shadowapdevicesdir, carddir)
-		linkdst := fmt.Sprintf("../../../devices/ap/%s", carddir)
-		if err = makelink(linksrc, linkdst); err != nil {
-			break
-		}
-		// queue link
-		linksrc = fmt.Sprintf("%s/%s", shadowapdevicesdir, queuedir)
-		linkdst = fmt.Sprintf("../../../devices/ap/%s/%s", carddir, queuedir)
-		if err = makelink(linksrc, linkdst); err != nil {
-			break
-		}
-
-		// shadow sys/bus/ap/drivers
-		if err = makedir(shadowapbusdir + "/drivers"); err != nil {
-			break
-		}
-		if err = makedir(shadowapbusdir + "/drivers/cex4card"); err != nil {
-			break
-		}
-		linksrc = fmt.Sprintf("%s/drivers/cex4card/%s", shadowapbusdir, carddir)
-		linkdst = fmt.Sprintf("../../../../devices/ap/%s", carddir)
-		if err = makelink(linksrc, linkdst); err != nil {
-			break
-		}
-		if err = makedir(shadowapbusdir + "/drivers/cex4queue"); err != nil {
-			break
-		}
-		linksrc = fmt.Sprintf("%s/drivers/cex4queue/%s", shadowapbusdir, queuedir)
-		linkdst = fmt.Sprintf("../../../../devices/ap/%s/%s", carddir, queuedir)
-		if err = makelink(linksrc, linkdst); err != nil {
-			break
-		}
 
 		// all good, return with the values of the two shadow dirs which are to
 		// be used as /sys/bus/ap and /sys/devices/ap within the container
@@ -434,7 +467,7 @@ func delShadowSysfs(shadowdir string) {
 	os.RemoveAll(dir)
 }
 
-func addLiveMounts(id string, carsp *kdp.ContainerAllocateResponse, card, queue int) error {
+func addLiveMounts(id string, carsp *kdp.ContainerAllocateResponse, apqns APQNList) error {
 
 	makelink := func(src, dst string) error {
 		//fmt.Printf("debug: makelink(%s,%s)\n", src, dst)
@@ -447,27 +480,30 @@ func addLiveMounts(id string, carsp *kdp.ContainerAllocateResponse, card, queue
 	}
 
 	shadowdir := fmt.Sprintf("%s/sysfs-%s", shadowbasedir, id)
-	apcarddir := fmt.Sprintf("%s/card%02x", apdevsdir, card)
-	apqueuedir := fmt.Sprintf("%s/%02x.%04x", apcarddir, card, queue)
-
-	// Create symlink from original ap queue dir to tmp_bus dir in shadowsysfs
-	linkdst := fmt.Sprintf("%s", apqueuedir)
-	linksrc := fmt.Sprintf("%s/tmp_bus", shadowdir)
-	if err := makelink(linksrc, linkdst); err != nil {
-		log.Printf("Shadowsysfs: Error makelink: %s --> %s\n", linkdst, linksrc)
-		return fmt.Errorf("Shadowsysfs: Failed to create directory symlink from %s to %s/tmp_bus", apqueuedir, shadowdir)
-	}
 
-	// Over-mount container dir with tmp_bus dir in shadowsysfs
-	container_path := fmt.Sprintf("%s/devices/%02x.%04x", apbusdir, card, queue)
-	host_path := fmt.Sprintf("%s/tmp_bus", shadowdir)
-	carsp.Mounts = append(carsp.Mounts, &kdp.Mount{
-		ContainerPath: container_path,
-		HostPath:      host_path,
-		ReadOnly:      true})
+	for _, a := range apqns {
+		queuedir := fmt.Sprintf("%02x.%04x", a.Adapter, a.Domain)
+		apcarddir := fmt.Sprintf("%s/card%02x", apdevsdir, a.Adapter)
+		apqueuedir := fmt.Sprintf("%s/%s", apcarddir, queuedir)
 
-	log.Printf("Shadowsysfs: Container has now live access to host's %s.\n", apqueuedir)
-	log.Printf("Shadowsysfs: Files in %s are symlinked to %s.\n", apcarddir, apqueuedir)
+		// Create symlink from original ap queue dir to tmp_bus dir in shadowsysfs
+		linkdst := apqueuedir
+		linksrc := fmt.Sprintf("%s/tmp_bus_%s", shadowdir, queuedir)
+		if err := makelink(linksrc, linkdst); err != nil {
+			log.Printf("Shadowsysfs: Error makelink: %s --> %s\n", linkdst, linksrc)
+			return fmt.Errorf("Shadowsysfs: Failed to create directory symlink from %s to %s", apqueuedir, linksrc)
+		}
+
+		// Over-mount container dir with tmp_bus dir in shadowsysfs
+		container_path := fmt.Sprintf("%s/devices/%s", apbusdir, queuedir)
+		carsp.Mounts = append(carsp.Mounts, &kdp.Mount{
+			ContainerPath: container_path,
+			HostPath:      linksrc,
+			ReadOnly:      true})
+
+		log.Printf("Shadowsysfs: Container has now live access to host's %s.\n", apqueuedir)
+		log.Printf("Shadowsysfs: Files in %s are symlinked to %s.\n", apcarddir, apqueuedir)
+	}
 
 	return nil
 }
@@ -0,0 +1,160 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * remediation policies for containers using CEX resources from a foreign namespace
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The policies are ordered, each policy includes the actions of the
+// policies before. So evict-pod also destroys the zcrypt node, which
+// revokes the access to the CEX resources immediately, even when the
+// eviction is refused or delayed by a pod disruption budget.
+const (
+	ViolationPolicyLog         = "log"          // only log the violation (default)
+	ViolationPolicyEvent       = "event"        // log and emit a warning event for the pod
+	ViolationPolicyDestroyNode = "destroy-node" // additionally destroy the zcrypt node of the container
+	ViolationPolicyEvictPod    = "evict-pod"    // additionally evict the pod via the eviction API
+)
+
+var violationPolicyLevel = map[string]int{
+	ViolationPolicyLog:         0,
+	ViolationPolicyEvent:       1,
+	ViolationPolicyDestroyNode: 2,
+	ViolationPolicyEvictPod:    3,
+}
+
+// the remediation actions for a container are repeated at most every ViolationActionInterval s
+var ViolationActionInterval = int64(getenvint("VIOLATION_ACTION_INTERVAL", 300, 30, 3600))
+
+// containers with a violation with the timestamp of the last remediation
+var violationsmap = map[string]time.Time{}
+
+// the remediation actions, tests may replace them
+var (
+	violationRecordEvent = kubeRecordEvent
+	violationNodeExists  = zcryptNodeExists
+	violationDestroyNode = zcryptDestroyNode
+	violationEvictPod    = kubeEvictPod
+)
+
+// result of the check of a container's namespace against a config set,
+// ordered so that the worst result of all the devices of a container wins
+type nsCheck int
+
+const (
+	nsCheckAllowed   nsCheck = iota // the namespace may use the config set
+	nsCheckUnknown                  // the namespaceselector could not be evaluated
+	nsCheckViolation                // the namespace may not use the config set
+)
+
+// checkNamespace checks if the namespace may use the config set. When
+// the labels of the namespace can't be looked up the result is unknown
+// and the error is returned.
+func checkNamespace(ccset *CryptoConfigSet, namespace string) (nsCheck, error) {
+
+	allowed, err := ccset.AllowsNamespace(namespace)
+	if err != nil {
+		return nsCheckUnknown, err
+	}
+	if !allowed {
+		return nsCheckViolation, nil
+	}
+
+	return nsCheckAllowed, nil
+}
+
+// handleViolation runs the remediation actions of the config set's
+// violation policy for a container using CEX resources of this set
+// from a namespace which is not allowed to use the set. If the check
+// of the namespace failed, the container is only logged, as removing
+// the access on an api server hiccup would hit legitimate workloads.
+func (pl *PodLister) handleViolation(ccset *CryptoConfigSet, check nsCheck, namespace, podname, container, znname string, devs []string) {
+
+	if check == nsCheckAllowed {
+		return
+	}
+	policy := ccset.ViolationPolicy
+	if len(policy) == 0 {
+		policy = ViolationPolicyLog
+	}
+	level := violationPolicyLevel[policy]
+	if level == 0 {
+		return
+	}
+	if check == nsCheckUnknown {
+		log.Printf("PodLister: Namespace of container '%s' of pod '%s/%s' can't be checked against config set '%s', violation policy '%s' skipped\n",
+			container, namespace, podname, ccset.SetName, policy)
+		return
+	}
+
+	key := namespace + "/" + podname + "/" + container
+	last, found := violationsmap[key]
+	if found && time.Since(last).Milliseconds()/1000 < ViolationActionInterval {
+		return
+	}
+	violationsmap[key] = time.Now()
+
+	msg := fmt.Sprintf("Container '%s' uses CEX resources of config set '%s' which is not allowed for namespace '%s'",
+		container, ccset.SetName, namespace)
+	log.Printf("PodLister: Violation policy '%s' for container '%s' of pod '%s/%s'\n",
+		policy, container, namespace, podname)
+
+	violationRecordEvent(&corev1.ObjectReference{
+		Kind:       "Pod",
+		APIVersion: "v1",
+		Namespace:  namespace,
+		Name:       podname,
+	}, corev1.EventTypeWarning, "CEXNamespaceViolation", msg)
+
+	if level >= violationPolicyLevel[ViolationPolicyDestroyNode] {
+		if violationNodeExists(znname) {
+			log.Printf("PodLister: deleting zcrypt node '%s': used from foreign namespace '%s'\n",
+				znname, namespace)
+			pl.tellMetricsCollAboutDestroyNode(znname, devs)
+			if err := violationDestroyNode(znname); err == nil {
+				delete(zcryptnodemap, znname)
+			}
+		}
+	}
+
+	if level >= violationPolicyLevel[ViolationPolicyEvictPod] {
+		if err := violationEvictPod(namespace, podname); err != nil {
+			log.Printf("PodLister: %s\n", err)
+		} else {
+			log.Printf("PodLister: Pod '%s/%s' evicted\n", namespace, podname)
+		}
+	}
+}
+
+// purgeViolations removes the entries of containers where the
+// last remediation is older than twice the action interval
+func purgeViolations() {
+
+	for key, last := range violationsmap {
+		if time.Since(last).Milliseconds()/1000 > 2*ViolationActionInterval {
+			delete(violationsmap, key)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * remediation policies for containers using CEX resources from a foreign namespace
+ */
+
+// run with
+// $ go test -run Violation
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHandleViolation(t *testing.T) {
+	savedlookup, savedmap := namespaceLabels, violationsmap
+	savedevent, savedexists, saveddestroy, savedevict := violationRecordEvent, violationNodeExists, violationDestroyNode, violationEvictPod
+	defer func() {
+		namespaceLabels, violationsmap = savedlookup, savedmap
+		violationRecordEvent, violationNodeExists, violationDestroyNode, violationEvictPod = savedevent, savedexists, saveddestroy, savedevict
+	}()
+
+	var events, destroyed, evicted int
+	violationRecordEvent = func(ref *corev1.ObjectReference, eventtype, reason, message string) { events++ }
+	violationNodeExists = func(nodename string) bool { return true }
+	violationDestroyNode = func(nodename string) error { destroyed++; return nil }
+	violationEvictPod = func(namespace, name string) error { evicted++; return nil }
+	namespaceLabels = func(namespace string) (map[string]string, error) {
+		switch namespace {
+		case "team-a":
+			return map[string]string{"team": "ep11"}, nil
+		case "team-b":
+			return map[string]string{"team": "cca"}, nil
+		}
+		return nil, fmt.Errorf("namespace '%s' not found", namespace)
+	}
+
+	var tests = []struct {
+		policy    string
+		namespace string
+		check     nsCheck
+		events    int
+		destroyed int
+		evicted   int
+	}{
+		{"", "team-b", nsCheckViolation, 0, 0, 0},
+		{ViolationPolicyLog, "team-b", nsCheckViolation, 0, 0, 0},
+		{ViolationPolicyEvent, "team-b", nsCheckViolation, 1, 0, 0},
+		{ViolationPolicyDestroyNode, "team-b", nsCheckViolation, 1, 1, 0},
+		{ViolationPolicyEvictPod, "team-b", nsCheckViolation, 1, 1, 1},
+		{ViolationPolicyEvictPod, "team-a", nsCheckAllowed, 0, 0, 0},
+		// the namespace labels lookup fails, only log
+		{ViolationPolicyLog, "team-c", nsCheckUnknown, 0, 0, 0},
+		{ViolationPolicyEvent, "team-c", nsCheckUnknown, 0, 0, 0},
+		{ViolationPolicyDestroyNode, "team-c", nsCheckUnknown, 0, 0, 0},
+		{ViolationPolicyEvictPod, "team-c", nsCheckUnknown, 0, 0, 0},
+	}
+	pl := &PodLister{}
+	for _, test := range tests {
+		ccset := &CryptoConfigSet{
+			SetName:         "set",
+			Project:         "p1",
+			ViolationPolicy: test.policy,
+			NsSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"team": "ep11"},
+			},
+		}
+		check, _ := checkNamespace(ccset, test.namespace)
+		if check != test.check {
+			t.Errorf(`checkNamespace for policy "%s" namespace "%s" returned %d, expected %d`,
+				test.policy, test.namespace, check, test.check)
+		}
+		violationsmap = map[string]time.Time{}
+		events, destroyed, evicted = 0, 0, 0
+		// the second call is within the action interval and does nothing
+		for i := 0; i < 2; i++ {
+			pl.handleViolation(ccset, check, test.namespace, "pod", "container", "zcrypt-apqn-1-2-0", []string{"apqn-1-2-0"})
+		}
+		if events != test.events || destroyed != test.destroyed || evicted != test.evicted {
+			t.Errorf(`handleViolation for policy "%s" namespace "%s" did %d events, %d node destroys, %d evictions, expected %d, %d, %d`,
+				test.policy, test.namespace, events, destroyed, evicted, test.events, test.destroyed, test.evicted)
+		}
+	}
+}
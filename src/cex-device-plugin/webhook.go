@@ -0,0 +1,281 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * validating admission webhook server
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	webhookMaxBodySize = 4 * 1024 * 1024 // config maps are limited to 1MiB
+)
+
+var (
+	webhookPort    = getenvint("WEBHOOK_PORT", 8443, 1, 65535)
+	webhookTLSCert = getenvstr("WEBHOOK_TLS_CERT", "/tls/tls.crt")
+	webhookTLSKey  = getenvstr("WEBHOOK_TLS_KEY", "/tls/tls.key")
+)
+
+// a webhook validation function returns if the request is allowed
+// and if not, a message with the reason
+type webhookValidateFunc func(req *admissionv1.AdmissionRequest) (bool, string)
+
+// the certificate is re-read when the files change, as for example
+// the OpenShift service CA operator rotates the serving certificate
+type webhookCert_s struct {
+	sync.Mutex
+	certfile string
+	keyfile  string
+	modtime  time.Time
+	cert     *tls.Certificate
+}
+
+func (c *webhookCert_s) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	fi, err := os.Stat(c.certfile)
+	if err != nil {
+		return nil, fmt.Errorf("Webhook: Can't stat certificate file '%s': %w", c.certfile, err)
+	}
+	if c.cert != nil && fi.ModTime().Equal(c.modtime) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certfile, c.keyfile)
+	if err != nil {
+		log.Printf("Webhook: Can't load certificate and key: %s\n", err)
+		return nil, fmt.Errorf("Webhook: Can't load certificate and key: %w", err)
+	}
+	log.Printf("Webhook: Certificate loaded from '%s'\n", c.certfile)
+	c.cert, c.modtime = &cert, fi.ModTime()
+
+	return c.cert, nil
+}
+
+// webhookMain runs the validating admission webhook server
+func webhookMain(args []string) int {
+
+	fs := flag.NewFlagSet("webhook", flag.ContinueOnError)
+	portarg := fs.Int("port", webhookPort, "https listen port")
+	certarg := fs.String("tls-cert", webhookTLSCert, "TLS certificate file")
+	keyarg := fs.String("tls-key", webhookTLSKey, "TLS private key file")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s webhook [options]\n", cexctlName)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	log.Println("Webhook: S390 k8s z crypto resources validating admission webhook starting")
+	log.Printf("Webhook: Version: %s\n", version)
+
+	cert := &webhookCert_s{certfile: *certarg, keyfile: *keyarg}
+	if _, err := cert.get(nil); err != nil {
+		log.Printf("Webhook: %s\n", err)
+		return 1
+	}
+
+	// the pod validation needs the current crypto config, the config map
+	// validation works without, so don't give up if there is none yet
+	go func() {
+		for {
+			_, err := InitializeConfigWatcher()
+			if err == nil {
+				return
+			}
+			log.Printf("Webhook: Reading crypto configuration failed: %s\n", err)
+			time.Sleep(Cccheckinterval * time.Second)
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate-configmap", webhookHandler(webhookValidateConfigMap))
+	mux.HandleFunc("/validate-pod", webhookHandler(webhookValidatePod))
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", *portarg),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: cert.get,
+		},
+	}
+	log.Printf("Webhook: Listening on port %d\n", *portarg)
+	err := server.ListenAndServeTLS("", "")
+	log.Printf("Webhook: https server error: %s\n", err)
+
+	return 1
+}
+
+// webhookHandler decodes the AdmissionReview request, runs the
+// validation function and sends back the AdmissionReview response
+func webhookHandler(validate webhookValidateFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST supported", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, webhookMaxBodySize))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error reading request: %s", err), http.StatusBadRequest)
+			return
+		}
+		var review admissionv1.AdmissionReview
+		if err = json.Unmarshal(body, &review); err != nil || review.Request == nil {
+			log.Printf("Webhook: Invalid AdmissionReview request on %s\n", r.URL.Path)
+			http.Error(w, "invalid AdmissionReview request", http.StatusBadRequest)
+			return
+		}
+
+		allowed, msg := validate(review.Request)
+		review.Response = &admissionv1.AdmissionResponse{
+			UID:     review.Request.UID,
+			Allowed: allowed,
+		}
+		if !allowed {
+			log.Printf("Webhook: %s %s '%s/%s' denied: %s\n", review.Request.Operation,
+				review.Request.Kind.Kind, review.Request.Namespace, review.Request.Name, msg)
+			review.Response.Result = &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Code:    http.StatusForbidden,
+				Reason:  metav1.StatusReasonForbidden,
+				Message: msg,
+			}
+		}
+		review.Request = nil
+
+		resp, err := json.Marshal(&review)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error encoding response: %s", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(resp)
+	}
+}
+
+// webhookValidateConfigMap verifies the crypto config of the cex resources
+// config map, all other config maps are allowed
+func webhookValidateConfigMap(req *admissionv1.AdmissionRequest) (bool, string) {
+
+	if req.Kind.Kind != "ConfigMap" || req.Operation == admissionv1.Delete {
+		return true, ""
+	}
+	var cm corev1.ConfigMap
+	if err := json.Unmarshal(req.Object.Raw, &cm); err != nil {
+		return false, fmt.Sprintf("error decoding ConfigMap: %s", err)
+	}
+	if cm.Name != ccConfigMapName {
+		return true, ""
+	}
+
+	file := filepath.Base(ccsfile)
+	data, found := cm.Data[file]
+	if !found {
+		return false, fmt.Sprintf("ConfigMap %s has no %s entry", cm.Name, file)
+	}
+	newcc, err := ccParseConfig([]byte(data))
+	if err != nil {
+		return false, fmt.Sprintf("error parsing %s: %s", file, err)
+	}
+	errs := newcc.Verify()
+	if len(errs) > 0 {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s verification failed with %d errors:", file, len(errs))
+		for _, e := range errs {
+			fmt.Fprintf(&b, "\n%s", e)
+		}
+		return false, b.String()
+	}
+
+	return true, ""
+}
+
+// webhookValidatePod denies pods which request CEX resources of a config
+// set from a namespace which is not allowed to use this config set
+func webhookValidatePod(req *admissionv1.AdmissionRequest) (bool, string) {
+
+	if req.Kind.Kind != "Pod" || req.Operation == admissionv1.Delete {
+		return true, ""
+	}
+	var pod corev1.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		return false, fmt.Sprintf("error decoding Pod: %s", err)
+	}
+	// on create the namespace is not always filled in the pod object
+	namespace := req.Namespace
+	if len(namespace) == 0 {
+		namespace = pod.Namespace
+	}
+
+	cc := GetCurrentCryptoConfig()
+	var containers []corev1.Container
+	containers = append(containers, pod.Spec.InitContainers...)
+	containers = append(containers, pod.Spec.Containers...)
+	for _, c := range containers {
+		resources := []corev1.ResourceList{c.Resources.Limits, c.Resources.Requests}
+		for _, rl := range resources {
+			for name := range rl {
+				setname, found := strings.CutPrefix(string(name), baseResourceName+"/")
+				if !found {
+					continue
+				}
+				if cc == nil {
+					return false, fmt.Sprintf("container '%s' requests %s but the crypto config is not loaded yet",
+						c.Name, name)
+				}
+				ccset := cc.GetCryptoConfigSet(setname)
+				if ccset == nil {
+					return false, fmt.Sprintf("container '%s' requests %s but there is no CryptoConfigSet '%s'",
+						c.Name, name, setname)
+				}
+				allowed, err := ccset.AllowsNamespace(namespace)
+				if err != nil {
+					return false, fmt.Sprintf("container '%s' requests %s but namespace '%s' can't be checked against CryptoConfigSet '%s': %s",
+						c.Name, name, namespace, setname, err)
+				}
+				if !allowed {
+					return false, fmt.Sprintf("container '%s' requests %s but namespace '%s' is not allowed to use CryptoConfigSet '%s'",
+						c.Name, name, namespace, setname)
+				}
+			}
+		}
+	}
+
+	return true, ""
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * s390 zcrypt kubernetes device plugin
+ * validation of config maps and pods by the admission webhook
+ */
+
+// run with
+// $ go test -run Webhook
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var resource1 = resource.MustParse("1")
+
+func webhookTestRequest(t *testing.T, op admissionv1.Operation, name string, data map[string]string) *admissionv1.AdmissionRequest {
+	cm := corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "cex-device-plugin",
+		},
+		Data: data,
+	}
+	raw, err := json.Marshal(&cm)
+	if err != nil {
+		t.Fatalf(`ConfigMap marshal failed: %s`, err)
+	}
+	return &admissionv1.AdmissionRequest{
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+		Operation: op,
+		Name:      name,
+		Namespace: "cex-device-plugin",
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+}
+
+func TestWebhookValidateConfigMap(t *testing.T) {
+	const valid = `{"cryptoconfigsets": [{"setname": "set1", "project": "p1", "apqns": [{"adapter": 1, "domain": 1}]}]}`
+	const dupapqn = `{"cryptoconfigsets": [
+		{"setname": "set1", "project": "p1", "apqns": [{"adapter": 1, "domain": 1}]},
+		{"setname": "set2", "project": "p2", "apqns": [{"adapter": 1, "domain": 1}]}]}`
+	const badsetname = `{"cryptoconfigsets": [{"setname": "set 1", "project": "p1", "mincexgen": "cex3"}]}`
+
+	var tests = []struct {
+		name string
+		op   admissionv1.Operation
+		cm   string
+		data map[string]string
+		want bool
+	}{
+		{"valid config", admissionv1.Update, ccConfigMapName, map[string]string{"cex_resources.json": valid}, true},
+		{"duplicate apqn", admissionv1.Update, ccConfigMapName, map[string]string{"cex_resources.json": dupapqn}, false},
+		{"invalid setname and mincexgen", admissionv1.Create, ccConfigMapName, map[string]string{"cex_resources.json": badsetname}, false},
+		{"invalid json", admissionv1.Create, ccConfigMapName, map[string]string{"cex_resources.json": "{"}, false},
+		{"missing file", admissionv1.Create, ccConfigMapName, map[string]string{"foo": valid}, false},
+		{"other config map", admissionv1.Update, "other", map[string]string{"cex_resources.json": "{"}, true},
+		{"delete", admissionv1.Delete, ccConfigMapName, nil, true},
+	}
+	for _, test := range tests {
+		allowed, msg := webhookValidateConfigMap(webhookTestRequest(t, test.op, test.cm, test.data))
+		if allowed != test.want {
+			t.Errorf(`webhookValidateConfigMap for "%s" returned %v (%s)`, test.name, allowed, msg)
+		}
+	}
+}
+
+func TestWebhookValidatePod(t *testing.T) {
+	mu.Lock()
+	savedcc := cc
+	cc = &CryptoConfig{
+		CryptoConfigSets: []*CryptoConfigSet{
+			&CryptoConfigSet{
+				SetName: "set1",
+				Project: "p1",
+			},
+		},
+	}
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		cc = savedcc
+		mu.Unlock()
+	}()
+
+	podwith := func(resource string) []byte {
+		pod := corev1.Pod{
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					corev1.Container{
+						Name: "c1",
+						Resources: corev1.ResourceRequirements{
+							Limits: corev1.ResourceList{
+								corev1.ResourceName(resource): resource1,
+							},
+						},
+					},
+				},
+			},
+		}
+		raw, err := json.Marshal(&pod)
+		if err != nil {
+			t.Fatalf(`Pod marshal failed: %s`, err)
+		}
+		return raw
+	}
+
+	var tests = []struct {
+		name      string
+		namespace string
+		resource  string
+		want      bool
+	}{
+		{"allowed namespace", "p1", "cex.s390.ibm.com/set1", true},
+		{"wrong namespace", "p2", "cex.s390.ibm.com/set1", false},
+		{"unknown set", "p1", "cex.s390.ibm.com/set2", false},
+		{"no cex resource", "p2", "cpu", true},
+	}
+	for _, test := range tests {
+		req := &admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Operation: admissionv1.Create,
+			Namespace: test.namespace,
+			Object:    runtime.RawExtension{Raw: podwith(test.resource)},
+		}
+		if allowed, msg := webhookValidatePod(req); allowed != test.want {
+			t.Errorf(`webhookValidatePod for "%s" returned %v (%s)`, test.name, allowed, msg)
+		}
+	}
+
+	// without a crypto config only pods without CEX resources are allowed
+	mu.Lock()
+	cc = nil
+	mu.Unlock()
+	for _, resource := range []string{"cex.s390.ibm.com/set1", "cpu"} {
+		req := &admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Operation: admissionv1.Create,
+			Namespace: "p1",
+			Object:    runtime.RawExtension{Raw: podwith(resource)},
+		}
+		allowed, msg := webhookValidatePod(req)
+		if resource == "cpu" && !allowed {
+			t.Errorf(`webhookValidatePod without crypto config denied a pod without CEX resources (%s)`, msg)
+		}
+		if resource != "cpu" && (allowed || !strings.Contains(msg, "crypto config is not loaded yet")) {
+			t.Errorf(`webhookValidatePod without crypto config returned %v (%s)`, allowed, msg)
+		}
+	}
+}
@@ -30,12 +30,31 @@ import (
 	"time"
 )
 
-const (
-	zcryptvdevdir      = "/sys/devices/virtual/zcrypt"
-	zcryptnodefilemode = 0666
-)
+const zcryptnodefilemode = 0666
 
 var zcryptclassdir = getenvstr("ZCRYPT_CLASSDIR", "/sys/class/zcrypt")
+var zcryptvdevdir = getenvstr("ZCRYPT_VDEVDIR", "/sys/devices/virtual/zcrypt")
+var zcryptdevdir = getenvstr("ZCRYPT_DEVDIR", "/dev")
+
+// zcrypt ioctl names and their ioctl numbers (_IOC_NR) from the
+// kernel's asm/zcrypt.h as used as bit index in the ioctlmask
+var zcryptIoctlNumbers = map[string]int{
+	"ZSENDEP11CPRB":           0x04,
+	"ICARSAMODEXPO":           0x05,
+	"ICARSACRT":               0x06,
+	"Z90STAT_REQUESTQ_COUNT":  0x44,
+	"Z90STAT_PENDINGQ_COUNT":  0x45,
+	"Z90STAT_TOTALOPEN_COUNT": 0x46,
+	"Z90STAT_DOMAIN_INDEX":    0x47,
+	"Z90STAT_STATUS_MASK":     0x48,
+	"Z90STAT_QDEPTH_MASK":     0x49,
+	"Z90STAT_PERDEV_REQCNT":   0x4a,
+	"ZCRYPT_STATUS_MASK":      0x58,
+	"ZCRYPT_QDEPTH_MASK":      0x59,
+	"ZCRYPT_PERDEV_REQCNT":    0x5a,
+	"ZCRYPT_DEVICE_STATUS":    0x5f,
+	"ZSECSENDCPRB":            0x81,
+}
 
 func zcryptHasNodesSupport() bool {
 
@@ -101,7 +120,7 @@ func zcryptCreateNode(nodename string) error {
 	f.Close()
 
 	// wait until the device node file in /dev is created via udev
-	devname := "/dev/" + nodename
+	devname := zcryptdevdir + "/" + nodename
 	ok := false
 	for w := 25; !ok && w <= 3200; w *= 2 {
 		_, err := os.Stat(devname)
@@ -236,29 +255,82 @@ func zcryptAddIoctlsToNode(nodename string, ioctls ...int) error {
 	return nil
 }
 
-func zcryptCreateSimpleNode(nodename string, adapter, domain int) error {
+func zcryptCreateSimpleNode(nodename string, adapters, domains, ioctls []int) error {
 
 	if err := zcryptCreateNode(nodename); err != nil {
 		return fmt.Errorf("Zcrypt: zcryptCreateNode('%s') failed: %w", nodename, err)
 	}
 
-	if err := zcryptAddAdaptersToNode(nodename, adapter); err != nil {
+	if err := zcryptAddAdaptersToNode(nodename, adapters...); err != nil {
 		return fmt.Errorf("Zcrypt: zcryptAddAdaptersToNode('%s') failed: %w", nodename, err)
 	}
 
-	if err := zcryptAddDomainsToNode(nodename, domain); err != nil {
+	if err := zcryptAddDomainsToNode(nodename, domains...); err != nil {
 		return fmt.Errorf("Zcrypt: zcryptAddDomainsToNode('%s') failed: %w", nodename, err)
 	}
 
-	if err := zcryptAddIoctlsToNode(nodename); err != nil {
+	if err := zcryptAddIoctlsToNode(nodename, ioctls...); err != nil {
 		return fmt.Errorf("Zcrypt: zcryptAddIoctlsToNode('%s') failed: %w", nodename, err)
 	}
 
-	log.Printf("Zcrypt: simple node '%s' for APQN(%d,%d) created\n", nodename, adapter, domain)
+	if len(ioctls) > 0 {
+		log.Printf("Zcrypt: simple node '%s' for adapters %v and domains %v and ioctls %v created\n",
+			nodename, adapters, domains, ioctls)
+	} else {
+		log.Printf("Zcrypt: simple node '%s' for adapters %v and domains %v created\n", nodename, adapters, domains)
+	}
 
 	return nil
 }
 
+func zcryptMaskString(bits ...int) string {
+
+	var mask [32]byte
+	for _, bit := range bits {
+		mask[bit/8] |= 0x80 >> (bit % 8)
+	}
+	var b strings.Builder
+	b.Grow(2 + 32*2)
+	b.WriteString("0x")
+	for i := 0; i < len(mask); i++ {
+		fmt.Fprintf(&b, "%02x", mask[i])
+	}
+
+	return b.String()
+}
+
+func zcryptNodeMatches(nodename string, adapters, domains, ioctls []int) bool {
+
+	// compare the masks of an existing node with the given adapters, domains and ioctls
+	nodedir := zcryptvdevdir + "/" + nodename
+	apmask, err := apReadFirstLineFromFile(nodedir + "/" + "apmask")
+	if err != nil {
+		log.Printf("Zcrypt: Error reading apmask of node '%s': %s\n", nodename, err)
+		return false
+	}
+	aqmask, err := apReadFirstLineFromFile(nodedir + "/" + "aqmask")
+	if err != nil {
+		log.Printf("Zcrypt: Error reading aqmask of node '%s': %s\n", nodename, err)
+		return false
+	}
+	ioctlmask, err := apReadFirstLineFromFile(nodedir + "/" + "ioctlmask")
+	if err != nil {
+		log.Printf("Zcrypt: Error reading ioctlmask of node '%s': %s\n", nodename, err)
+		return false
+	}
+	if len(ioctls) == 0 {
+		// no ioctls given means all
+		ioctls = make([]int, 0, 256)
+		for i := 0; i < 256; i++ {
+			ioctls = append(ioctls, i)
+		}
+	}
+
+	return apmask == zcryptMaskString(adapters...) &&
+		aqmask == zcryptMaskString(domains...) &&
+		ioctlmask == zcryptMaskString(ioctls...)
+}
+
 func zcryptFetchActiveNodes() ([]string, error) {
 
 	var nodes []string
@@ -0,0 +1,244 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Prometheus exporter for the s390 zcrypt kubernetes device plugin
+ * Authentication of the cex plugin apps pushing metrics data
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kubeNodeNameExtra    = "authentication.kubernetes.io/node-name"
+	tokenReviewCacheTime = 60 * time.Second
+)
+
+var (
+	// dir with tls.crt, tls.key and ca.crt, the collector requires client
+	// certificates signed by the ca.crt, mTLS is disabled if empty
+	collTLSDir = getenvstr("COLLECTOR_TLS_DIR", "")
+	// review the service account token sent by the cex plugin apps
+	collTokenReview   = getenvint("COLLECTOR_TOKEN_REVIEW", 0, 0) > 0
+	collTokenAudience = getenvstr("COLLECTOR_TOKEN_AUDIENCE", "cex-prometheus-exporter")
+	collAllowedSA     = getenvstr("COLLECTOR_ALLOWED_SERVICEACCOUNT", "system:serviceaccount:cex-device-plugin:cex-plugin-sa")
+)
+
+// tlsfiles_s loads the collector certificate, key and the client ca
+// again when the files have been updated (like a rotated Secret)
+type tlsfiles_s struct {
+	mutex   sync.Mutex
+	dir     string
+	modtime time.Time
+	config  *tls.Config
+}
+
+var colltlsfiles = &tlsfiles_s{}
+
+func (tf *tlsfiles_s) load() (*tls.Config, error) {
+
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+
+	certfile, keyfile, cafile := tf.dir+"/tls.crt", tf.dir+"/tls.key", tf.dir+"/ca.crt"
+	var modtime time.Time
+	for _, f := range []string{certfile, keyfile, cafile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, fmt.Errorf("Auth: Can't access TLS file: %w", err)
+		}
+		if fi.ModTime().After(modtime) {
+			modtime = fi.ModTime()
+		}
+	}
+	if tf.config != nil && modtime.Equal(tf.modtime) {
+		return tf.config, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return nil, fmt.Errorf("Auth: Can't load collector certificate: %w", err)
+	}
+	capem, err := os.ReadFile(cafile)
+	if err != nil {
+		return nil, fmt.Errorf("Auth: Can't read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(capem) {
+		return nil, fmt.Errorf("Auth: No certificate found in client CA file %s", cafile)
+	}
+	tf.config = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	tf.modtime = modtime
+	log.Printf("Auth: TLS files loaded from %s\n", tf.dir)
+
+	return tf.config, nil
+}
+
+// collTLSListener wraps the listener with mTLS if enabled
+func collTLSListener(li net.Listener) (net.Listener, error) {
+
+	if len(collTLSDir) == 0 {
+		log.Printf("Auth: mTLS disabled, any client may push metrics data\n")
+		return li, nil
+	}
+	colltlsfiles.dir = collTLSDir
+	if _, err := colltlsfiles.load(); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return colltlsfiles.load()
+		},
+	}
+	log.Printf("Auth: mTLS enabled, client certificates required\n")
+
+	return tls.NewListener(li, config), nil
+}
+
+type tokenreview_s struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Token     string   `json:"token"`
+		Audiences []string `json:"audiences,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Authenticated bool `json:"authenticated"`
+		User          struct {
+			Username string              `json:"username"`
+			Extra    map[string][]string `json:"extra,omitempty"`
+		} `json:"user"`
+		Error string `json:"error,omitempty"`
+	} `json:"status"`
+}
+
+type tokenreview_entry_s struct {
+	review  *tokenreview_s
+	expires time.Time
+}
+
+var (
+	tokenreviews      = map[string]*tokenreview_entry_s{}
+	tokenreviewsmutex sync.Mutex
+)
+
+// reviewTokenFunc is the token review function, tests may replace it
+var reviewTokenFunc = reviewToken
+
+// reviewToken asks the kubernetes api server to review the service
+// account token, the results are cached for tokenReviewCacheTime
+func reviewToken(token string) (*tokenreview_s, error) {
+
+	tokenreviewsmutex.Lock()
+	now := time.Now()
+	for t, e := range tokenreviews {
+		if now.After(e.expires) {
+			delete(tokenreviews, t)
+		}
+	}
+	e, found := tokenreviews[token]
+	tokenreviewsmutex.Unlock()
+	if found {
+		return e.review, nil
+	}
+
+	// don't hold the lock across the api server request, concurrent
+	// pushes with the same token just review it twice
+
+	req := &tokenreview_s{APIVersion: "authentication.k8s.io/v1", Kind: "TokenReview"}
+	req.Spec.Token = token
+	if len(collTokenAudience) > 0 {
+		req.Spec.Audiences = []string{collTokenAudience}
+	}
+	review := &tokenreview_s{}
+	err := kubeAPIRequest(http.MethodPost, "/apis/authentication.k8s.io/v1/tokenreviews", req, review)
+	if err != nil {
+		return nil, fmt.Errorf("Auth: TokenReview failed: %w", err)
+	}
+	tokenreviewsmutex.Lock()
+	tokenreviews[token] = &tokenreview_entry_s{review: review, expires: now.Add(tokenReviewCacheTime)}
+	tokenreviewsmutex.Unlock()
+
+	return review, nil
+}
+
+// collAuthenticate checks the client certificate and the service account
+// token of a push for the given node. It returns the authenticated node
+// name or an empty string if neither mTLS nor the token review is enabled,
+// on failure the http status code and the reason.
+func collAuthenticate(r *http.Request, nodename string) (string, int, error) {
+
+	identity := ""
+
+	if len(collTLSDir) > 0 {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return "", http.StatusUnauthorized, errors.New("client certificate required")
+		}
+		cert := r.TLS.PeerCertificates[0]
+		if cert.Subject.CommonName != nodename && cert.VerifyHostname(nodename) != nil {
+			return "", http.StatusForbidden, fmt.Errorf("client certificate '%s' not valid for node '%s'",
+				cert.Subject.CommonName, nodename)
+		}
+		identity = nodename
+	}
+
+	if collTokenReview {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || len(token) == 0 {
+			return "", http.StatusUnauthorized, errors.New("service account token required")
+		}
+		review, err := reviewTokenFunc(token)
+		if err != nil {
+			log.Printf("%s\n", err)
+			return "", http.StatusServiceUnavailable, errors.New("token review failed")
+		}
+		if !review.Status.Authenticated {
+			return "", http.StatusUnauthorized, fmt.Errorf("token not authenticated: %s", review.Status.Error)
+		}
+		if review.Status.User.Username != collAllowedSA {
+			return "", http.StatusForbidden, fmt.Errorf("service account '%s' not allowed", review.Status.User.Username)
+		}
+		// bound tokens (kubernetes 1.30 and newer) name the node of the pod,
+		// without it any plugin pod could push data for any node
+		nodes := review.Status.User.Extra[kubeNodeNameExtra]
+		if len(nodes) == 0 {
+			return "", http.StatusForbidden, errors.New("token not bound to a node")
+		}
+		if nodes[0] != nodename {
+			return "", http.StatusForbidden, fmt.Errorf("token of node '%s' not valid for node '%s'", nodes[0], nodename)
+		}
+		identity = nodename
+	}
+
+	return identity, http.StatusOK, nil
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Prometheus exporter for the s390 zcrypt kubernetes device plugin
+ * Authentication of the cex plugin apps pushing metrics data
+ */
+
+// run with
+// $ go test -run Auth
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthClientCertificate(t *testing.T) {
+	savedir, savereview := collTLSDir, collTokenReview
+	defer func() { collTLSDir, collTokenReview = savedir, savereview }()
+	collTLSDir, collTokenReview = "/tls", false
+
+	var tests = []struct {
+		cert     *x509.Certificate // nil if no client certificate is sent
+		nodename string
+		status   int
+	}{
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "worker-1"}}, "worker-1", http.StatusOK},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "client"}, DNSNames: []string{"worker-1"}}, "worker-1", http.StatusOK},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "worker-2"}}, "worker-1", http.StatusForbidden},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "client"}, DNSNames: []string{"worker-2"}}, "worker-1", http.StatusForbidden},
+		{nil, "worker-1", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, collAPIPath, nil)
+		r.TLS = &tls.ConnectionState{}
+		if test.cert != nil {
+			r.TLS.PeerCertificates = []*x509.Certificate{test.cert}
+		}
+		identity, status, err := collAuthenticate(r, test.nodename)
+		if status != test.status {
+			t.Errorf(`collAuthenticate for node "%s" returned status %d (%v), expected %d`, test.nodename, status, err, test.status)
+		}
+		if status == http.StatusOK && identity != test.nodename {
+			t.Errorf(`collAuthenticate for node "%s" returned identity "%s"`, test.nodename, identity)
+		}
+	}
+}
+
+func TestAuthTokenReview(t *testing.T) {
+	savedir, savereview, savefunc := collTLSDir, collTokenReview, reviewTokenFunc
+	defer func() { collTLSDir, collTokenReview, reviewTokenFunc = savedir, savereview, savefunc }()
+	collTLSDir, collTokenReview = "", true
+
+	reviewTokenFunc = func(token string) (*tokenreview_s, error) {
+		review := &tokenreview_s{}
+		review.Status.User.Username = collAllowedSA
+		review.Status.User.Extra = map[string][]string{}
+		switch token {
+		case "worker-1":
+			review.Status.Authenticated = true
+			review.Status.User.Extra[kubeNodeNameExtra] = []string{"worker-1"}
+		case "nonode":
+			review.Status.Authenticated = true
+		case "othersa":
+			review.Status.Authenticated = true
+			review.Status.User.Username = "system:serviceaccount:default:default"
+			review.Status.User.Extra[kubeNodeNameExtra] = []string{"worker-1"}
+		case "unavailable":
+			return nil, errors.New("Auth: TokenReview failed")
+		}
+		return review, nil
+	}
+
+	var tests = []struct {
+		token    string // empty if no token is sent
+		nodename string
+		status   int
+	}{
+		{"worker-1", "worker-1", http.StatusOK},
+		{"worker-1", "worker-2", http.StatusForbidden},
+		{"nonode", "worker-1", http.StatusForbidden},
+		{"othersa", "worker-1", http.StatusForbidden},
+		{"invalid", "worker-1", http.StatusUnauthorized},
+		{"unavailable", "worker-1", http.StatusServiceUnavailable},
+		{"", "worker-1", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, collAPIPath, nil)
+		if len(test.token) > 0 {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		identity, status, err := collAuthenticate(r, test.nodename)
+		if status != test.status {
+			t.Errorf(`collAuthenticate with token "%s" for node "%s" returned status %d (%v), expected %d`,
+				test.token, test.nodename, status, err, test.status)
+		}
+		if status == http.StatusOK && identity != test.nodename {
+			t.Errorf(`collAuthenticate with token "%s" for node "%s" returned identity "%s"`, test.token, test.nodename, identity)
+		}
+	}
+}
@@ -22,37 +22,69 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"mime"
 	"net"
-	"strings"
+	"net/http"
 	"time"
 )
 
+const (
+	// the versioned path of the metrics push api, an incompatible change
+	// of the data structs below requires a new version
+	collAPIPath     = "/v1/metrics"
+	collMaxBodySize = 4 * 1024 * 1024 // limit of the pushed json data
+)
+
 var (
-	collPort       = getenvint("COLLECTOR_SERVICE_PORT", 12358, 0) // the metrics collector listener port
-	collTCPTimeout = 5 * time.Second                               // read and write timeout for all TCP connections
+	collPort    = getenvint("COLLECTOR_SERVICE_PORT", 12358, 0) // the metrics collector listener port
+	collTimeout = 5 * time.Second                               // read and write timeout for all connections
 )
 
 // data structs for the metrics data pushed by the cex plugin apps
 type cset_mc_data_s struct {
-	Setname          string // cex config set name
-	Total_plugindevs int    // total nr of plugin devices in this set
-	Used_plugindevs  int    // nr of plugin devices currently in use in this set
-	Request_counter  int    // current sum of request counters for all cex resources (APQNs) in this set
+	Setname          string         // cex config set name
+	Total_plugindevs int            // total nr of plugin devices in this set
+	Used_plugindevs  int            // nr of plugin devices currently in use in this set
+	Request_counter  int            // current sum of request counters for all cex resources (APQNs) in this set
+	Filtered_apqns   map[string]int // nr of APQNs not announced in this set per reason (like "cexmode")
+	Unhealthy_apqns  map[string]int // nr of announced but unhealthy APQNs in this set per reason (like "checkstopped")
+}
+type container_mc_data_s struct {
+	Nodename        string  // nodename of the cex plugin app, set by the disposer
+	Namespace       string  // namespace of the pod
+	Pod             string  // pod name
+	Container       string  // container name
+	Setname         string  // cex config set of the plugin devices used by the container
+	Request_counter float64 // requests attributed to the container since it has been seen first
+	Queue_depth     int     // pending and queued requests on the APQNs of the container
+	Load            int     // sum of the load of the APQNs of the container
+	Shared          bool    // the APQNs are shared with other containers, the request counter is estimated
+	Latency         float64 // request latency estimated from queue depth and request rate, 0 if no requests
 }
 type mc_data_s struct {
-	timestamp        time.Time         // received time
-	Nodename         string            // nodename of the cex plugin app
-	Total_plugindevs int               // total nr of plugin devices provided
-	Used_plugindevs  int               // nr of plugin devices currently in use
-	Request_counter  int               // current sum of request couters for all cex resources (APQNs)
-	Csets            []*cset_mc_data_s // array holding per cex config set data
+	Nodename         string                 // nodename of the cex plugin app
+	Timestamp        time.Time              // time the data has been prepared by the cex plugin app
+	Total_plugindevs int                    // total nr of plugin devices provided
+	Used_plugindevs  int                    // nr of plugin devices currently in use
+	Request_counter  int                    // current sum of request couters for all cex resources (APQNs)
+	Config_rejected  bool                   // latest crypto config revision has been rejected by this cex plugin app
+	Csets            []*cset_mc_data_s      // array holding per cex config set data
+	Containers       []*container_mc_data_s // array holding per container data
+}
+
+// reply to a push, on failure with the reason
+type coll_reply_s struct {
+	Status string // "ok" or "error"
+	Error  string `json:",omitempty"`
 }
 
 type MetricsCollector struct {
-	li net.Listener
+	srv *http.Server
 }
 
 func NewMetricsCollector() *MetricsCollector {
@@ -60,11 +92,45 @@ func NewMetricsCollector() *MetricsCollector {
 	return &MetricsCollector{}
 }
 
+// newMux returns the handler of the push api, pushes to other paths (like
+// another api version) are rejected
+func (mc *MetricsCollector) newMux() *http.ServeMux {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(collAPIPath, mc.handlePush)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		collReply(w, http.StatusNotFound, "unknown api path '%s', supported is %s", r.URL.Path, collAPIPath)
+	})
+
+	return mux
+}
+
 func (mc *MetricsCollector) Start() error {
 
 	log.Println("Collector: Start()")
 
-	go mc.loop()
+	mc.srv = &http.Server{
+		Addr:              fmt.Sprintf(":%d", collPort),
+		Handler:           mc.newMux(),
+		ReadHeaderTimeout: collTimeout,
+		ReadTimeout:       collTimeout,
+		WriteTimeout:      collTimeout,
+	}
+	li, err := net.Listen("tcp", mc.srv.Addr)
+	if err != nil {
+		return fmt.Errorf("Collector: Listen on port %d failed: %w", collPort, err)
+	}
+	if li, err = collTLSListener(li); err != nil {
+		return err
+	}
+	log.Printf("Collector: Listening on port %d\n", collPort)
+
+	go func() {
+		err := mc.srv.Serve(li)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Collector: http server error: %s\n", err)
+		}
+	}()
 
 	return nil
 }
@@ -73,82 +139,82 @@ func (mc *MetricsCollector) Stop() {
 
 	log.Println("Collector: Stop()")
 
-	if mc.li != nil {
-		mc.li.Close()
-		mc.li = nil
+	if mc.srv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), collTimeout)
+		defer cancel()
+		mc.srv.Shutdown(ctx)
+		mc.srv = nil
 	}
 }
 
-func (mc *MetricsCollector) loop() {
-
-	var err error
-
-	mc.li, err = net.Listen("tcp", fmt.Sprintf(":%d", collPort))
-	if err != nil {
-		log.Fatalf("Collector: Listen on port %d failed: %s\n", collPort, err)
-	}
-	log.Printf("Collector: Listening on port %d\n", collPort)
+func collReply(w http.ResponseWriter, code int, format string, args ...any) {
 
-	for {
-		con, err := mc.li.Accept()
-		if err != nil {
-			log.Printf("Collector: Accept on port %d failed: %s\n", collPort, err)
-			break
-		}
-		//log.Printf("Collector: new connection from %s\n", con.RemoteAddr())
-		go mc.handleConnection(con)
-	}
-
-	if mc.li != nil {
-		mc.li.Close()
+	reply := &coll_reply_s{Status: "ok"}
+	if code != http.StatusOK {
+		reply.Status = "error"
+		reply.Error = fmt.Sprintf(format, args...)
 	}
+	data, _ := json.Marshal(reply)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
 }
 
-func (mc *MetricsCollector) handleConnection(con net.Conn) bool {
+// handlePush receives the metrics data of one cex plugin app. Unknown
+// json fields are ignored, so newer plugins may add fields.
+func (mc *MetricsCollector) handlePush(w http.ResponseWriter, r *http.Request) {
 
 	var mcd mc_data_s
-	buf := make([]byte, 16*1024)
 
-	defer con.Close()
-
-	con.SetReadDeadline(time.Now().Add(collTCPTimeout))
-	n, err := con.Read(buf)
-	if err != nil {
-		log.Printf("Collector: Connection read error: %s\n", err)
-		return false
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		collReply(w, http.StatusMethodNotAllowed, "method %s not allowed, use POST", r.Method)
+		return
 	}
-	if n == len(buf) {
-		log.Println("Collector: Receive buffer exceeded !!!")
-		return false
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		collReply(w, http.StatusUnsupportedMediaType, "content type '%s' not supported, use application/json",
+			r.Header.Get("Content-Type"))
+		return
 	}
-
-	log.Printf("Collector: received %d bytes from client %s\n", n, con.RemoteAddr())
-
-	if err := json.Unmarshal(buf[0:n], &mcd); err != nil {
-		log.Printf("Collector: Error parsing raw metrics data from client %s: %s\n", con.RemoteAddr(), err)
-		return false
+	r.Body = http.MaxBytesReader(w, r.Body, collMaxBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&mcd); err != nil {
+		var maxerr *http.MaxBytesError
+		if errors.As(err, &maxerr) {
+			log.Printf("Collector: Metrics data from client %s exceeds %d bytes\n", r.RemoteAddr, collMaxBodySize)
+			collReply(w, http.StatusRequestEntityTooLarge, "metrics data exceeds %d bytes", collMaxBodySize)
+			return
+		}
+		log.Printf("Collector: Error parsing raw metrics data from client %s: %s\n", r.RemoteAddr, err)
+		collReply(w, http.StatusBadRequest, "error parsing metrics data: %s", err)
+		return
 	}
-	mcd.timestamp = time.Now()
-
-	con.SetWriteDeadline(time.Now().Add(collTCPTimeout))
-	if _, err = con.Write([]byte("ok\n")); err != nil {
-		log.Printf("Collector: Connection write error: %s\n", err)
-		return false
+	if len(mcd.Nodename) == 0 {
+		collReply(w, http.StatusBadRequest, "metrics data without Nodename")
+		return
 	}
+	identity, code, err := collAuthenticate(r, mcd.Nodename)
+	if err != nil {
+		log.Printf("Collector: Rejected metrics data from client %s: %s\n", r.RemoteAddr, err)
+		collReply(w, code, "%s", err)
+		return
+	}
+	log.Printf("Collector: received metrics data from client %s\n", r.RemoteAddr)
 
 	// for debugging:
-	//fmt.Printf("Collector: metrics data from client %s:\n", con.RemoteAddr())
+	//fmt.Printf("Collector: metrics data from client %s:\n", r.RemoteAddr)
 	//fmt.Printf("Collector:   Nodename '%s' Total_plugindevs %d Used_plugindevs %d Request_counter %d\n",
 	//	mcd.Nodename, mcd.Total_plugindevs, mcd.Used_plugindevs, mcd.Request_counter)
-	//fmt.Printf("Collector:   and %d config set metrics data:\n", len(mcd.Csets))
-	//for _, mcs := range mcd.Csets {
-	//	fmt.Printf("Collector:     Setname '%s' Total_plugindevs %d Used_plugindevs %d Request_counter %d\n",
-	//		mcs.Setname, mcs.Total_plugindevs, mcs.Used_plugindevs, mcs.Request_counter)
-	//}
 
-	raddr := con.RemoteAddr().String()
-	ipaddr := raddr[0:strings.LastIndexByte(raddr, ':')]
-	dpStoreNodeMetricsData(ipaddr, &mcd)
+	// authenticated data is stored per node, otherwise per remote ip
+	if len(identity) > 0 {
+		dpStoreNodeMetricsData(identity, &mcd)
+	} else {
+		ipaddr, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ipaddr = r.RemoteAddr
+		}
+		dpStoreNodeMetricsData(ipaddr, &mcd)
+	}
 
-	return true
+	collReply(w, http.StatusOK, "")
 }
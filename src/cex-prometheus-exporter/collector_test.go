@@ -0,0 +1,96 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Prometheus exporter for the s390 zcrypt kubernetes device plugin
+ * Metrics collector receiving the data pushed by the cex plugin apps
+ */
+
+// run with
+// $ go test -run Coll
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCollHandlePush(t *testing.T) {
+	savedir, savereview, savedata := collTLSDir, collTokenReview, node_mc_data
+	defer func() { collTLSDir, collTokenReview, node_mc_data = savedir, savereview, savedata }()
+	collTLSDir, collTokenReview = "", false
+
+	var tests = []struct {
+		name        string
+		method      string
+		path        string
+		contenttype string
+		body        string
+		code        int
+		stored      bool // the data is stored by the disposer
+	}{
+		{"successful push", http.MethodPost, collAPIPath, "application/json",
+			`{"Nodename":"worker-1","Total_plugindevs":4,"Used_plugindevs":1}`, http.StatusOK, true},
+		{"content type with charset", http.MethodPost, collAPIPath, "application/json; charset=utf-8",
+			`{"Nodename":"worker-1"}`, http.StatusOK, true},
+		{"unknown fields are ignored", http.MethodPost, collAPIPath, "application/json",
+			`{"Nodename":"worker-1","Newfield":1}`, http.StatusOK, true},
+		{"api version mismatch", http.MethodPost, "/v2/metrics", "application/json",
+			`{"Nodename":"worker-1"}`, http.StatusNotFound, false},
+		{"wrong method", http.MethodGet, collAPIPath, "", "", http.StatusMethodNotAllowed, false},
+		{"wrong content type", http.MethodPost, collAPIPath, "text/plain",
+			`{"Nodename":"worker-1"}`, http.StatusUnsupportedMediaType, false},
+		{"bad json", http.MethodPost, collAPIPath, "application/json",
+			`{"Nodename":"worker-1",`, http.StatusBadRequest, false},
+		{"json type mismatch", http.MethodPost, collAPIPath, "application/json",
+			`{"Nodename":"worker-1","Total_plugindevs":"four"}`, http.StatusBadRequest, false},
+		{"no nodename", http.MethodPost, collAPIPath, "application/json",
+			`{"Total_plugindevs":4}`, http.StatusBadRequest, false},
+		{"body too large", http.MethodPost, collAPIPath, "application/json",
+			`{"Nodename":"` + strings.Repeat("x", collMaxBodySize) + `"}`, http.StatusRequestEntityTooLarge, false},
+	}
+	mux := NewMetricsCollector().newMux()
+	for _, test := range tests {
+		node_mc_data = map[string]*node_entry_s{}
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if len(test.contenttype) > 0 {
+			r.Header.Set("Content-Type", test.contenttype)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf(`%s: push returned status %d, expected %d: %s`, test.name, w.Code, test.code, w.Body.String())
+		}
+		var reply coll_reply_s
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+			t.Errorf(`%s: reply "%s" is not valid json: %s`, test.name, w.Body.String(), err)
+		} else if (reply.Status == "ok") != (test.code == http.StatusOK) || (reply.Status != "ok" && len(reply.Error) == 0) {
+			t.Errorf(`%s: reply has status "%s" error "%s" for http status %d`, test.name, reply.Status, reply.Error, w.Code)
+		}
+		if test.method != http.MethodPost && w.Header().Get("Allow") != http.MethodPost {
+			t.Errorf(`%s: reply has Allow header "%s", expected "%s"`, test.name, w.Header().Get("Allow"), http.MethodPost)
+		}
+		// without authentication the data is stored per remote ip
+		e, found := node_mc_data["192.0.2.1"]
+		if found != test.stored {
+			t.Errorf(`%s: metrics data stored is %t, expected %t`, test.name, found, test.stored)
+		} else if found && e.nodename != "worker-1" {
+			t.Errorf(`%s: metrics data stored for node "%s", expected "worker-1"`, test.name, e.nodename)
+		}
+	}
+}
@@ -30,10 +30,13 @@ import (
 
 // data structs to hold the accumulated metrics data from the cex plugin apps
 type cluster_mc_data_s struct {
-	Total_plugindevs int               // total nr of plugin devices provided
-	Used_plugindevs  int               // nr of plugin devices currently in use
-	Request_counter  int               // current sum of request couters for all cex resources (APQNs)
-	Cset_mc_data     []*cset_mc_data_s // slice holding per cex config set data
+	Total_plugindevs  int                    // total nr of plugin devices provided
+	Used_plugindevs   int                    // nr of plugin devices currently in use
+	Request_counter   int                    // current sum of request couters for all cex resources (APQNs)
+	Config_rejected   int                    // nr of cex plugin apps which rejected the latest crypto config revision
+	Cset_mc_data      []*cset_mc_data_s      // slice holding per cex config set data
+	Container_mc_data []*container_mc_data_s // slice holding per container data of all nodes
+	Nodes_up          map[string]bool        // per nodename: the latest metrics data is available and up to date
 }
 
 var (
@@ -44,17 +47,32 @@ var (
 func dumpClusterMcData(cmc *cluster_mc_data_s) {
 
 	log.Printf("Disposer: Cluster metrics data:\n")
-	log.Printf("Disposer:   Total_plugindevs %d Used_plugindevs %d Request_counter %d\n",
-		cmc.Total_plugindevs, cmc.Used_plugindevs, cmc.Request_counter)
+	log.Printf("Disposer:   Total_plugindevs %d Used_plugindevs %d Request_counter %d Config_rejected %d\n",
+		cmc.Total_plugindevs, cmc.Used_plugindevs, cmc.Request_counter, cmc.Config_rejected)
 	for _, cs := range cmc.Cset_mc_data {
 		log.Printf("Disposer:     Setname '%s' Total_plugindevs %d Used_plugindevs %d Request_counter %d\n",
 			cs.Setname, cs.Total_plugindevs, cs.Used_plugindevs, cs.Request_counter)
 	}
 }
 
-// latest metrics data per node (ipaddr)
 var (
-	node_mc_data       = map[string]*mc_data_s{}
+	// metrics data older than this is not used and the node is reported down
+	dpStaleTime = time.Duration(getenvint("NODE_DATA_STALE_TIME", 60, 10)) * time.Second
+	// a node not seen for this time is forgotten, at least after dpStaleTime
+	dpPurgeTime = max(time.Duration(getenvint("NODE_DATA_PURGE_TIME", 600, 0))*time.Second, dpStaleTime)
+)
+
+// node_entry_s holds the latest metrics data of a cex plugin app
+type node_entry_s struct {
+	nodename string
+	mcd      *mc_data_s // latest metrics data, nil if none has been received yet
+	up       bool       // the latest push or scrape succeeded
+	lastseen time.Time  // time of the latest push or scrape attempt
+}
+
+// latest metrics data per node (nodename if authenticated or scraped, else ipaddr)
+var (
+	node_mc_data       = map[string]*node_entry_s{}
 	node_mc_data_mutex = sync.Mutex{}
 )
 
@@ -74,15 +92,35 @@ func updateClusterMcData() {
 	var cmc *cluster_mc_data_s = new(cluster_mc_data_s)
 	var cset []*cset_mc_data_s
 
+	cmc.Nodes_up = map[string]bool{}
+	now := time.Now()
+
 	node_mc_data_mutex.Lock()
-	// purge mc data for nodes with timestamp older than 60s
-	for k, mcd := range node_mc_data {
-		if mcd.timestamp.Add(60 * time.Second).Before(time.Now()) {
+	// purge nodes which have not been seen for dpPurgeTime
+	for k, ne := range node_mc_data {
+		if ne.lastseen.Add(dpPurgeTime).Before(now) {
+			log.Printf("Disposer: purge node %s ('%s')\n", k, ne.nodename)
 			delete(node_mc_data, k)
 		}
 	}
 	// add mc data for the remaining nodes to the cluster metrics data
-	for _, mcd := range node_mc_data {
+	for _, ne := range node_mc_data {
+		mcd := ne.mcd
+		// judged on the time the data has been prepared, so the data of a
+		// cex plugin app which hangs gets stale even if it is still served
+		fresh := mcd != nil && mcd.Timestamp.Add(dpStaleTime).After(now)
+		// after a restart a plugin may push from a new ipaddr
+		cmc.Nodes_up[ne.nodename] = cmc.Nodes_up[ne.nodename] || (ne.up && fresh)
+		if !fresh {
+			continue
+		}
+		if mcd.Config_rejected {
+			cmc.Config_rejected++
+		}
+		for _, c := range mcd.Containers {
+			c.Nodename = mcd.Nodename
+			cmc.Container_mc_data = append(cmc.Container_mc_data, c)
+		}
 		for _, cs := range mcd.Csets {
 			found := false
 			var s *cset_mc_data_s
@@ -100,6 +138,18 @@ func updateClusterMcData() {
 			s.Total_plugindevs += cs.Total_plugindevs
 			s.Used_plugindevs += cs.Used_plugindevs
 			s.Request_counter += cs.Request_counter
+			for reason, n := range cs.Filtered_apqns {
+				if s.Filtered_apqns == nil {
+					s.Filtered_apqns = map[string]int{}
+				}
+				s.Filtered_apqns[reason] += n
+			}
+			for reason, n := range cs.Unhealthy_apqns {
+				if s.Unhealthy_apqns == nil {
+					s.Unhealthy_apqns = map[string]int{}
+				}
+				s.Unhealthy_apqns[reason] += n
+			}
 		}
 	}
 	node_mc_data_mutex.Unlock()
@@ -117,6 +167,7 @@ func updateClusterMcData() {
 		Cluster_mc_data.Total_plugindevs != cmc.Total_plugindevs ||
 		Cluster_mc_data.Used_plugindevs != cmc.Used_plugindevs ||
 		Cluster_mc_data.Request_counter != cmc.Request_counter ||
+		Cluster_mc_data.Config_rejected != cmc.Config_rejected ||
 		len(Cluster_mc_data.Cset_mc_data) != len(cmc.Cset_mc_data) {
 		dumpClusterMcData(cmc)
 	}
@@ -124,15 +175,58 @@ func updateClusterMcData() {
 	Cluster_mc_data_mutex.Unlock()
 }
 
-func dpStoreNodeMetricsData(ipaddr string, mcd *mc_data_s) {
+// dpStoreNodeMetricsData stores the metrics data of a node, the key is
+// the nodename if authenticated or scraped, else the client ipaddr
+func dpStoreNodeMetricsData(key string, mcd *mc_data_s) {
+
+	log.Printf("Disposer: new metrics data from %s ('%s')\n", key, mcd.Nodename)
 
-	log.Printf("Disposer: new metrics data from %s ('%s')\n", ipaddr, mcd.Nodename)
+	// dumpMcData(fmt.Sprintf("mc data from %s", key), mcd)
 
-	// dumpMcData(fmt.Sprintf("mc data from %s", ipaddr), mcd)
+	now := time.Now()
+	// older cex plugin apps don't send the time the data has been prepared,
+	// and a clock ahead of ours would keep the data fresh for too long
+	if mcd.Timestamp.IsZero() || mcd.Timestamp.After(now) {
+		mcd.Timestamp = now
+	}
 
 	node_mc_data_mutex.Lock()
-	node_mc_data[ipaddr] = mcd
+	node_mc_data[key] = &node_entry_s{
+		nodename: mcd.Nodename,
+		mcd:      mcd,
+		up:       true,
+		lastseen: now,
+	}
 	node_mc_data_mutex.Unlock()
 
 	updateClusterMcData()
 }
+
+// dpNodeDown records a failed scrape of a node. The latest metrics data
+// is still used until it gets stale, but the node is reported down.
+func dpNodeDown(nodename string) {
+
+	node_mc_data_mutex.Lock()
+	ne, found := node_mc_data[nodename]
+	if !found {
+		ne = &node_entry_s{nodename: nodename}
+		node_mc_data[nodename] = ne
+	}
+	ne.up = false
+	ne.lastseen = time.Now()
+	node_mc_data_mutex.Unlock()
+}
+
+// dpKeepNodes forgets all nodes except the given ones, like the nodes
+// with a running cex plugin pod in pull mode
+func dpKeepNodes(nodenames map[string]bool) {
+
+	node_mc_data_mutex.Lock()
+	for k, ne := range node_mc_data {
+		if !nodenames[k] {
+			log.Printf("Disposer: forget node %s ('%s')\n", k, ne.nodename)
+			delete(node_mc_data, k)
+		}
+	}
+	node_mc_data_mutex.Unlock()
+}
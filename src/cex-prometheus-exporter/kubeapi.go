@@ -0,0 +1,121 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Prometheus exporter for the s390 zcrypt kubernetes device plugin
+ * Minimal client for the kubernetes api server
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	kubeSATokenFile     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubeSACAFile        = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	kubeSANamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+var (
+	kubeclient      *http.Client
+	kubeclientmutex sync.Mutex
+)
+
+// kubeNamespace returns the namespace the exporter runs in
+func kubeNamespace() string {
+
+	ns, err := os.ReadFile(kubeSANamespaceFile)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(ns))
+}
+
+// kubeAPIRequest sends a request to the kubernetes api server with the
+// service account of the exporter. The request data is sent as json and
+// the json reply is decoded into reply.
+func kubeAPIRequest(method, path string, request, reply any) error {
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if len(host) == 0 || len(port) == 0 {
+		return errors.New("KubeAPI: Not running within a kubernetes cluster")
+	}
+	// the token is rotated by the kubelet, so read it each time
+	satoken, err := os.ReadFile(kubeSATokenFile)
+	if err != nil {
+		return fmt.Errorf("KubeAPI: Can't read service account token: %w", err)
+	}
+
+	kubeclientmutex.Lock()
+	if kubeclient == nil {
+		capem, err := os.ReadFile(kubeSACAFile)
+		if err != nil {
+			kubeclientmutex.Unlock()
+			return fmt.Errorf("KubeAPI: Can't read service account CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(capem)
+		kubeclient = &http.Client{
+			Timeout:   collTimeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}},
+		}
+	}
+	client := kubeclient
+	kubeclientmutex.Unlock()
+
+	var body io.Reader
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return fmt.Errorf("KubeAPI: Can't encode request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "https://"+net.JoinHostPort(host, port)+path, body)
+	if err != nil {
+		return fmt.Errorf("KubeAPI: Can't create request: %w", err)
+	}
+	if request != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(satoken)))
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("KubeAPI: %s %s failed: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("KubeAPI: %s %s failed: %s", method, path, resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(reply); err != nil {
+		return fmt.Errorf("KubeAPI: Can't decode reply of %s %s: %w", method, path, err)
+	}
+
+	return nil
+}
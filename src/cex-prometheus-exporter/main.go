@@ -29,6 +29,8 @@ import (
 	"strconv"
 )
 
+var collMode = getenvstr("COLLECTOR_MODE", "push")
+
 var (
 	version    = "development"
 	git_url    = "https://github.com/ibm-s390-cloud/k8s-cex-dev-plugin.git"
@@ -51,6 +53,14 @@ func getenvint(envvar string, defaultval, minval int) int {
 	return defaultval
 }
 
+func getenvstr(envvar, defaultval string) string {
+	valstr, isset := os.LookupEnv(envvar)
+	if isset {
+		return valstr
+	}
+	return defaultval
+}
+
 func main() {
 
 	versionarg := flag.Bool("version", false, "Print version and exit")
@@ -69,21 +79,30 @@ func main() {
 		os.Exit(0)
 	}
 
-	// start metrics data collector server
-	mc := NewMetricsCollector()
-	if err := mc.Start(); err != nil {
-		log.Fatalf("Main: MetricsCollector Start failed: %s\n", err)
+	// push mode: the cex plugin apps push their data to the collector server
+	// pull mode: the scraper fetches the data from the cex plugin apps
+	switch collMode {
+	case "push":
+		mc := NewMetricsCollector()
+		if err := mc.Start(); err != nil {
+			log.Fatalf("Main: MetricsCollector Start failed: %s\n", err)
+		}
+		defer mc.Stop()
+	case "pull":
+		sc := NewScraper()
+		if err := sc.Start(); err != nil {
+			log.Fatalf("Main: Scraper Start failed: %s\n", err)
+		}
+		defer sc.Stop()
+	default:
+		log.Fatalf("Main: Invalid COLLECTOR_MODE '%s', supported are push and pull\n", collMode)
 	}
 
 	// run the prometheus api loop
 	promLoop()
 
-	// stop metrics data collector server
-	mc.Stop()
-
 	log.Println("Main: S390 k8s cex plugin prometheus exporter terminating")
 }
 
 // TODO:
 // - provide nr of cex plugings running
-// - use timestamp of the node data
@@ -65,6 +65,14 @@ func promLoop() {
 		})
 	prometheus.MustRegister(total_request_counter)
 	log.Println("Promstuff: Prometheus Gauge cex_plugin_total_request_counter created")
+	config_rejected := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: "cex_plugin",
+			Name:      "config_rejected",
+			Help:      "Number of CEX plugins which rejected the latest crypto configuration revision",
+		})
+	prometheus.MustRegister(config_rejected)
+	log.Println("Promstuff: Prometheus Gauge cex_plugin_config_rejected created")
 	plugindevs_available := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Subsystem: "cex_plugin",
@@ -95,6 +103,89 @@ func promLoop() {
 	)
 	prometheus.MustRegister(request_counter)
 	log.Println("Promstuff: Prometheus GaugeVec cex_plugin_request_counter created")
+	filtered_apqns := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "cex_plugin",
+			Name:      "filtered_apqns",
+			Help:      "Number of APQNs not announced because of a mismatch with the configset, partitioned by configset and reason",
+		},
+		[]string{"setname", "reason"},
+	)
+	prometheus.MustRegister(filtered_apqns)
+	log.Println("Promstuff: Prometheus GaugeVec cex_plugin_filtered_apqns created")
+	unhealthy_apqns := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "cex_plugin",
+			Name:      "unhealthy_apqns",
+			Help:      "Number of announced APQNs which are not healthy, partitioned by configset and reason",
+		},
+		[]string{"setname", "reason"},
+	)
+	prometheus.MustRegister(unhealthy_apqns)
+	log.Println("Promstuff: Prometheus GaugeVec cex_plugin_unhealthy_apqns created")
+
+	containerlabels := []string{"nodename", "namespace", "pod", "container", "setname"}
+	container_request_counter := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "cex_plugin",
+			Name:      "container_request_counter",
+			Help:      "Requests processed for a container, estimated if the APQNs are shared with other containers",
+		},
+		containerlabels,
+	)
+	prometheus.MustRegister(container_request_counter)
+	log.Println("Promstuff: Prometheus GaugeVec cex_plugin_container_request_counter created")
+	container_queue_depth := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "cex_plugin",
+			Name:      "container_queue_depth",
+			Help:      "Pending and queued requests on the APQNs used by a container",
+		},
+		containerlabels,
+	)
+	prometheus.MustRegister(container_queue_depth)
+	log.Println("Promstuff: Prometheus GaugeVec cex_plugin_container_queue_depth created")
+	container_load := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "cex_plugin",
+			Name:      "container_load",
+			Help:      "Sum of the load of the APQNs used by a container",
+		},
+		containerlabels,
+	)
+	prometheus.MustRegister(container_load)
+	log.Println("Promstuff: Prometheus GaugeVec cex_plugin_container_load created")
+	container_shared := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "cex_plugin",
+			Name:      "container_shared",
+			Help:      "1 if the APQNs used by a container are shared with other containers and the request counter is estimated, 0 if not",
+		},
+		containerlabels,
+	)
+	prometheus.MustRegister(container_shared)
+	log.Println("Promstuff: Prometheus GaugeVec cex_plugin_container_shared created")
+	container_latency := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "cex_plugin",
+			Name:      "container_latency_estimate_seconds",
+			Help:      "Request latency of a container estimated from the queue depth and the request rate of the APQNs",
+		},
+		containerlabels,
+	)
+	prometheus.MustRegister(container_latency)
+	log.Println("Promstuff: Prometheus GaugeVec cex_plugin_container_latency_estimate_seconds created")
+
+	node_up := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "cex_plugin",
+			Name:      "node_up",
+			Help:      "1 if the latest metrics data of the cex plugin on a node is available and up to date, 0 if not",
+		},
+		[]string{"nodename"},
+	)
+	prometheus.MustRegister(node_up)
+	log.Println("Promstuff: Prometheus GaugeVec cex_plugin_node_up created")
 
 	// start the prometheus metrics http interface
 	http.Handle("/metrics", promhttp.Handler())
@@ -108,24 +199,58 @@ func promLoop() {
 
 	// loop and update the prometheus objects
 	for {
+		// let the data of nodes gone silent get stale
+		updateClusterMcData()
 		Cluster_mc_data_mutex.Lock()
-		if Cluster_mc_data == nil {
-			Cluster_mc_data_mutex.Unlock()
-			continue
-		}
 		total_plugindevs_available.Set(float64(Cluster_mc_data.Total_plugindevs))
 		total_plugindevs_used.Set(float64(Cluster_mc_data.Used_plugindevs))
 		total_request_counter.Set(float64(Cluster_mc_data.Request_counter))
+		config_rejected.Set(float64(Cluster_mc_data.Config_rejected))
 		if tlast.Add(10 * time.Minute).Before(time.Now()) {
 			plugindevs_available.Reset()
 			plugindevs_used.Reset()
 			request_counter.Reset()
 		}
+		filtered_apqns.Reset()
+		unhealthy_apqns.Reset()
 		for _, cs := range Cluster_mc_data.Cset_mc_data {
 			sn := cs.Setname
 			plugindevs_available.WithLabelValues(sn).Set(float64(cs.Total_plugindevs))
 			plugindevs_used.WithLabelValues(sn).Set(float64(cs.Used_plugindevs))
 			request_counter.WithLabelValues(sn).Set(float64(cs.Request_counter))
+			for reason, n := range cs.Filtered_apqns {
+				filtered_apqns.WithLabelValues(sn, reason).Set(float64(n))
+			}
+			for reason, n := range cs.Unhealthy_apqns {
+				unhealthy_apqns.WithLabelValues(sn, reason).Set(float64(n))
+			}
+		}
+		node_up.Reset()
+		for nn, up := range Cluster_mc_data.Nodes_up {
+			if up {
+				node_up.WithLabelValues(nn).Set(1)
+			} else {
+				node_up.WithLabelValues(nn).Set(0)
+			}
+		}
+		container_request_counter.Reset()
+		container_queue_depth.Reset()
+		container_load.Reset()
+		container_shared.Reset()
+		container_latency.Reset()
+		for _, c := range Cluster_mc_data.Container_mc_data {
+			labels := []string{c.Nodename, c.Namespace, c.Pod, c.Container, c.Setname}
+			container_request_counter.WithLabelValues(labels...).Set(c.Request_counter)
+			container_queue_depth.WithLabelValues(labels...).Set(float64(c.Queue_depth))
+			container_load.WithLabelValues(labels...).Set(float64(c.Load))
+			if c.Shared {
+				container_shared.WithLabelValues(labels...).Set(1)
+			} else {
+				container_shared.WithLabelValues(labels...).Set(0)
+			}
+			if c.Latency > 0 {
+				container_latency.WithLabelValues(labels...).Set(c.Latency)
+			}
 		}
 		Cluster_mc_data_mutex.Unlock()
 		time.Sleep(promGaugesUpdateInterval)
@@ -0,0 +1,274 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Prometheus exporter for the s390 zcrypt kubernetes device plugin
+ * Scraper fetching the metrics data from the cex plugin apps (pull mode)
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	scrapeNamespace = getenvstr("SCRAPE_PLUGIN_NAMESPACE", "") // namespace of the cex plugin pods, default is the own namespace
+	scrapeSelector  = getenvstr("SCRAPE_PLUGIN_SELECTOR", "name=cex-plugin")
+	scrapePort      = getenvint("SCRAPE_PLUGIN_PORT", 9941, 1) // PLUGIN_PULL_PORT of the cex plugin apps
+	scrapeInterval  = time.Duration(getenvint("SCRAPE_INTERVAL", 15, 5)) * time.Second
+	// dir with the client certificate tls.crt, tls.key of the exporter and
+	// the ca.crt of the server certificates of the cex plugin apps
+	scrapeTLSDir = getenvstr("SCRAPE_TLS_DIR", "")
+	// the pods are addressed by ip, their server certificates must be
+	// valid for this name instead
+	scrapeServerName = getenvstr("SCRAPE_PLUGIN_SERVERNAME", "cex-plugin")
+	// service account token sent with each request, not sent if empty
+	scrapeTokenFile = getenvstr("SCRAPE_TOKEN_FILE", "")
+)
+
+// the fields of the kubernetes pod list used by the scraper
+type podlist_s struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Spec struct {
+			NodeName string `json:"nodeName"`
+		} `json:"spec"`
+		Status struct {
+			Phase string `json:"phase"`
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// Scraper discovers the cex plugin pods via the kubernetes api and
+// fetches the metrics data from each of them every scrapeInterval
+type Scraper struct {
+	stopChan   chan struct{}
+	namespace  string
+	client     *http.Client
+	clientmtx  sync.Mutex
+	tlsmodtime time.Time
+}
+
+func NewScraper() *Scraper {
+
+	ns := scrapeNamespace
+	if len(ns) == 0 {
+		ns = kubeNamespace()
+	}
+
+	return &Scraper{
+		stopChan:  make(chan struct{}),
+		namespace: ns,
+	}
+}
+
+func (sc *Scraper) Start() error {
+
+	log.Println("Scraper: Start()")
+
+	if len(sc.namespace) == 0 {
+		return errors.New("Scraper: Unknown namespace of the cex plugin pods, set SCRAPE_PLUGIN_NAMESPACE")
+	}
+	if _, err := sc.getClient(); err != nil {
+		return err
+	}
+	log.Printf("Scraper: Scraping pods '%s' in namespace '%s' on port %d every %s\n",
+		scrapeSelector, sc.namespace, scrapePort, scrapeInterval)
+
+	go sc.loop()
+
+	return nil
+}
+
+func (sc *Scraper) Stop() {
+
+	log.Println("Scraper: Stop()")
+
+	close(sc.stopChan)
+}
+
+func (sc *Scraper) loop() {
+
+	tick := time.NewTicker(scrapeInterval)
+
+	sc.scrapeAll()
+ForLoop:
+	for {
+		select {
+		case <-sc.stopChan:
+			tick.Stop()
+			break ForLoop
+		case <-tick.C:
+			sc.scrapeAll()
+		}
+	}
+}
+
+// scrapeAll fetches the metrics data from all running cex plugin pods
+func (sc *Scraper) scrapeAll() {
+
+	var pods podlist_s
+	path := "/api/v1/namespaces/" + url.PathEscape(sc.namespace) +
+		"/pods?labelSelector=" + url.QueryEscape(scrapeSelector)
+	if err := kubeAPIRequest(http.MethodGet, path, nil, &pods); err != nil {
+		// keep the nodes, they get stale if this persists
+		log.Printf("Scraper: Can't list the cex plugin pods: %s\n", err)
+		return
+	}
+
+	nodes := map[string]bool{}
+	var wg sync.WaitGroup
+	for _, pod := range pods.Items {
+		nodename := pod.Spec.NodeName
+		if len(nodename) == 0 {
+			// not scheduled yet
+			continue
+		}
+		nodes[nodename] = true
+		if pod.Status.Phase != "Running" || len(pod.Status.PodIP) == 0 {
+			dpNodeDown(nodename)
+			continue
+		}
+		wg.Add(1)
+		go func(podname, podip string) {
+			defer wg.Done()
+			mcd, err := sc.scrape(podip, nodename)
+			if err != nil {
+				log.Printf("Scraper: Scrape of pod %s on node '%s' failed: %s\n", podname, nodename, err)
+				dpNodeDown(nodename)
+				return
+			}
+			// the node is taken from the pod, not from the data
+			dpStoreNodeMetricsData(nodename, mcd)
+		}(pod.Metadata.Name, pod.Status.PodIP)
+	}
+	wg.Wait()
+
+	dpKeepNodes(nodes)
+	updateClusterMcData()
+}
+
+// getClient returns the http client for the mTLS requests to the cex
+// plugin apps. The client certificate, key and the CA are loaded again
+// when the files have been updated (like a rotated Secret).
+func (sc *Scraper) getClient() (*http.Client, error) {
+
+	sc.clientmtx.Lock()
+	defer sc.clientmtx.Unlock()
+
+	if len(scrapeTLSDir) == 0 {
+		return nil, errors.New("Scraper: The metrics data is only fetched via mTLS, set SCRAPE_TLS_DIR")
+	}
+	certfile, keyfile, cafile := scrapeTLSDir+"/tls.crt", scrapeTLSDir+"/tls.key", scrapeTLSDir+"/ca.crt"
+	var modtime time.Time
+	for _, f := range []string{certfile, keyfile, cafile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, fmt.Errorf("Scraper: Can't access TLS file: %w", err)
+		}
+		if fi.ModTime().After(modtime) {
+			modtime = fi.ModTime()
+		}
+	}
+	if sc.client != nil && modtime.Equal(sc.tlsmodtime) {
+		return sc.client, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return nil, fmt.Errorf("Scraper: Can't load client certificate: %w", err)
+	}
+	capem, err := os.ReadFile(cafile)
+	if err != nil {
+		return nil, fmt.Errorf("Scraper: Can't read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(capem) {
+		return nil, fmt.Errorf("Scraper: No certificate found in CA file %s", cafile)
+	}
+	if sc.client != nil {
+		sc.client.CloseIdleConnections()
+	}
+	sc.client = &http.Client{
+		Timeout: collTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{cert},
+				RootCAs:      pool,
+				ServerName:   scrapeServerName,
+			},
+		},
+	}
+	sc.tlsmodtime = modtime
+	log.Printf("Scraper: TLS files loaded from %s\n", scrapeTLSDir)
+
+	return sc.client, nil
+}
+
+// scrape fetches the metrics data from one cex plugin pod
+func (sc *Scraper) scrape(podip, nodename string) (*mc_data_s, error) {
+
+	client, err := sc.getClient()
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(podip, strconv.Itoa(scrapePort))
+	req, err := http.NewRequest(http.MethodGet, "https://"+addr+collAPIPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(scrapeTokenFile) > 0 {
+		// the projected token is rotated by the kubelet, so read it each time
+		token, err := os.ReadFile(scrapeTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read token file: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	mcd := &mc_data_s{}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, collMaxBodySize)).Decode(mcd); err != nil {
+		return nil, fmt.Errorf("invalid metrics data: %w", err)
+	}
+	if mcd.Nodename != nodename {
+		return nil, fmt.Errorf("metrics data of node '%s' from a pod on node '%s'", mcd.Nodename, nodename)
+	}
+	return mcd, nil
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2026 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Prometheus exporter for the s390 zcrypt kubernetes device plugin
+ * Scraper fetching the metrics data from the cex plugin apps (pull mode)
+ */
+
+// run with
+// $ go test -run Scrape
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestScrapeTLS(t *testing.T) {
+	// self signed certificate, used as server certificate of the plugin
+	// pod, as client certificate of the exporter and as CA of both
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cex-prometheus-exporter"},
+		DNSNames:              []string{"cex-plugin"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf(`Can't create certificate: %s`, err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyder, _ := x509.MarshalECPrivateKey(key)
+	certpem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keypem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder})
+
+	var cn, auth string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cn = r.TLS.PeerCertificates[0].Subject.CommonName
+		auth = r.Header.Get("Authorization")
+		if r.URL.Path != collAPIPath {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"Nodename":"worker-1","Total_plugindevs":3}`))
+	}))
+	servercert, _ := tls.X509KeyPair(certpem, keypem)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{servercert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"tls.crt": certpem,
+		"tls.key": keypem,
+		"ca.crt":  certpem,
+		"token":   []byte("secret-token\n"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatalf(`Can't write %s: %s`, name, err)
+		}
+	}
+
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	saveport, savedir, savetoken := scrapePort, scrapeTLSDir, scrapeTokenFile
+	defer func() { scrapePort, scrapeTLSDir, scrapeTokenFile = saveport, savedir, savetoken }()
+	scrapePort, _ = strconv.Atoi(port)
+	scrapeTokenFile = filepath.Join(dir, "token")
+
+	sc := NewScraper()
+	scrapeTLSDir = ""
+	if _, err := sc.scrape(host, "worker-1"); err == nil {
+		t.Errorf(`scrape without SCRAPE_TLS_DIR succeeded`)
+	}
+
+	scrapeTLSDir = dir
+	mcd, err := sc.scrape(host, "worker-1")
+	if err != nil || mcd.Nodename != "worker-1" || mcd.Total_plugindevs != 3 {
+		t.Errorf(`scrape returned %+v, %v`, mcd, err)
+	}
+	if cn != "cex-prometheus-exporter" {
+		t.Errorf(`scrape presented client certificate "%s", expected "cex-prometheus-exporter"`, cn)
+	}
+	if auth != "Bearer secret-token" {
+		t.Errorf(`scrape sent Authorization "%s", expected "Bearer secret-token"`, auth)
+	}
+
+	// the data names another node than the pod
+	if _, err := sc.scrape(host, "worker-2"); err == nil {
+		t.Errorf(`scrape accepted the metrics data of another node`)
+	}
+}